@@ -26,17 +26,30 @@ func main() {
 		logger.SetGlobalLogLevel(logger.DEBUG)
 	}
 
-	plugins := plugin.InitPlugins(config.Input)
+	plugins := plugin.InitPlugins(config.Input, config.Output)
 
 	e := emitter.NewEmitter()
-	go e.Start(plugins)
+	e.Start(plugins)
+
+	// inputs reading from files stop by themselves once everything has been read
+	finished := make(chan struct{})
+	go func() {
+		e.Wait()
+		close(finished)
+	}()
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
-	<-quit
+	// reading all input files is a normal completion, being stopped by a signal is not
+	code := 0
+	select {
+	case <-quit:
+		code = 1
+	case <-finished:
+	}
 	e.Close()
 	logger.Info("Shutdown Server")
-	os.Exit(1)
+	os.Exit(code)
 }
 
 func checkConfigFile() {
@@ -5,6 +5,10 @@ go 1.20
 require (
 	github.com/google/gopacket v1.1.19
 	github.com/knadh/koanf v1.5.0
+	go.mongodb.org/mongo-driver v1.17.6
+	golang.org/x/crypto v0.33.0
+	golang.org/x/net v0.35.0
+	google.golang.org/protobuf v1.28.1
 )
 
 require (
@@ -12,6 +16,7 @@ require (
 	github.com/mitchellh/copystructure v1.2.0 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/mitchellh/reflectwalk v1.0.2 // indirect
-	golang.org/x/sys v0.0.0-20210603081109-ebe580a85c40 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
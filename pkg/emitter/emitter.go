@@ -8,7 +8,6 @@ import (
 	"net-capture/pkg/message"
 	"net-capture/pkg/plugin"
 	"sync"
-	"time"
 )
 
 func NewEmitter() *Emitter {
@@ -51,9 +50,6 @@ func (e *Emitter) Close() {
 
 // CopyMulti copies from 1 reader to multiple writers
 func CopyMulti(src message.PluginReader, writers ...message.PluginWriter) (err error) {
-	filteredCount := 0
-	filteredRequestsLastCleanTime := time.Now().UnixNano()
-	filteredRequests := make(map[string]int64)
 	for {
 		msg, er := src.PluginRead()
 		if er != nil {
@@ -71,20 +67,6 @@ func CopyMulti(src message.PluginReader, writers ...message.PluginWriter) (err e
 				}
 			}
 		}
-		// Run GC on each 1000 request
-		if filteredCount > 0 && filteredCount%1000 == 0 {
-			// Clean up filtered requests for which we didn't get a response to filter
-			now := time.Now().UnixNano()
-			if now-filteredRequestsLastCleanTime > int64(60*time.Second) {
-				for k, v := range filteredRequests {
-					if now-v > int64(60*time.Second) {
-						delete(filteredRequests, k)
-						filteredCount--
-					}
-				}
-				filteredRequestsLastCleanTime = time.Now().UnixNano()
-			}
-		}
 	}
 
 	return err
@@ -6,8 +6,9 @@ import (
 	"net-capture/pkg/listener"
 	"net-capture/pkg/logger"
 	"net-capture/pkg/message"
-	"strconv"
-	"strings"
+	"net-capture/pkg/model"
+	"net-capture/pkg/parser"
+	"net-capture/pkg/util"
 	"sync"
 	"time"
 )
@@ -16,36 +17,63 @@ var ErrorStopped = errors.New("reading stopped")
 
 type IPInput struct {
 	sync.Mutex
-	cancelListener context.CancelFunc
-	closed         bool
-	Expire         time.Duration
-	Stats          bool
-	Host           string
-	Port           uint16
-	quit           chan bool
-	listener       *listener.IPListener
+	cancelListener  context.CancelFunc
+	closed          bool
+	Expire          time.Duration
+	Stats           bool
+	Protocol        string
+	Host            string
+	Ports           model.Ports
+	File            string
+	Realtime        bool
+	TrackResponse   bool
+	ResponseTimeout time.Duration
+	BPFFilter       string
+	Decoders        map[uint16]string
+	DecoderOptions  parser.DecoderOptions
+	quit            chan bool
+	listener        *listener.IPListener
 }
 
-func NewIPInput(address string) (i *IPInput) {
+func NewIPInput(config model.InputConfig) (i *IPInput) {
 	i = new(IPInput)
-	i.Init(address)
+	i.Init(config.Address)
+	i.File = config.File
+	i.Realtime = config.Realtime
+	i.TrackResponse = config.TrackResponse
+	i.ResponseTimeout = config.ResponseTimeout
+	if i.ResponseTimeout == 0 {
+		i.ResponseTimeout = time.Minute
+	}
+	i.BPFFilter = config.BPFFilter
+	i.Decoders = make(map[uint16]string)
+	for _, d := range config.Decoders {
+		for _, port := range d.Ports {
+			i.Decoders[port] = d.Name
+		}
+	}
+	var err error
+	if i.DecoderOptions.GRPCDescriptors, err = parser.LoadGRPCDescriptors(config.GRPCDescriptors); err != nil {
+		logger.Fatal(err, "error while loading grpc descriptors")
+	}
+	if config.TLSKeyLog != "" {
+		if i.DecoderOptions.TLSKeyLog, err = parser.LoadTLSKeyLog(config.TLSKeyLog); err != nil {
+			logger.Fatal(err, "error while loading tls key log")
+		}
+	}
 	i.listen()
 	return
 }
 
 func (i *IPInput) Init(address string) {
-	parts := strings.Split(address, ":")
-	if len(parts) != 2 {
-		logger.Fatal(nil, "error while parsing address: %s", address)
-	}
-
-	portNum, err := strconv.Atoi(parts[1])
+	addr, err := util.ParseInputAddress(address)
 	if err != nil {
-		logger.Fatal(nil, "error while parsing address: %s", address)
+		logger.Fatal(err, "error while parsing address: %s", address)
 	}
 
-	i.Host = parts[0]
-	i.Port = uint16(portNum)
+	i.Protocol = addr.Protocol
+	i.Host = addr.Host
+	i.Ports = addr.Ports
 
 	i.quit = make(chan bool)
 }
@@ -53,10 +81,24 @@ func (i *IPInput) Init(address string) {
 func (i *IPInput) listen() {
 	i.Expire = time.Second * 2
 	var err error
-	i.listener, err = listener.NewIPListener(i.Host, i.Port, i.Expire)
+	if i.File != "" {
+		i.listener, err = listener.NewFileListener(i.File, i.Protocol, i.Host, i.Ports, i.Expire, i.Realtime)
+	} else {
+		i.listener, err = listener.NewIPListener(i.Protocol, i.Host, i.Ports, i.Expire)
+	}
 	if err != nil {
 		logger.Fatal(err, "create listener failed")
 	}
+	if i.TrackResponse {
+		i.listener.TrackResponse(i.ResponseTimeout)
+	}
+	if i.BPFFilter != "" {
+		i.listener.AddBPFFilter(i.BPFFilter)
+	}
+	if len(i.Decoders) > 0 {
+		i.listener.ForceDecoders(i.Decoders)
+	}
+	i.listener.SetDecoderOptions(i.DecoderOptions)
 
 	err = i.listener.Activate()
 	if err != nil {
@@ -76,7 +118,12 @@ func (i *IPInput) PluginRead() (*message.NetMessage, error) {
 	var msg *message.NetMessage
 	select {
 	case <-i.quit:
-		return nil, ErrorStopped
+		// hand out what the listener already produced, e.g. the tail of a pcap file
+		select {
+		case msg = <-i.listener.Messages():
+		default:
+			return nil, ErrorStopped
+		}
 	case msg = <-i.listener.Messages():
 	}
 
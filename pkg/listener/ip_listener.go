@@ -9,6 +9,7 @@ import (
 	"net"
 	"net-capture/pkg/logger"
 	"net-capture/pkg/message"
+	"net-capture/pkg/model"
 	"net-capture/pkg/parser"
 	"runtime"
 	"strings"
@@ -19,9 +20,14 @@ import (
 type IPListener struct {
 	sync.Mutex
 	messages        chan *message.NetMessage
+	protocol        string
 	host            string
-	port            uint16
+	ports           model.Ports
 	trackResponse   bool
+	responseTimeout time.Duration
+	bpfFilter       string
+	decoders        map[uint16]string
+	decoderOptions  parser.DecoderOptions
 	Interfaces      []pcap.Interface
 	Reading         chan bool
 	Handles         map[string]packetHandle
@@ -30,6 +36,8 @@ type IPListener struct {
 	expiry          time.Duration
 	allowIncomplete bool
 	loopIndex       int
+	file            string
+	realtime        bool
 	Activate        func() error
 	ReadPcap        func()
 }
@@ -40,9 +48,9 @@ type packetHandle struct {
 	ips          []net.IP
 }
 
-func NewIPListener(host string, port uint16, expiry time.Duration) (l *IPListener, err error) {
+func NewIPListener(protocol string, host string, ports model.Ports, expiry time.Duration) (l *IPListener, err error) {
 	l = &IPListener{}
-	err = l.Init(host, port, expiry)
+	err = l.Init(protocol, host, ports, expiry)
 	if err != nil {
 		return nil, err
 	}
@@ -52,7 +60,25 @@ func NewIPListener(host string, port uint16, expiry time.Duration) (l *IPListene
 	return
 }
 
-func (l *IPListener) Init(host string, port uint16, expiry time.Duration) (err error) {
+// NewFileListener creates a listener which reads packets from a pcap or pcapng file instead of a live interface.
+// When realtime is true packets are replayed with the same gaps as they were captured, otherwise as fast as possible
+func NewFileListener(file string, protocol string, host string, ports model.Ports, expiry time.Duration, realtime bool) (l *IPListener, err error) {
+	l = &IPListener{}
+	l.file = file
+	l.realtime = realtime
+	err = l.Init(protocol, host, ports, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	l.messages = make(chan *message.NetMessage, 10000)
+	l.ReadPcap = l.readPcap
+	return
+}
+
+// Init prepares the listener, protocol is tcp or udp, when empty both are captured
+func (l *IPListener) Init(protocol string, host string, ports model.Ports, expiry time.Duration) (err error) {
+	l.protocol = protocol
 	l.host = host
 	if l.host == "localhost" {
 		l.host = "127.0.0.1"
@@ -61,8 +87,12 @@ func (l *IPListener) Init(host string, port uint16, expiry time.Duration) (err e
 	l.closeDone = make(chan struct{})
 	l.quit = make(chan struct{})
 	l.Reading = make(chan bool)
-	l.port = port
+	l.ports = ports
 	l.expiry = expiry
+	if l.file != "" {
+		l.Activate = l.activatePcapFile
+		return
+	}
 	l.Activate = l.activatePcap
 	err = l.setInterfaces()
 	return
@@ -79,9 +109,9 @@ func (l *IPListener) activatePcap() error {
 			continue
 		}
 
+		// packets are handed over to the parser asynchronously, so they must not share the handle's buffer
 		source := gopacket.NewPacketSource(handle, handle.LinkType())
 		source.Lazy = true
-		source.NoCopy = true
 		l.Handles[ifi.Name] = packetHandle{
 			handler:      handle,
 			packetSource: source,
@@ -94,6 +124,57 @@ func (l *IPListener) activatePcap() error {
 	return nil
 }
 
+func (l *IPListener) activatePcapFile() error {
+	handle, err := pcap.OpenOffline(l.file)
+	if err != nil {
+		return fmt.Errorf("open pcap file error: %q, file: %q", err, l.file)
+	}
+
+	bpfFilter := l.Filter(pcap.Interface{})
+	logger.Info("File: %s. BPF Filter: %s", l.file, bpfFilter)
+	err = handle.SetBPFFilter(bpfFilter)
+	if err != nil {
+		handle.Close()
+		return fmt.Errorf("BPF filter error: %q%s, file: %q", err, bpfFilter, l.file)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(l.host); ip != nil {
+		ips = append(ips, ip)
+	}
+
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+	source.Lazy = true
+	l.Handles[l.file] = packetHandle{
+		handler:      handle,
+		packetSource: source,
+		ips:          ips,
+	}
+	return nil
+}
+
+// TrackResponse pairs requests sent to the listened port with their responses,
+// requests still unanswered after the timeout are emitted without a response
+func (l *IPListener) TrackResponse(timeout time.Duration) {
+	l.trackResponse = true
+	l.responseTimeout = timeout
+}
+
+// AddBPFFilter restricts the captured packets further, the expression is combined with the generated filter
+func (l *IPListener) AddBPFFilter(expr string) {
+	l.bpfFilter = expr
+}
+
+// ForceDecoders decodes the flows using one of the ports with the named decoder instead of detecting it
+func (l *IPListener) ForceDecoders(decoders map[uint16]string) {
+	l.decoders = decoders
+}
+
+// SetDecoderOptions passes the key log and gRPC descriptors of the input to the decoders of its flows
+func (l *IPListener) SetDecoderOptions(options parser.DecoderOptions) {
+	l.decoderOptions = options
+}
+
 // PcapHandle returns new pcap Handle from dev on success.
 // this function should be called after setting all necessary options for this listener
 func (l *IPListener) PcapHandle(ifi pcap.Interface) (handle *pcap.Handle, err error) {
@@ -141,8 +222,20 @@ func (l *IPListener) readPcap() {
 
 			defer l.closeHandles(key)
 
-			messageParser := parser.NewMessageParser(l.messages, l.port, ph.ips)
+			messageParser := parser.NewMessageParser(l.messages, l.protocol, l.ports, ph.ips, l.expiry)
+			if l.file == "" {
+				messageParser.SetInterface(key)
+			}
+			if l.decoders != nil {
+				messageParser.ForceDecoders(l.decoders)
+			}
+			messageParser.SetDecoderOptions(l.decoderOptions)
+			if l.trackResponse {
+				messageParser.TrackResponse(l.responseTimeout)
+			}
+			defer messageParser.Close()
 
+			var firstPacketTime, startTime time.Time
 			for {
 				select {
 				case <-l.quit:
@@ -158,6 +251,15 @@ func (l *IPListener) readPcap() {
 						continue
 					}
 
+					if l.realtime {
+						timestamp := packet.Metadata().Timestamp
+						if firstPacketTime.IsZero() {
+							firstPacketTime, startTime = timestamp, time.Now()
+						} else if !l.waitUntil(startTime.Add(timestamp.Sub(firstPacketTime))) {
+							return
+						}
+					}
+
 					messageParser.PacketHandler(packet)
 				}
 			}
@@ -166,25 +268,42 @@ func (l *IPListener) readPcap() {
 	close(l.Reading)
 }
 
+// waitUntil blocks until the given time is reached, it returns false if the listener was closed meanwhile
+func (l *IPListener) waitUntil(t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-l.quit:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
 func (l *IPListener) Filter(ifi pcap.Interface) (filter string) {
-	// 如果需要对host做过滤，可以扩展下面的代码
-	//hosts := []string{l.host}
-	//if listenAll(l.host) || isDevice(l.host, ifi) {
-	//	hosts = interfaceAddresses(ifi)
-	//}
-	//
-	//var hostFilters []string
-	//hostFilters = append(hostFilters, hostsFilter("dst", hosts))
-	//hostFilters = append(hostFilters, hostsFilter("src", hosts))
+	// only the configured address is captured, a device name stands for all addresses of the device
+	hosts := []string{l.host}
+	if listenAll(l.host) || (net.ParseIP(l.host) == nil && isDevice(l.host, ifi)) {
+		hosts = interfaceAddresses(ifi)
+	}
 
-	var portFilters []string
+	transports := []string{"tcp", "udp"}
+	if l.protocol != "" {
+		transports = []string{l.protocol}
+	}
 
-	portFilters = append(portFilters, portFilter("tcp", "dst", l.port))
-	portFilters = append(portFilters, portFilter("udp", "dst", l.port))
-	portFilters = append(portFilters, portFilter("tcp", "src", l.port))
-	portFilters = append(portFilters, portFilter("udp", "src", l.port))
+	// requests are sent to host:port and responses come back from it
+	filter = directionFilter(transports, "dst", hosts, l.ports) + " or " + directionFilter(transports, "src", hosts, l.ports)
 
-	return strings.Join(portFilters, " or ")
+	if l.bpfFilter != "" {
+		filter = fmt.Sprintf("(%s) and (%s)", filter, l.bpfFilter)
+	}
+	return
 }
 
 func (l *IPListener) setInterfaces() (err error) {
@@ -304,8 +423,10 @@ func listenAll(addr string) bool {
 }
 
 func isDevice(addr string, ifi pcap.Interface) bool {
+	ip := net.ParseIP(addr)
+
 	// Windows npcap loopback have no IPs
-	if addr == "127.0.0.1" && ifi.Name == `\Device\NPF_Loopback` {
+	if ip != nil && ip.IsLoopback() && ifi.Name == `\Device\NPF_Loopback` {
 		return true
 	}
 
@@ -319,8 +440,9 @@ func isDevice(addr string, ifi pcap.Interface) bool {
 		}
 	}
 
+	// IPv6 addresses can be written in several forms, so they are compared parsed
 	for _, _addr := range ifi.Addresses {
-		if _addr.IP.String() == addr {
+		if ip != nil && _addr.IP.Equal(ip) {
 			return true
 		}
 	}
@@ -336,12 +458,28 @@ func interfaceAddresses(ifi pcap.Interface) []string {
 	return hosts
 }
 
-func portFilter(transport string, direction string, port uint16) string {
-	if port == 0 {
-		return fmt.Sprintf("(%s %s portrange 0-%d)", transport, direction, 1<<16-1)
+func portFilter(transport string, direction string, ports model.PortRange) string {
+	if ports.From != ports.To {
+		return fmt.Sprintf("(%s %s portrange %d-%d)", transport, direction, ports.From, ports.To)
+	}
+
+	return fmt.Sprintf("(%s %s port %d)", transport, direction, ports.From)
+}
+
+func directionFilter(transports []string, direction string, hosts []string, ports model.Ports) string {
+	var portFilters []string
+	for _, transport := range transports {
+		for _, r := range ports {
+			portFilters = append(portFilters, portFilter(transport, direction, r))
+		}
+	}
+
+	filter := "(" + strings.Join(portFilters, " or ") + ")"
+	if len(hosts) == 0 {
+		return filter
 	}
 
-	return fmt.Sprintf("(%s %s port %d)", transport, direction, port)
+	return fmt.Sprintf("(%s and (%s))", filter, hostsFilter(direction, hosts))
 }
 
 func hostsFilter(direction string, hosts []string) string {
@@ -0,0 +1,61 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DNSMessage is a decoded DNS query or response, LatencyMs is set on responses whose query was seen
+type DNSMessage struct {
+	ID        uint16        `json:"id"`
+	Response  bool          `json:"response"`
+	OpCode    string        `json:"opcode"`
+	RCode     string        `json:"rcode,omitempty"`
+	Truncated bool          `json:"truncated,omitempty"`
+	Questions []DNSQuestion `json:"questions"`
+	Answers   []DNSRecord   `json:"answers,omitempty"`
+	// Authorities and Additionals are the number of records in the authority and additional sections
+	Authorities int     `json:"authorities,omitempty"`
+	Additionals int     `json:"additionals,omitempty"`
+	LatencyMs   float64 `json:"latency_ms,omitempty"`
+	// Size is the length of the DNS message in bytes, without the length prefix used over TCP
+	Size int `json:"size"`
+}
+
+type DNSQuestion struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+}
+
+// DNSRecord is a resource record of the answer section, Data is its content in presentation format
+type DNSRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+func (m *DNSMessage) Protocol() string {
+	return "dns"
+}
+
+func (m *DNSMessage) String() string {
+	var b bytes.Buffer
+	if m.Response {
+		_, _ = fmt.Fprintf(&b, "response %d %s", m.ID, m.RCode)
+		if m.LatencyMs > 0 {
+			_, _ = fmt.Fprintf(&b, " after %.3fms", m.LatencyMs)
+		}
+	} else {
+		_, _ = fmt.Fprintf(&b, "query %d %s", m.ID, m.OpCode)
+	}
+	b.WriteString("\n")
+	for _, q := range m.Questions {
+		_, _ = fmt.Fprintf(&b, "  ? %s %s %s\n", q.Name, q.Class, q.Type)
+	}
+	for _, a := range m.Answers {
+		_, _ = fmt.Fprintf(&b, "  %s %d %s %s\n", a.Name, a.TTL, a.Type, a.Data)
+	}
+	return b.String()
+}
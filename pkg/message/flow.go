@@ -0,0 +1,24 @@
+package message
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/google/gopacket"
+	"hash/fnv"
+)
+
+// ConnectionID derives an identifier from the protocol and both endpoints of a connection, it does not
+// depend on the direction, so requests and responses of a connection share it
+func ConnectionID(protocol string, network, transport gopacket.Flow) string {
+	a := append(append([]byte{}, network.Src().Raw()...), transport.Src().Raw()...)
+	b := append(append([]byte{}, network.Dst().Raw()...), transport.Dst().Raw()...)
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(protocol))
+	_, _ = h.Write(a)
+	_, _ = h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
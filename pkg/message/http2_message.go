@@ -0,0 +1,80 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// HTTP2Message is one side of a decoded HTTP/2 stream, the request with its pseudo headers Method, Scheme,
+// Authority and Path or the response with its Status. Header and Trailer hold the regular header fields
+type HTTP2Message struct {
+	StreamID  uint32      `json:"stream_id"`
+	Method    string      `json:"method,omitempty"`
+	Scheme    string      `json:"scheme,omitempty"`
+	Authority string      `json:"authority,omitempty"`
+	Path      string      `json:"path,omitempty"`
+	Status    int         `json:"status,omitempty"`
+	Header    http.Header `json:"headers"`
+	Trailer   http.Header `json:"trailers,omitempty"`
+	BodySize  int         `json:"body_size"`
+	// Reset is the error code of RST_STREAM when the stream was reset
+	Reset string `json:"reset,omitempty"`
+	// GRPC is set for streams carrying gRPC
+	GRPC *GRPCCall `json:"grpc,omitempty"`
+}
+
+// GRPCCall describes the gRPC messages of one side of a call, Status and StatusMessage are set for responses
+type GRPCCall struct {
+	Service       string        `json:"service"`
+	Method        string        `json:"method"`
+	Status        *int          `json:"status,omitempty"`
+	StatusMessage string        `json:"status_message,omitempty"`
+	Messages      []GRPCMessage `json:"messages"`
+}
+
+// GRPCMessage is a length prefixed gRPC message, JSON holds it rendered with the loaded protobuf descriptors
+type GRPCMessage struct {
+	Compressed bool            `json:"compressed,omitempty"`
+	Size       int             `json:"size"`
+	JSON       json.RawMessage `json:"json,omitempty"`
+}
+
+func (m *HTTP2Message) Protocol() string {
+	if m.GRPC != nil {
+		return "grpc"
+	}
+	return "http2"
+}
+
+func (m *HTTP2Message) IsRequest() bool {
+	return m.Method != ""
+}
+
+func (m *HTTP2Message) String() string {
+	var b bytes.Buffer
+	if m.IsRequest() {
+		_, _ = fmt.Fprintf(&b, "stream %d: %s %s://%s%s\n", m.StreamID, m.Method, m.Scheme, m.Authority, m.Path)
+	} else {
+		_, _ = fmt.Fprintf(&b, "stream %d: %d\n", m.StreamID, m.Status)
+	}
+	_ = m.Header.Write(&b)
+	if m.GRPC != nil {
+		for _, msg := range m.GRPC.Messages {
+			_, _ = fmt.Fprintf(&b, "grpc message %d bytes %s\n", msg.Size, msg.JSON)
+		}
+		if m.GRPC.Status != nil {
+			_, _ = fmt.Fprintf(&b, "grpc-status %d %s\n", *m.GRPC.Status, m.GRPC.StatusMessage)
+		}
+	} else {
+		_, _ = fmt.Fprintf(&b, "\n%d bytes body\n", m.BodySize)
+	}
+	if len(m.Trailer) > 0 {
+		_ = m.Trailer.Write(&b)
+	}
+	if m.Reset != "" {
+		_, _ = fmt.Fprintf(&b, "reset: %s\n", m.Reset)
+	}
+	return b.String()
+}
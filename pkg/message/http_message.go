@@ -0,0 +1,42 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// HTTPMessage is a decoded HTTP/1.x request or response, for requests Method and URL are set,
+// for responses StatusCode and Status. Body is already de-chunked and decompressed
+type HTTPMessage struct {
+	Method     string      `json:"method,omitempty"`
+	URL        string      `json:"url,omitempty"`
+	Proto      string      `json:"proto"`
+	StatusCode int         `json:"status_code,omitempty"`
+	Status     string      `json:"status,omitempty"`
+	Header     http.Header `json:"headers"`
+	// Body is encoded as base64 in JSON
+	Body []byte `json:"body,omitempty"`
+}
+
+func (m *HTTPMessage) Protocol() string {
+	return "http"
+}
+
+func (m *HTTPMessage) IsRequest() bool {
+	return m.Method != ""
+}
+
+func (m *HTTPMessage) String() string {
+	var b bytes.Buffer
+	if m.IsRequest() {
+		_, _ = fmt.Fprintf(&b, "%s %s %s\n", m.Method, m.URL, m.Proto)
+	} else {
+		_, _ = fmt.Fprintf(&b, "%s %s\n", m.Proto, m.Status)
+	}
+	_ = m.Header.Write(&b)
+	b.WriteString("\n")
+	b.Write(m.Body)
+	b.WriteString("\n")
+	return b.String()
+}
@@ -0,0 +1,77 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// KafkaMessage is a decoded Kafka request or response, responses are matched to their request by CorrelationID
+// and carry its APIKey, APIVersion and ClientID. Topics are read for Produce, Fetch, Metadata and OffsetCommit
+type KafkaMessage struct {
+	APIKey        string `json:"api_key"`
+	APIVersion    int16  `json:"api_version"`
+	CorrelationID int32  `json:"correlation_id"`
+	ClientID      string `json:"client_id,omitempty"`
+	Response      bool   `json:"response"`
+	// GroupID is the consumer group of OffsetCommit
+	GroupID string       `json:"group_id,omitempty"`
+	Topics  []KafkaTopic `json:"topics,omitempty"`
+	// ErrorCode is the top level error of a response, partitions carry their own
+	ErrorCode int16  `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// Size is the length of the request or response in bytes, without its length prefix
+	Size int `json:"size"`
+}
+
+type KafkaTopic struct {
+	Name       string           `json:"name"`
+	ErrorCode  int16            `json:"error_code,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	Partitions []KafkaPartition `json:"partitions,omitempty"`
+}
+
+// KafkaPartition is a partition of a topic, Records is the number of records produced or fetched
+type KafkaPartition struct {
+	Partition int32  `json:"partition"`
+	Records   int    `json:"records,omitempty"`
+	ErrorCode int16  `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (m *KafkaMessage) Protocol() string {
+	return "kafka"
+}
+
+func (m *KafkaMessage) String() string {
+	var b bytes.Buffer
+	kind := "request"
+	if m.Response {
+		kind = "response"
+	}
+	_, _ = fmt.Fprintf(&b, "%s v%d %s %d client %s", m.APIKey, m.APIVersion, kind, m.CorrelationID, m.ClientID)
+	if m.GroupID != "" {
+		_, _ = fmt.Fprintf(&b, " group %s", m.GroupID)
+	}
+	if m.Error != "" {
+		_, _ = fmt.Fprintf(&b, ": %s", m.Error)
+	}
+	b.WriteString("\n")
+	for _, topic := range m.Topics {
+		_, _ = fmt.Fprintf(&b, "  %s", topic.Name)
+		if topic.Error != "" {
+			_, _ = fmt.Fprintf(&b, " %s", topic.Error)
+		}
+		for _, p := range topic.Partitions {
+			_, _ = fmt.Fprintf(&b, " [%d", p.Partition)
+			if p.Records > 0 {
+				_, _ = fmt.Fprintf(&b, " %d records", p.Records)
+			}
+			if p.Error != "" {
+				_, _ = fmt.Fprintf(&b, " %s", p.Error)
+			}
+			b.WriteString("]")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,55 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// MemcachedMessage is a decoded memcached command or response of the ASCII or binary protocol. Responses carry
+// the Command and Keys of the command they answer, Hits and Misses count the keys found by retrievals. The
+// responses to mn and noop carry the keys of the quiet gets before them which were not answered as misses
+type MemcachedMessage struct {
+	Command string   `json:"command"`
+	Keys    []string `json:"keys,omitempty"`
+	// ValueSize is the size of the stored value, for responses of the returned values
+	ValueSize int  `json:"value_size,omitempty"`
+	Response  bool `json:"response"`
+	// Status is the first word of an ASCII response, e.g. STORED, VALUE or END, or the binary status name
+	Status string `json:"status,omitempty"`
+	Hits   int    `json:"hits,omitempty"`
+	Misses int    `json:"misses,omitempty"`
+	// NoReply is set for ASCII commands the server does not answer
+	NoReply bool `json:"noreply,omitempty"`
+	// Quiet is set for meta commands with the q flag and quiet binary commands, which are answered on errors
+	// or, for gets, on hits only
+	Quiet     bool    `json:"quiet,omitempty"`
+	Binary    bool    `json:"binary,omitempty"`
+	Opaque    uint32  `json:"opaque,omitempty"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	// Size is the length of the command or response in bytes
+	Size int `json:"size"`
+}
+
+func (m *MemcachedMessage) Protocol() string {
+	return "memcached"
+}
+
+func (m *MemcachedMessage) String() string {
+	var b bytes.Buffer
+	_, _ = fmt.Fprintf(&b, "%s %s", m.Command, strings.Join(m.Keys, " "))
+	if m.Response {
+		_, _ = fmt.Fprintf(&b, ": %s", m.Status)
+		if m.Hits > 0 || m.Misses > 0 {
+			_, _ = fmt.Fprintf(&b, " %d hits %d misses", m.Hits, m.Misses)
+		}
+	}
+	if m.ValueSize > 0 {
+		_, _ = fmt.Fprintf(&b, ", %d bytes value", m.ValueSize)
+	}
+	if m.LatencyMs > 0 {
+		_, _ = fmt.Fprintf(&b, " after %.3fms", m.LatencyMs)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
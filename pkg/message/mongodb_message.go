@@ -0,0 +1,68 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// MongoDBMessage is a decoded MongoDB wire protocol message. Replies are paired with their request by ResponseTo
+// and carry its Command, Database and Collection, DurationMs is the time since the request was sent
+type MongoDBMessage struct {
+	OpCode     string `json:"op_code"`
+	RequestID  int32  `json:"request_id"`
+	ResponseTo int32  `json:"response_to,omitempty"`
+	Command    string `json:"command,omitempty"`
+	Database   string `json:"database,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	// Document is the command or reply document as relaxed extended JSON, large documents are left out
+	Document  json.RawMessage   `json:"document,omitempty"`
+	Sequences []MongoDBSequence `json:"sequences,omitempty"`
+	// MoreToCome is set when the sender will send further messages without waiting for an answer
+	MoreToCome bool `json:"more_to_come,omitempty"`
+	// Compressor names the compression of OP_COMPRESSED messages which could not be decompressed
+	Compressor   string  `json:"compressor,omitempty"`
+	OK           *bool   `json:"ok,omitempty"`
+	ErrorCode    int32   `json:"error_code,omitempty"`
+	ErrorName    string  `json:"error_name,omitempty"`
+	ErrorMessage string  `json:"error_message,omitempty"`
+	DurationMs   float64 `json:"duration_ms,omitempty"`
+	// Size is the length of the message in bytes
+	Size int `json:"size"`
+}
+
+// MongoDBSequence is a document sequence of OP_MSG, e.g. the documents of an insert
+type MongoDBSequence struct {
+	Identifier string `json:"identifier"`
+	Documents  int    `json:"documents"`
+}
+
+func (m *MongoDBMessage) Protocol() string {
+	return "mongodb"
+}
+
+func (m *MongoDBMessage) String() string {
+	var b bytes.Buffer
+	_, _ = fmt.Fprintf(&b, "%s %d", m.OpCode, m.RequestID)
+	if m.ResponseTo != 0 {
+		_, _ = fmt.Fprintf(&b, " reply to %d", m.ResponseTo)
+	}
+	if m.Command != "" {
+		_, _ = fmt.Fprintf(&b, " %s %s.%s", m.Command, m.Database, m.Collection)
+	}
+	if m.OK != nil {
+		_, _ = fmt.Fprintf(&b, " ok %v", *m.OK)
+	}
+	if m.ErrorCode != 0 {
+		_, _ = fmt.Fprintf(&b, " error %d %s: %s", m.ErrorCode, m.ErrorName, m.ErrorMessage)
+	}
+	if m.DurationMs > 0 {
+		_, _ = fmt.Fprintf(&b, " after %.3fms", m.DurationMs)
+	}
+	b.WriteString("\n")
+	if len(m.Document) > 0 {
+		b.Write(m.Document)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// MQTTMessage is a decoded MQTT control packet. LatencyMs is set on PUBACK, PUBCOMP, SUBACK and UNSUBACK
+// when the packet they acknowledge was seen
+type MQTTMessage struct {
+	Type     string `json:"type"`
+	PacketID uint16 `json:"packet_id,omitempty"`
+	// ClientID, ProtocolVersion, Username and KeepAlive are sent with CONNECT
+	ClientID        string `json:"client_id,omitempty"`
+	ProtocolVersion string `json:"protocol_version,omitempty"`
+	Username        string `json:"username,omitempty"`
+	KeepAlive       uint16 `json:"keep_alive,omitempty"`
+	// Topic, QoS, Retain, Dup and PayloadSize describe a PUBLISH
+	Topic       string `json:"topic,omitempty"`
+	QoS         int    `json:"qos,omitempty"`
+	Retain      bool   `json:"retain,omitempty"`
+	Dup         bool   `json:"dup,omitempty"`
+	PayloadSize int    `json:"payload_size,omitempty"`
+	// Subscriptions are the topic filters of SUBSCRIBE and UNSUBSCRIBE
+	Subscriptions []MQTTSubscription `json:"subscriptions,omitempty"`
+	// ReasonCodes are the return code of CONNACK, the granted QoS or failures of SUBACK and the reason codes
+	// MQTT 5 adds to the other acknowledgements
+	ReasonCodes []int   `json:"reason_codes,omitempty"`
+	LatencyMs   float64 `json:"latency_ms,omitempty"`
+	// Size is the length of the control packet in bytes
+	Size int `json:"size"`
+}
+
+type MQTTSubscription struct {
+	Topic string `json:"topic"`
+	QoS   int    `json:"qos,omitempty"`
+}
+
+func (m *MQTTMessage) Protocol() string {
+	return "mqtt"
+}
+
+func (m *MQTTMessage) String() string {
+	var b bytes.Buffer
+	b.WriteString(m.Type)
+	if m.PacketID != 0 {
+		_, _ = fmt.Fprintf(&b, " %d", m.PacketID)
+	}
+	if m.ClientID != "" {
+		_, _ = fmt.Fprintf(&b, " client %s MQTT %s", m.ClientID, m.ProtocolVersion)
+	}
+	if m.Topic != "" {
+		_, _ = fmt.Fprintf(&b, " %s qos %d retain %v, %d bytes payload", m.Topic, m.QoS, m.Retain, m.PayloadSize)
+	}
+	for _, s := range m.Subscriptions {
+		_, _ = fmt.Fprintf(&b, " %s(qos %d)", s.Topic, s.QoS)
+	}
+	if len(m.ReasonCodes) > 0 {
+		_, _ = fmt.Fprintf(&b, " reason codes %v", m.ReasonCodes)
+	}
+	if m.LatencyMs > 0 {
+		_, _ = fmt.Fprintf(&b, " after %.3fms", m.LatencyMs)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
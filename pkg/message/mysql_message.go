@@ -0,0 +1,78 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// MySQLMessage is a decoded MySQL command or the complete response to it. Command is the name of the command,
+// e.g. COM_QUERY, for responses the command they answer. Responses have Status set to OK, ERR, RESULTSET
+// or one of the handshake steps HANDSHAKE, AUTH_SWITCH, AUTH_MORE_DATA and LOCAL_INFILE
+type MySQLMessage struct {
+	Command string `json:"command"`
+	// Query is the SQL of COM_QUERY and COM_STMT_PREPARE, for COM_STMT_EXECUTE the prepared SQL if it was seen
+	Query       string `json:"query,omitempty"`
+	StatementID uint32 `json:"statement_id,omitempty"`
+	User        string `json:"user,omitempty"`
+	Database    string `json:"database,omitempty"`
+
+	Status        string `json:"status,omitempty"`
+	ErrorCode     uint16 `json:"error_code,omitempty"`
+	SQLState      string `json:"sql_state,omitempty"`
+	ErrorMessage  string `json:"error_message,omitempty"`
+	AffectedRows  uint64 `json:"affected_rows,omitempty"`
+	LastInsertID  uint64 `json:"last_insert_id,omitempty"`
+	Columns       int    `json:"columns,omitempty"`
+	Rows          int    `json:"rows,omitempty"`
+	ServerVersion string `json:"server_version,omitempty"`
+	// DurationMs is the time from the command to the response completing it
+	DurationMs float64 `json:"duration_ms,omitempty"`
+	// Size is the length of all packets of the message in bytes
+	Size int `json:"size"`
+}
+
+func (m *MySQLMessage) Protocol() string {
+	return "mysql"
+}
+
+func (m *MySQLMessage) IsRequest() bool {
+	return m.Status == ""
+}
+
+func (m *MySQLMessage) String() string {
+	var b bytes.Buffer
+	if m.IsRequest() {
+		b.WriteString(m.Command)
+		if m.StatementID != 0 {
+			_, _ = fmt.Fprintf(&b, " #%d", m.StatementID)
+		}
+		if m.User != "" {
+			_, _ = fmt.Fprintf(&b, " user %s", m.User)
+		}
+		if m.Database != "" {
+			_, _ = fmt.Fprintf(&b, " database %s", m.Database)
+		}
+		if m.Query != "" {
+			b.WriteString(": " + m.Query)
+		}
+		b.WriteString("\n")
+		return b.String()
+	}
+
+	_, _ = fmt.Fprintf(&b, "%s to %s", m.Status, m.Command)
+	switch m.Status {
+	case "ERR":
+		_, _ = fmt.Fprintf(&b, ": %d (%s) %s", m.ErrorCode, m.SQLState, m.ErrorMessage)
+	case "OK":
+		_, _ = fmt.Fprintf(&b, ": %d affected rows", m.AffectedRows)
+	case "RESULTSET":
+		_, _ = fmt.Fprintf(&b, ": %d columns, %d rows", m.Columns, m.Rows)
+	case "HANDSHAKE":
+		b.WriteString(": " + m.ServerVersion)
+	}
+	if m.DurationMs > 0 {
+		_, _ = fmt.Fprintf(&b, " after %.3fms", m.DurationMs)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
@@ -1,13 +1,64 @@
 package message
 
 import (
+	"encoding/hex"
+	"fmt"
 	"github.com/google/gopacket"
+	"net"
+	"time"
 )
 
+// Direction tells whether a message was received or sent by the local service
+type Direction string
+
+const (
+	DirectionIncoming Direction = "incoming"
+	DirectionOutgoing Direction = "outgoing"
+)
+
+// NetMessage is a chunk of data sent in one direction, for TCP it holds the reassembled bytes between two
+// direction switches of the connection, for UDP a single datagram
 type NetMessage struct {
-	Packet gopacket.Packet
+	Packets   []gopacket.Packet
+	Network   gopacket.Flow
+	Transport gopacket.Flow
+	Timestamp time.Time
+	Payload   []byte
+	// Request is set for messages sent to the captured port, otherwise the message is a response
+	Request bool
+
+	// Protocol, SrcIP, SrcPort, DstIP and DstPort are the decoded 5-tuple of Network and Transport
+	Protocol string
+	SrcIP    net.IP
+	SrcPort  uint16
+	DstIP    net.IP
+	DstPort  uint16
+	// Direction is relative to the local service, Interface is the name of the capturing interface
+	// and empty for files. ConnectionID is the same for both directions of a connection
+	Direction    Direction
+	Interface    string
+	ConnectionID string
+
+	// Record is set when the payload has been decoded by an application protocol decoder
+	Record Record
+
+	// Response is only set when responses are tracked and the request has been answered,
+	// Latency is the time between the first byte of the request and the first byte of the response
+	Response *NetMessage
+	Latency  time.Duration
 }
 
 func (nm *NetMessage) String() string {
-	return nm.Packet.Dump()
+	content := hex.Dump(nm.Payload)
+	if nm.Record != nil {
+		content = nm.Record.String()
+	}
+	s := fmt.Sprintf("%s %s -> %s, %d bytes, %d packets\n%s",
+		nm.Direction, net.JoinHostPort(nm.Network.Src().String(), nm.Transport.Src().String()),
+		net.JoinHostPort(nm.Network.Dst().String(), nm.Transport.Dst().String()),
+		len(nm.Payload), len(nm.Packets), content)
+	if nm.Response != nil {
+		s += fmt.Sprintf("Response after %s: %s", nm.Latency, nm.Response.String())
+	}
+	return s
 }
@@ -0,0 +1,69 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// PostgreSQLMessage is a group of PostgreSQL protocol messages, the messages a client sends up to Sync or a simple
+// Query, or the messages the server answers with up to ReadyForQuery. Messages lists the message types in order,
+// repeated types like DataRow are listed once
+type PostgreSQLMessage struct {
+	Messages []string `json:"messages"`
+	// Query is the SQL of a simple query or of Parse, for Bind the SQL of the statement if it was seen
+	Query     string `json:"query,omitempty"`
+	Statement string `json:"statement,omitempty"`
+	User      string `json:"user,omitempty"`
+	Database  string `json:"database,omitempty"`
+
+	// CommandTags are the tags of CommandComplete, e.g. SELECT 2 or INSERT 0 1
+	CommandTags   []string `json:"command_tags,omitempty"`
+	Columns       int      `json:"columns,omitempty"`
+	Rows          int      `json:"rows,omitempty"`
+	ErrorSeverity string   `json:"error_severity,omitempty"`
+	ErrorCode     string   `json:"error_code,omitempty"`
+	ErrorMessage  string   `json:"error_message,omitempty"`
+	// TransactionStatus is reported by ReadyForQuery, idle, transaction or failed
+	TransactionStatus string `json:"transaction_status,omitempty"`
+	// DurationMs is the time from the Query or Sync of the client to the ReadyForQuery ending this group
+	DurationMs float64 `json:"duration_ms,omitempty"`
+	// Size is the length of all messages of the group in bytes
+	Size int `json:"size"`
+}
+
+func (m *PostgreSQLMessage) Protocol() string {
+	return "postgresql"
+}
+
+// AddMessage appends a message type unless it repeats the last one
+func (m *PostgreSQLMessage) AddMessage(name string) {
+	if len(m.Messages) == 0 || m.Messages[len(m.Messages)-1] != name {
+		m.Messages = append(m.Messages, name)
+	}
+}
+
+func (m *PostgreSQLMessage) String() string {
+	var b bytes.Buffer
+	b.WriteString(strings.Join(m.Messages, ", "))
+	if m.User != "" {
+		_, _ = fmt.Fprintf(&b, " user %s database %s", m.User, m.Database)
+	}
+	if m.Statement != "" {
+		_, _ = fmt.Fprintf(&b, " statement %s", m.Statement)
+	}
+	if m.Query != "" {
+		b.WriteString(": " + m.Query)
+	}
+	if len(m.CommandTags) > 0 {
+		_, _ = fmt.Fprintf(&b, ": %s, %d rows", strings.Join(m.CommandTags, ", "), m.Rows)
+	}
+	if m.ErrorCode != "" {
+		_, _ = fmt.Fprintf(&b, ": %s %s %s", m.ErrorSeverity, m.ErrorCode, m.ErrorMessage)
+	}
+	if m.DurationMs > 0 {
+		_, _ = fmt.Fprintf(&b, " after %.3fms", m.DurationMs)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
@@ -0,0 +1,9 @@
+package message
+
+// Record is an application protocol message decoded from the payload of a NetMessage,
+// records are written to the json output as they are marshalled
+type Record interface {
+	// Protocol returns the name of the decoder which produced the record, e.g. http
+	Protocol() string
+	String() string
+}
@@ -0,0 +1,35 @@
+package message
+
+import "fmt"
+
+// RedisMessage is a decoded RESP2/RESP3 command or reply. Commands have Command, Key and Args set, replies
+// have ReplyType, Error for error replies, and Command of the request they answer in connection order
+type RedisMessage struct {
+	Command string `json:"command,omitempty"`
+	Key     string `json:"key,omitempty"`
+	// Args is the number of arguments following the command name, for aggregate replies the number of elements
+	Args int `json:"args"`
+	// ReplyType is the RESP type of a reply, e.g. simple_string, bulk_string, array or error
+	ReplyType string `json:"reply_type,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// Size is the length of the encoded command or reply in bytes
+	Size int `json:"size"`
+}
+
+func (m *RedisMessage) Protocol() string {
+	return "redis"
+}
+
+func (m *RedisMessage) IsRequest() bool {
+	return m.ReplyType == ""
+}
+
+func (m *RedisMessage) String() string {
+	if m.IsRequest() {
+		return fmt.Sprintf("%s %s, %d args, %d bytes\n", m.Command, m.Key, m.Args, m.Size)
+	}
+	if m.Error != "" {
+		return fmt.Sprintf("%s reply to %s: %s, %d bytes\n", m.ReplyType, m.Command, m.Error, m.Size)
+	}
+	return fmt.Sprintf("%s reply to %s, %d bytes\n", m.ReplyType, m.Command, m.Size)
+}
@@ -0,0 +1,82 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TLSMessage describes consecutive TLS records sent in one direction. The hello messages and, as long as it is
+// not encrypted like in TLS 1.3 or can be decrypted with a key log, the server certificate are decoded, the other
+// records are only counted
+type TLSMessage struct {
+	// Handshakes are the handshake message types, EncryptedHandshake for handshake records after ChangeCipherSpec
+	Handshakes []string `json:"handshakes,omitempty"`
+	// Alert is the level and description of a plaintext alert
+	Alert string `json:"alert,omitempty"`
+	// ApplicationData is the number of bytes of encrypted application data
+	ApplicationData int `json:"application_data,omitempty"`
+	Records         int `json:"records"`
+
+	ServerName string   `json:"server_name,omitempty"`
+	ALPN       []string `json:"alpn,omitempty"`
+	// Version is the version of ClientHello or the version the server selected
+	Version           string   `json:"version,omitempty"`
+	SupportedVersions []string `json:"supported_versions,omitempty"`
+	// CipherSuites are offered by the client, CipherSuite is the one the server selected
+	CipherSuites []string        `json:"cipher_suites,omitempty"`
+	CipherSuite  string          `json:"cipher_suite,omitempty"`
+	JA3          string          `json:"ja3,omitempty"`
+	JA3Hash      string          `json:"ja3_hash,omitempty"`
+	JA3S         string          `json:"ja3s,omitempty"`
+	JA3SHash     string          `json:"ja3s_hash,omitempty"`
+	Certificate  *TLSCertificate `json:"certificate,omitempty"`
+	// Size is the length of the records in bytes
+	Size int `json:"size"`
+}
+
+// TLSCertificate is the leaf certificate the server sent
+type TLSCertificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+func (m *TLSMessage) Protocol() string {
+	return "tls"
+}
+
+func (m *TLSMessage) String() string {
+	var b bytes.Buffer
+	var parts []string
+	parts = append(parts, m.Handshakes...)
+	if m.Alert != "" {
+		parts = append(parts, "Alert "+m.Alert)
+	}
+	if m.ApplicationData > 0 {
+		parts = append(parts, fmt.Sprintf("%d bytes application data", m.ApplicationData))
+	}
+	_, _ = fmt.Fprintf(&b, "%s in %d records\n", strings.Join(parts, ", "), m.Records)
+	if m.ServerName != "" {
+		_, _ = fmt.Fprintf(&b, "  server name %s\n", m.ServerName)
+	}
+	if len(m.ALPN) > 0 {
+		_, _ = fmt.Fprintf(&b, "  alpn %s\n", strings.Join(m.ALPN, ", "))
+	}
+	if m.Version != "" {
+		_, _ = fmt.Fprintf(&b, "  version %s %s\n", m.Version, m.CipherSuite)
+	}
+	if m.JA3Hash != "" {
+		_, _ = fmt.Fprintf(&b, "  ja3 %s\n", m.JA3Hash)
+	}
+	if m.JA3SHash != "" {
+		_, _ = fmt.Fprintf(&b, "  ja3s %s\n", m.JA3SHash)
+	}
+	if c := m.Certificate; c != nil {
+		_, _ = fmt.Fprintf(&b, "  certificate %s issued by %s, valid until %s\n", c.Subject, c.Issuer, c.NotAfter.Format(time.RFC3339))
+	}
+	return b.String()
+}
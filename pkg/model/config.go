@@ -1,10 +1,112 @@
 package model
 
+import "time"
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+const (
+	OutputTypeStdout = "stdout"
+	OutputTypePcap   = "pcap"
+	OutputTypeJSON   = "json"
+	OutputTypeReplay = "replay"
+)
+
 type Config struct {
-	DebugMode bool          `koanf:"debug_mode"`
-	Input     []InputConfig `koanf:"input"`
+	DebugMode bool           `koanf:"debug_mode"`
+	Input     []InputConfig  `koanf:"input"`
+	Output    []OutputConfig `koanf:"output"`
+}
+
+// InputAddress is the parsed form of InputConfig.Address, an empty Protocol captures tcp and udp
+type InputAddress struct {
+	Protocol string
+	Host     string
+	Ports    Ports
+}
+
+// PortRange is an inclusive range of ports, a single port has From equal to To
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// Ports is the set of ports captured by an input
+type Ports []PortRange
+
+func (p Ports) Contains(port uint16) bool {
+	for _, r := range p {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
 }
 
 type InputConfig struct {
-	Address string `koanf:"address"`
+	Address         string        `koanf:"address"`
+	File            string        `koanf:"file"`
+	Realtime        bool          `koanf:"realtime"`
+	TrackResponse   bool          `koanf:"track_response"`
+	ResponseTimeout time.Duration `koanf:"response_timeout"`
+	BPFFilter       string        `koanf:"bpf_filter"`
+	// Decoders force the decoder of the flows using the given ports instead of detecting it
+	Decoders []DecoderConfig `koanf:"decoders"`
+	// GRPCDescriptors are protobuf descriptor set files used to render gRPC messages as JSON
+	GRPCDescriptors []string `koanf:"grpc_descriptors"`
+	// TLSKeyLog is an NSS key log file with the secrets used to decrypt TLS connections, it is read again when it changes
+	TLSKeyLog string `koanf:"tls_keylog"`
+}
+
+// DecoderConfig forces the named decoder, or raw to keep the data undecoded, for a list of ports
+type DecoderConfig struct {
+	Name  string   `koanf:"name"`
+	Ports []uint16 `koanf:"ports"`
+}
+
+// OutputConfig selects an output by Type, the options of that type are read from the field named like it
+type OutputConfig struct {
+	Type   string             `koanf:"type"`
+	Pcap   PcapOutputConfig   `koanf:"pcap"`
+	JSON   JSONOutputConfig   `koanf:"json"`
+	Replay ReplayOutputConfig `koanf:"replay"`
+}
+
+type PcapOutputConfig struct {
+	// Path of the files, %Y %m %d %H %M %S are replaced with the time the file is created and %n with a counter,
+	// the counter is appended when %n is missing
+	Path string `koanf:"path"`
+	// Format is pcap or pcapng
+	Format string `koanf:"format"`
+	// MaxSize in bytes after which a new file is started, 0 disables size based rotation
+	MaxSize int64 `koanf:"max_size"`
+	// RotateInterval after which a new file is started, 0 disables time based rotation
+	RotateInterval time.Duration `koanf:"rotate_interval"`
+	// MaxFiles is the number of files kept, older ones are removed. 0 keeps all files
+	MaxFiles int `koanf:"max_files"`
+}
+
+type JSONOutputConfig struct {
+	// Path of the file the JSON lines are appended to, stdout when empty or -
+	Path string `koanf:"path"`
+	// PayloadEncoding is text, base64 or auto which uses text for printable payloads
+	PayloadEncoding string `koanf:"payload_encoding"`
+}
+
+type ReplayOutputConfig struct {
+	// Target address the captured requests are sent to, host:port
+	Target string `koanf:"target"`
+	// Rate scales the pacing of the captured requests, 2 replays twice as fast. 0 sends requests as fast as possible
+	Rate float64 `koanf:"rate"`
+	// ReuseConnection keeps one target connection per captured connection, otherwise every request gets its own
+	ReuseConnection bool `koanf:"reuse_connection"`
+	// RecordPath of the file the responses of the target are written to as JSON lines, they are discarded when empty
+	RecordPath string `koanf:"record_path"`
+	// Timeout for connecting, sending a request and reading its response, 5s by default
+	Timeout time.Duration `koanf:"timeout"`
+	// DiscardResponse sends the requests without waiting for responses, the target's replies are read and dropped
+	// in the background. Meant for UDP and protocols which do not answer every request
+	DiscardResponse bool `koanf:"discard_response"`
 }
@@ -0,0 +1,196 @@
+package output
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"io"
+	"net-capture/pkg/logger"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"net-capture/pkg/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// JSONMessage is the schema of the lines written by JSONOutput, fields are only ever added to it
+type JSONMessage struct {
+	// Timestamp is the capture time of the first packet of the message, RFC 3339 with nanoseconds
+	Timestamp time.Time `json:"timestamp"`
+	// Interface the message was captured on, empty when it is not known
+	Interface string `json:"interface,omitempty"`
+	SrcIP     string `json:"src_ip"`
+	SrcPort   uint16 `json:"src_port"`
+	DstIP     string `json:"dst_ip"`
+	DstPort   uint16 `json:"dst_port"`
+	// Protocol is the transport protocol, tcp or udp
+	Protocol string `json:"protocol"`
+	// Direction is request for messages sent to the captured port, response otherwise
+	Direction string `json:"direction"`
+	// FlowDirection is incoming for messages received by the local service and outgoing for those it sent
+	FlowDirection string `json:"flow_direction"`
+	// ConnectionID is shared by all messages of the same connection in both directions
+	ConnectionID string `json:"connection_id"`
+	// Flags are the TCP flags seen on the packets of the message
+	Flags []string `json:"flags,omitempty"`
+	// Payload holds the data of the message encoded as told by PayloadEncoding, text or base64
+	Payload         string `json:"payload"`
+	PayloadEncoding string `json:"payload_encoding"`
+	PayloadSize     int    `json:"payload_size"`
+	// AppProtocol is the name of the decoder which decoded the payload, absent for undecoded payloads
+	AppProtocol string `json:"app_protocol,omitempty"`
+	// Record holds the decoded message
+	Record interface{} `json:"record,omitempty"`
+	// Response and LatencyMs are present for requests paired with their response
+	Response  *JSONMessage `json:"response,omitempty"`
+	LatencyMs float64      `json:"latency_ms,omitempty"`
+}
+
+// JSONOutput writes every message as one JSON object per line to a file or stdout
+type JSONOutput struct {
+	sync.Mutex
+	config model.JSONOutputConfig
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// NewJSONOutput constructor for JSONOutput
+func NewJSONOutput(config model.JSONOutputConfig) (o *JSONOutput) {
+	o = new(JSONOutput)
+	o.config = config
+	if o.config.PayloadEncoding == "" {
+		o.config.PayloadEncoding = "auto"
+	}
+
+	if o.config.Path == "" || o.config.Path == "-" {
+		o.writer = bufio.NewWriter(os.Stdout)
+		return
+	}
+
+	var err error
+	if err = os.MkdirAll(filepath.Dir(o.config.Path), 0755); err == nil {
+		o.file, err = os.OpenFile(o.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		logger.Fatal(err, "open json output file failed")
+	}
+	o.writer = bufio.NewWriter(o.file)
+	return
+}
+
+func (o *JSONOutput) PluginWrite(msg *message.NetMessage) error {
+	line := util.ToJsonString(o.toJSON(msg)) + "\n"
+
+	o.Lock()
+	defer o.Unlock()
+	if _, err := io.WriteString(o.writer, line); err != nil {
+		return err
+	}
+	return o.writer.Flush()
+}
+
+func (o *JSONOutput) toJSON(msg *message.NetMessage) *JSONMessage {
+	j := &JSONMessage{
+		Timestamp:     msg.Timestamp,
+		Interface:     msg.Interface,
+		SrcIP:         msg.SrcIP.String(),
+		SrcPort:       msg.SrcPort,
+		DstIP:         msg.DstIP.String(),
+		DstPort:       msg.DstPort,
+		Protocol:      msg.Protocol,
+		Flags:         tcpFlags(msg),
+		PayloadSize:   len(msg.Payload),
+		Direction:     "response",
+		FlowDirection: string(msg.Direction),
+		ConnectionID:  msg.ConnectionID,
+	}
+	if msg.Request {
+		j.Direction = "request"
+	}
+	j.Payload, j.PayloadEncoding = encodePayload(msg.Payload, o.config.PayloadEncoding)
+
+	switch record := msg.Record.(type) {
+	case nil:
+	default:
+		j.AppProtocol = record.Protocol()
+		j.Record = record
+	}
+
+	if msg.Response != nil {
+		j.Response = o.toJSON(msg.Response)
+		j.LatencyMs = float64(msg.Latency) / float64(time.Millisecond)
+	}
+	return j
+}
+
+// encodePayload returns the data as text when it is printable or text encoding is forced, as base64 otherwise
+func encodePayload(data []byte, encoding string) (string, string) {
+	switch encoding {
+	case "text":
+		return string(data), "text"
+	case "base64":
+		return base64.StdEncoding.EncodeToString(data), "base64"
+	}
+
+	if isPrintable(data) {
+		return string(data), "text"
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+func (o *JSONOutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+	err := o.writer.Flush()
+	if o.file != nil {
+		if closeErr := o.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (o *JSONOutput) String() string {
+	return fmt.Sprintf("JSON Output: %s", o.config.Path)
+}
+
+func isPrintable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// tcpFlags collects the flags set on any TCP packet of the message
+func tcpFlags(msg *message.NetMessage) []string {
+	seen := make(map[string]bool)
+	for _, packet := range msg.Packets {
+		tcp, ok := packet.TransportLayer().(*layers.TCP)
+		if !ok {
+			continue
+		}
+		for name, set := range map[string]bool{"SYN": tcp.SYN, "ACK": tcp.ACK, "PSH": tcp.PSH, "FIN": tcp.FIN, "RST": tcp.RST, "URG": tcp.URG} {
+			if set {
+				seen[name] = true
+			}
+		}
+	}
+
+	var flags []string
+	for name := range seen {
+		flags = append(flags, name)
+	}
+	sort.Strings(flags)
+	return flags
+}
@@ -0,0 +1,258 @@
+package output
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"io"
+	"net-capture/pkg/logger"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pcapSnapLen = 262144
+
+// PcapOutput writes the captured packets into pcap or pcapng files which can be opened with Wireshark,
+// files are rotated by size or age and only the newest MaxFiles are kept. Only the packets of the messages are written,
+// packets without payload are kept with the data following them so the FIN and last ACKs of a connection can be missing
+type PcapOutput struct {
+	sync.Mutex
+	config model.PcapOutputConfig
+
+	file    *os.File
+	buffer  *bufio.Writer
+	counter *countingWriter
+	pcap    *pcapgo.Writer
+	ng      *pcapgo.NgWriter
+
+	// pcap files have a single link type, pcapng files get an interface per link type
+	linkType   layers.LinkType
+	interfaces map[layers.LinkType]int
+
+	opened time.Time
+	index  int
+	files  []string
+}
+
+// NewPcapOutput constructor for PcapOutput
+func NewPcapOutput(config model.PcapOutputConfig) (o *PcapOutput) {
+	o = new(PcapOutput)
+	o.config = config
+	if o.config.Format == "" {
+		o.config.Format = "pcap"
+	}
+	return
+}
+
+func (o *PcapOutput) PluginWrite(msg *message.NetMessage) error {
+	o.Lock()
+	defer o.Unlock()
+
+	for m := msg; m != nil; m = m.Response {
+		for _, packet := range m.Packets {
+			if err := o.writePacket(packet); err != nil {
+				return err
+			}
+		}
+	}
+	// flushing keeps the file readable while capturing and the size accounting accurate
+	return o.flush()
+}
+
+func (o *PcapOutput) writePacket(packet gopacket.Packet) error {
+	linkType := packetLinkType(packet)
+	if o.needsRotation(linkType) {
+		if err := o.rotate(linkType); err != nil {
+			return err
+		}
+	}
+
+	ci := packet.Metadata().CaptureInfo
+	if o.ng != nil {
+		id, err := o.interfaceID(linkType)
+		if err != nil {
+			return err
+		}
+		ci.InterfaceIndex = id
+		return o.ng.WritePacket(ci, packet.Data())
+	}
+	return o.pcap.WritePacket(ci, packet.Data())
+}
+
+func (o *PcapOutput) needsRotation(linkType layers.LinkType) bool {
+	switch {
+	case o.file == nil:
+		return true
+	case o.ng == nil && linkType != o.linkType:
+		return true
+	case o.config.MaxSize > 0 && o.counter.n >= o.config.MaxSize:
+		return true
+	case o.config.RotateInterval > 0 && time.Since(o.opened) >= o.config.RotateInterval:
+		return true
+	}
+	return false
+}
+
+// rotate closes the current file, opens the next one and removes the oldest files exceeding MaxFiles
+func (o *PcapOutput) rotate(linkType layers.LinkType) error {
+	if err := o.closeFile(); err != nil {
+		logger.Error(err, "close pcap file error")
+	}
+
+	now := time.Now()
+	o.index++
+	name := o.fileName(now)
+	// a file which is still kept must not be truncated or removed as one of the oldest files
+	for o.kept(name) {
+		o.index++
+		name = o.fileName(now)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("create pcap file error: %w", err)
+	}
+
+	o.file = file
+	o.counter = &countingWriter{w: file}
+	o.opened = now
+	o.linkType = linkType
+
+	if o.config.Format == "pcapng" {
+		o.ng, err = pcapgo.NewNgWriter(o.counter, linkType)
+		o.interfaces = map[layers.LinkType]int{linkType: 0}
+	} else {
+		o.buffer = bufio.NewWriter(o.counter)
+		o.pcap = pcapgo.NewWriterNanos(o.buffer)
+		err = o.pcap.WriteFileHeader(pcapSnapLen, linkType)
+	}
+	if err != nil {
+		_ = o.closeFile()
+		return fmt.Errorf("write pcap header error: %w", err)
+	}
+	logger.Info("Writing packets to %s", name)
+
+	o.files = append(o.files, name)
+	for o.config.MaxFiles > 0 && len(o.files) > o.config.MaxFiles {
+		if err := os.Remove(o.files[0]); err != nil && !os.IsNotExist(err) {
+			logger.Error(err, "remove old pcap file error")
+		}
+		o.files = o.files[1:]
+	}
+	return nil
+}
+
+func (o *PcapOutput) interfaceID(linkType layers.LinkType) (int, error) {
+	if id, ok := o.interfaces[linkType]; ok {
+		return id, nil
+	}
+	id, err := o.ng.AddInterface(pcapgo.NgInterface{LinkType: linkType, SnapLength: pcapSnapLen})
+	if err != nil {
+		return 0, err
+	}
+	o.interfaces[linkType] = id
+	return id, nil
+}
+
+// kept reports whether the file is one of the files written so far and not removed yet
+func (o *PcapOutput) kept(name string) bool {
+	for _, f := range o.files {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fileName expands the time placeholders %Y %m %d %H %M %S and the file counter %n of the configured path,
+// the counter is appended when the path has no %n so that files rotated within a second do not overwrite each other
+func (o *PcapOutput) fileName(t time.Time) string {
+	name := o.config.Path
+	if !strings.Contains(name, "%n") {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "_%n" + ext
+	}
+
+	return strings.NewReplacer(
+		"%Y", t.Format("2006"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+		"%H", t.Format("15"),
+		"%M", t.Format("04"),
+		"%S", t.Format("05"),
+		"%n", strconv.Itoa(o.index),
+	).Replace(name)
+}
+
+func (o *PcapOutput) flush() error {
+	switch {
+	case o.ng != nil:
+		return o.ng.Flush()
+	case o.buffer != nil:
+		return o.buffer.Flush()
+	}
+	return nil
+}
+
+func (o *PcapOutput) closeFile() error {
+	if o.file == nil {
+		return nil
+	}
+
+	err := o.flush()
+	if closeErr := o.file.Close(); err == nil {
+		err = closeErr
+	}
+	o.file, o.buffer, o.counter, o.pcap, o.ng = nil, nil, nil, nil, nil
+	return err
+}
+
+func (o *PcapOutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+	return o.closeFile()
+}
+
+func (o *PcapOutput) String() string {
+	return "Pcap Output: " + o.config.Path
+}
+
+// packetLinkType guesses the link type the packet was captured with from its first layer
+func packetLinkType(packet gopacket.Packet) layers.LinkType {
+	if len(packet.Layers()) == 0 {
+		return layers.LinkTypeEthernet
+	}
+
+	switch packet.Layers()[0].LayerType() {
+	case layers.LayerTypeLoopback:
+		return layers.LinkTypeNull
+	case layers.LayerTypeLinuxSLL:
+		return layers.LinkTypeLinuxSLL
+	case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+		return layers.LinkTypeRaw
+	default:
+		return layers.LinkTypeEthernet
+	}
+}
+
+// countingWriter keeps track of the bytes written to the current file
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,323 @@
+package output
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net-capture/pkg/logger"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"net-capture/pkg/util"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// replayIdleTimeout closes the target connection of a captured connection which did not send requests for a while
+const replayIdleTimeout = time.Minute
+
+// replayQueueSize is the number of requests of a captured connection waiting to be sent, more requests are dropped
+const replayQueueSize = 100
+
+// ReplayRecord is the schema of the lines written to the record file of ReplayOutput
+type ReplayRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Source is the client address of the captured request
+	Source      string `json:"source"`
+	Target      string `json:"target"`
+	RequestSize int    `json:"request_size"`
+	// Response holds the data returned by the target encoded as told by ResponseEncoding, text or base64
+	Response         string  `json:"response"`
+	ResponseEncoding string  `json:"response_encoding"`
+	ResponseSize     int     `json:"response_size"`
+	LatencyMs        float64 `json:"latency_ms"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// replayRequest is a captured request waiting to be sent at the given time
+type replayRequest struct {
+	msg *message.NetMessage
+	due time.Time
+}
+
+// ReplayOutput re-sends the captured requests to a target address, requests of the same captured connection
+// are sent in order over their own target connection
+type ReplayOutput struct {
+	sync.Mutex
+	config  model.ReplayOutputConfig
+	workers map[string]*replayWorker
+	wg      sync.WaitGroup
+	closed  bool
+	// dropped counts the requests which did not fit into the queue of a slow target connection
+	dropped int
+
+	// time of the first replayed request, on capture time and on wall clock, used to keep the pacing
+	firstCaptured time.Time
+	firstSent     time.Time
+
+	recordLock sync.Mutex
+	record     *os.File
+}
+
+// NewReplayOutput constructor for ReplayOutput
+func NewReplayOutput(config model.ReplayOutputConfig) (o *ReplayOutput) {
+	o = new(ReplayOutput)
+	o.config = config
+	o.workers = make(map[string]*replayWorker)
+	if o.config.Timeout == 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	if o.config.RecordPath != "" {
+		var err error
+		if err = os.MkdirAll(filepath.Dir(o.config.RecordPath), 0755); err == nil {
+			o.record, err = os.OpenFile(o.config.RecordPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		}
+		if err != nil {
+			logger.Fatal(err, "open replay record file failed")
+		}
+	}
+	return
+}
+
+func (o *ReplayOutput) PluginWrite(msg *message.NetMessage) error {
+	if !msg.Request || len(msg.Payload) == 0 {
+		return nil
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	if o.closed {
+		return io.ErrClosedPipe
+	}
+
+	req := &replayRequest{msg: msg, due: o.schedule(msg.Timestamp)}
+	key := msg.Network.String() + " " + msg.Transport.String()
+	w, ok := o.workers[key]
+	if !ok {
+		w = &replayWorker{output: o, key: key, requests: make(chan *replayRequest, replayQueueSize)}
+		o.workers[key] = w
+		o.wg.Add(1)
+		go w.run()
+	}
+	// a slow target must not hold up the emitter and the other outputs, its requests are dropped instead
+	select {
+	case w.requests <- req:
+	default:
+		o.dropped++
+		logger.Debug("[REPLAY] %s queue is full, request dropped", key)
+	}
+	return nil
+}
+
+// schedule returns when a request captured at the given time has to be sent to keep the captured pacing
+// scaled by the rate, without a rate requests are sent immediately
+func (o *ReplayOutput) schedule(captured time.Time) time.Time {
+	now := time.Now()
+	if o.config.Rate <= 0 {
+		return now
+	}
+	if o.firstSent.IsZero() {
+		o.firstCaptured, o.firstSent = captured, now
+		return now
+	}
+	return o.firstSent.Add(time.Duration(float64(captured.Sub(o.firstCaptured)) / o.config.Rate))
+}
+
+// removeWorker forgets an idle worker, it returns false if requests were queued for it meanwhile
+func (o *ReplayOutput) removeWorker(w *replayWorker) bool {
+	o.Lock()
+	defer o.Unlock()
+	if len(w.requests) > 0 {
+		return false
+	}
+	delete(o.workers, w.key)
+	return true
+}
+
+func (o *ReplayOutput) writeRecord(record *ReplayRecord) {
+	if o.record == nil {
+		return
+	}
+
+	o.recordLock.Lock()
+	defer o.recordLock.Unlock()
+	if _, err := o.record.WriteString(util.ToJsonString(record) + "\n"); err != nil {
+		logger.Error(err, "write replay record error")
+	}
+}
+
+func (o *ReplayOutput) Close() error {
+	o.Lock()
+	if o.closed {
+		o.Unlock()
+		return nil
+	}
+	o.closed = true
+	for _, w := range o.workers {
+		close(w.requests)
+	}
+	dropped := o.dropped
+	o.Unlock()
+
+	o.wg.Wait()
+	if dropped > 0 {
+		logger.Warn("Replay to %s dropped %d requests of connections which were too slow", o.config.Target, dropped)
+	}
+	if o.record != nil {
+		return o.record.Close()
+	}
+	return nil
+}
+
+func (o *ReplayOutput) String() string {
+	return "Replay Output: " + o.config.Target
+}
+
+// replayWorker sends the requests of one captured connection
+type replayWorker struct {
+	output   *ReplayOutput
+	key      string
+	requests chan *replayRequest
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+func (w *replayWorker) run() {
+	defer w.output.wg.Done()
+	defer w.closeConn()
+
+	idle := time.NewTimer(replayIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case req, ok := <-w.requests:
+			if !ok {
+				return
+			}
+			w.send(req)
+			resetTimer(idle, replayIdleTimeout)
+		case <-idle.C:
+			if w.output.removeWorker(w) {
+				return
+			}
+			resetTimer(idle, replayIdleTimeout)
+		}
+	}
+}
+
+// resetTimer stops the timer and drains a pending expiry before resetting it, a stale expiry would fire at once
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+func (w *replayWorker) send(req *replayRequest) {
+	if d := time.Until(req.due); d > 0 {
+		time.Sleep(d)
+	}
+
+	config := w.output.config
+	record := &ReplayRecord{
+		Timestamp:   time.Now(),
+		Source:      net.JoinHostPort(req.msg.SrcIP.String(), strconv.Itoa(int(req.msg.SrcPort))),
+		Target:      config.Target,
+		RequestSize: len(req.msg.Payload),
+	}
+
+	response, err := w.exchange(req.msg)
+	record.LatencyMs = float64(time.Since(record.Timestamp)) / float64(time.Millisecond)
+	record.ResponseSize = len(response)
+	record.Response, record.ResponseEncoding = encodePayload(response, "auto")
+	if err != nil {
+		record.Error = err.Error()
+		logger.Debug("[REPLAY] %s error: %v", w.key, err)
+		w.closeConn()
+	}
+	if !config.ReuseConnection {
+		w.closeConn()
+	}
+
+	w.output.writeRecord(record)
+}
+
+// exchange writes the request to the target and reads its response
+func (w *replayWorker) exchange(msg *message.NetMessage) ([]byte, error) {
+	config := w.output.config
+	if w.conn == nil {
+		conn, err := net.DialTimeout(msg.Protocol, config.Target, config.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		w.conn = conn
+		w.reader = bufio.NewReader(conn)
+		if config.DiscardResponse {
+			// the replies are still read, otherwise the target blocks on a full window
+			go func() { _, _ = io.Copy(io.Discard, conn) }()
+		}
+	}
+
+	if config.DiscardResponse {
+		_ = w.conn.SetWriteDeadline(time.Now().Add(config.Timeout))
+		_, err := w.conn.Write(msg.Payload)
+		return nil, err
+	}
+
+	_ = w.conn.SetDeadline(time.Now().Add(config.Timeout))
+	if _, err := w.conn.Write(msg.Payload); err != nil {
+		return nil, err
+	}
+
+	// the response has to be read even when it is not recorded, otherwise the target blocks on a full window
+	if httpMsg, ok := msg.Record.(*message.HTTPMessage); ok {
+		return readHTTPResponse(w.reader, httpMsg.Method)
+	}
+	return readAvailable(w.conn, w.reader)
+}
+
+func (w *replayWorker) closeConn() {
+	if w.conn != nil {
+		_ = w.conn.Close()
+		w.conn, w.reader = nil, nil
+	}
+}
+
+// readHTTPResponse reads exactly one HTTP response so that the connection can be reused for the next request
+// and rebuilds its bytes, the connection's reader must not be wrapped as a second buffer would read ahead
+func readHTTPResponse(reader *bufio.Reader, method string) ([]byte, error) {
+	resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	return httputil.DumpResponse(resp, true)
+}
+
+// readAvailable waits for the first bytes of a response and returns everything which arrives
+// without a pause, as the end of a response cannot be known for arbitrary protocols
+func readAvailable(conn net.Conn, reader *bufio.Reader) ([]byte, error) {
+	var response []byte
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := reader.Read(buf)
+		response = append(response, buf[:n]...)
+		if err != nil {
+			var netErr net.Error
+			if len(response) > 0 && (err == io.EOF || errors.As(err, &netErr) && netErr.Timeout()) {
+				return response, nil
+			}
+			return response, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	}
+}
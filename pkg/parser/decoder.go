@@ -0,0 +1,255 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"net-capture/pkg/message"
+	"sync"
+	"time"
+)
+
+// DecoderRaw is the name which can be forced for a port to keep its data undecoded
+const DecoderRaw = "raw"
+
+// maxDecoderBufferSize limits how much data is buffered while waiting for the rest of a message
+const maxDecoderBufferSize = 4 * maxMessageSize
+
+var (
+	errIncomplete = errors.New("incomplete message")
+	// errUpgrade tells that the data belongs to the protocol the connection was upgraded to
+	errUpgrade = errors.New("protocol upgraded")
+)
+
+// Decoder splits the data of one flow into application protocol messages. Decode consumes the message sent in
+// direction dir, 0 or 1, and returns the complete messages found so far, when final is set the sending side
+// will not send any more data and the remaining data has to be flushed. The flow metadata of msg is filled,
+// msg.Request tells whether the direction sends requests
+type Decoder interface {
+	Decode(dir int, msg *message.NetMessage, final bool) []*message.NetMessage
+}
+
+// DecoderFactory describes an application protocol, a flow is claimed by the decoder when one of its ports
+// is in Ports or, failing that, when Sniff accepts the first payload of the flow
+type DecoderFactory struct {
+	Name string
+	// Protocol is the transport the decoder handles, tcp or udp, or both when it is empty
+	Protocol string
+	Ports    []uint16
+	Sniff    func(payload []byte) bool
+	// New creates the decoder of one flow, for udp the flow of the datagrams between two endpoints
+	New func(options DecoderOptions) Decoder
+}
+
+// DecoderOptions are the settings of an input which the decoders of its flows share
+type DecoderOptions struct {
+	// GRPCDescriptors render the gRPC messages carried by HTTP/2 as JSON
+	GRPCDescriptors *GRPCDescriptors
+	// TLSKeyLog has the secrets to decrypt TLS connections
+	TLSKeyLog *TLSKeyLog
+}
+
+var (
+	decodersLock sync.RWMutex
+	decoders     []DecoderFactory
+)
+
+// RegisterDecoder makes a decoder available to all parsers, decoders are tried in the order they were registered
+func RegisterDecoder(factory DecoderFactory) {
+	decodersLock.Lock()
+	defer decodersLock.Unlock()
+
+	if factory.Name == DecoderRaw || factory.New == nil {
+		panic(fmt.Sprintf("invalid decoder %q", factory.Name))
+	}
+	for _, f := range decoders {
+		if f.Name == factory.Name {
+			panic(fmt.Sprintf("decoder %q registered twice", factory.Name))
+		}
+	}
+	decoders = append(decoders, factory)
+}
+
+// HasDecoder reports whether a decoder can be forced with the given name
+func HasDecoder(name string) bool {
+	if name == DecoderRaw {
+		return true
+	}
+	_, ok := lookupDecoder(name)
+	return ok
+}
+
+func lookupDecoder(name string) (DecoderFactory, bool) {
+	decodersLock.RLock()
+	defer decodersLock.RUnlock()
+
+	for _, f := range decoders {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return DecoderFactory{}, false
+}
+
+// newDecoder picks the decoder for a flow from its ports and first payload, nil keeps the flow undecoded
+func (parser *MessageParser) newDecoder(protocol string, srcPort, dstPort uint16, payload []byte) Decoder {
+	ports := []uint16{dstPort, srcPort}
+	for _, port := range ports {
+		if name, ok := parser.forced[port]; ok {
+			if f, ok := lookupDecoder(name); ok {
+				return f.New(parser.options)
+			}
+			return nil
+		}
+	}
+
+	decodersLock.RLock()
+	defer decodersLock.RUnlock()
+
+	for _, port := range ports {
+		for _, f := range decoders {
+			if handles(f, protocol) && containsPort(f.Ports, port) {
+				return f.New(parser.options)
+			}
+		}
+	}
+	if f, ok := sniffDecoder(protocol, payload, ""); ok {
+		return f.New(parser.options)
+	}
+	return nil
+}
+
+// sniffDecoder finds the first decoder other than skip which recognizes the payload, decodersLock has to be held
+func sniffDecoder(protocol string, payload []byte, skip string) (DecoderFactory, bool) {
+	for _, f := range decoders {
+		if f.Name != skip && handles(f, protocol) && f.Sniff != nil && f.Sniff(payload) {
+			return f, true
+		}
+	}
+	return DecoderFactory{}, false
+}
+
+func handles(f DecoderFactory, protocol string) bool {
+	return f.Protocol == "" || f.Protocol == protocol
+}
+
+func containsPort(ports []uint16, port uint16) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// decoderBuffer holds the bytes of one direction which do not form a complete message yet
+type decoderBuffer struct {
+	data      []byte
+	packets   []gopacket.Packet
+	timestamp time.Time
+}
+
+// frameParser parses the message at the start of data sent by the client when request is set, by the server
+// otherwise, and returns its record and the number of bytes it used.
+// errIncomplete asks for more data, errUpgrade hands the flow over to the decoder of an upgrader and any other
+// error stops decoding the flow. A nil record with a length passes the bytes through undecoded
+type frameParser interface {
+	parse(request bool, data []byte, final bool) (message.Record, int, error)
+}
+
+// upgrader is implemented by frame parsers of protocols which can switch the connection to a protocol decoded
+// by another decoder, upgrade returns that decoder after parse returned errUpgrade
+type upgrader interface {
+	upgrade() Decoder
+}
+
+// frameDecoder implements Decoder for protocols which can be parsed one message at a time from buffered data,
+// data which cannot be parsed turns the flow raw and is passed through undecoded from then on
+type frameDecoder struct {
+	parser  frameParser
+	buffers [2]decoderBuffer
+	raw     bool
+	// next decodes the flow after a protocol upgrade
+	next Decoder
+}
+
+func newFrameDecoder(parser frameParser) *frameDecoder {
+	return &frameDecoder{parser: parser}
+}
+
+func (d *frameDecoder) Decode(dir int, msg *message.NetMessage, final bool) (result []*message.NetMessage) {
+	buf := &d.buffers[dir]
+	if d.next != nil {
+		return d.next.Decode(dir, msg, final)
+	}
+	if d.raw {
+		if len(msg.Payload) > 0 {
+			result = append(result, msg)
+		}
+		return
+	}
+
+	if len(buf.data) == 0 {
+		buf.timestamp = msg.Timestamp
+	}
+	buf.data = append(buf.data, msg.Payload...)
+	buf.packets = append(buf.packets, msg.Packets...)
+
+	for len(buf.data) > 0 {
+		record, n, err := d.parser.parse(msg.Request, buf.data, final)
+		if u, ok := d.parser.(upgrader); ok && err == errUpgrade {
+			d.next = u.upgrade()
+			result = append(result, d.handOver(dir, msg, final)...)
+			break
+		}
+		if err == errIncomplete && !final && len(buf.data) < maxDecoderBufferSize {
+			break
+		}
+		if err != nil || n <= 0 {
+			d.raw = true
+			result = append(result, d.message(msg, buf, len(buf.data), nil))
+			break
+		}
+
+		result = append(result, d.message(msg, buf, n, record))
+		// pipelined messages following in the same chunk started arriving with it
+		buf.timestamp = msg.Timestamp
+	}
+	return
+}
+
+// handOver passes the data buffered in both directions to the decoder of the upgraded protocol
+func (d *frameDecoder) handOver(dir int, template *message.NetMessage, final bool) (result []*message.NetMessage) {
+	for i := range d.buffers {
+		buf := &d.buffers[i]
+		if len(buf.data) == 0 && (i != dir || !final) {
+			continue
+		}
+		msg := d.message(template, buf, len(buf.data), nil)
+		if i != dir {
+			reverseMessage(msg)
+		}
+		result = append(result, d.next.Decode(i, msg, final && i == dir)...)
+	}
+	return
+}
+
+// reverseMessage turns a message built from a template of one direction into a message of the other direction
+func reverseMessage(msg *message.NetMessage) {
+	msg.Network, msg.Transport = msg.Network.Reverse(), msg.Transport.Reverse()
+	msg.SrcIP, msg.DstIP = msg.DstIP, msg.SrcIP
+	msg.SrcPort, msg.DstPort = msg.DstPort, msg.SrcPort
+	msg.Request = !msg.Request
+}
+
+// message builds a NetMessage from the first n buffered bytes and removes them from the buffer
+func (d *frameDecoder) message(template *message.NetMessage, buf *decoderBuffer, n int, record message.Record) *message.NetMessage {
+	msg := *template
+	msg.Packets = buf.packets
+	msg.Timestamp = buf.timestamp
+	msg.Payload = buf.data[:n:n]
+	msg.Record = record
+	buf.data = buf.data[n:]
+	buf.packets = nil
+	return &msg
+}
@@ -0,0 +1,198 @@
+package parser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDNSPendingQueries bounds the queries of a flow waiting for their response
+const maxDNSPendingQueries = 1024
+
+var dnsResponseCodes = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+	layers.DNSResponseCodeYXDomain: "YXDOMAIN",
+	layers.DNSResponseCodeYXRRSet:  "YXRRSET",
+	layers.DNSResponseCodeNXRRSet:  "NXRRSET",
+	layers.DNSResponseCodeNotAuth:  "NOTAUTH",
+	layers.DNSResponseCodeNotZone:  "NOTZONE",
+}
+
+var dnsOpCodes = map[layers.DNSOpCode]string{
+	layers.DNSOpCodeQuery:  "QUERY",
+	layers.DNSOpCodeIQuery: "IQUERY",
+	layers.DNSOpCodeStatus: "STATUS",
+	layers.DNSOpCodeNotify: "NOTIFY",
+	layers.DNSOpCodeUpdate: "UPDATE",
+}
+
+func init() {
+	RegisterDecoder(DecoderFactory{
+		Name:  "dns",
+		Ports: []uint16{53},
+		New: func(DecoderOptions) Decoder {
+			return newDNSDecoder()
+		},
+	})
+}
+
+// dnsDecoder decodes DNS over UDP, one message per datagram, and over TCP, where every message is preceded
+// by its length. Responses are matched to their queries by transaction id to measure the resolution latency
+type dnsDecoder struct {
+	frames  *frameDecoder
+	queries map[uint16]time.Time
+}
+
+func newDNSDecoder() *dnsDecoder {
+	return &dnsDecoder{frames: newFrameDecoder(dnsTCPParser{}), queries: make(map[uint16]time.Time)}
+}
+
+func (d *dnsDecoder) Decode(dir int, msg *message.NetMessage, final bool) []*message.NetMessage {
+	var result []*message.NetMessage
+	if msg.Protocol == model.ProtocolTCP {
+		result = d.frames.Decode(dir, msg, final)
+	} else if len(msg.Payload) > 0 {
+		if record, err := decodeDNS(msg.Payload); err == nil {
+			msg.Record = record
+		}
+		result = []*message.NetMessage{msg}
+	}
+
+	for _, m := range result {
+		if record, ok := m.Record.(*message.DNSMessage); ok {
+			d.match(record, m.Timestamp)
+		}
+	}
+	return result
+}
+
+// match remembers when a query was sent and sets the latency of its response
+func (d *dnsDecoder) match(record *message.DNSMessage, timestamp time.Time) {
+	if !record.Response {
+		if len(d.queries) >= maxDNSPendingQueries {
+			d.queries = make(map[uint16]time.Time)
+		}
+		d.queries[record.ID] = timestamp
+		return
+	}
+
+	if sent, ok := d.queries[record.ID]; ok {
+		delete(d.queries, record.ID)
+		record.LatencyMs = float64(timestamp.Sub(sent)) / float64(time.Millisecond)
+	}
+}
+
+// dnsTCPParser splits DNS over TCP at the length prefix of the messages
+type dnsTCPParser struct{}
+
+func (dnsTCPParser) parse(_ bool, data []byte, _ bool) (message.Record, int, error) {
+	if len(data) < 2 {
+		return nil, 0, errIncomplete
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return nil, 0, errIncomplete
+	}
+
+	record, err := decodeDNS(data[2 : 2+length])
+	if err != nil {
+		return nil, 0, err
+	}
+	return record, 2 + length, nil
+}
+
+func decodeDNS(data []byte) (*message.DNSMessage, error) {
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+
+	record := &message.DNSMessage{
+		ID:          dns.ID,
+		Response:    dns.QR,
+		OpCode:      dnsOpCodes[dns.OpCode],
+		Truncated:   dns.TC,
+		Authorities: len(dns.Authorities),
+		Additionals: len(dns.Additionals),
+		Size:        len(data),
+	}
+	if record.OpCode == "" {
+		record.OpCode = strconv.Itoa(int(dns.OpCode))
+	}
+	if dns.QR {
+		record.RCode = dnsResponseCodes[dns.ResponseCode]
+		if record.RCode == "" {
+			record.RCode = strconv.Itoa(int(dns.ResponseCode))
+		}
+	}
+
+	for _, q := range dns.Questions {
+		record.Questions = append(record.Questions, message.DNSQuestion{
+			Name:  dnsName(q.Name),
+			Type:  dnsType(q.Type),
+			Class: q.Class.String(),
+		})
+	}
+	for _, a := range dns.Answers {
+		record.Answers = append(record.Answers, message.DNSRecord{
+			Name: dnsName(a.Name),
+			Type: dnsType(a.Type),
+			TTL:  a.TTL,
+			Data: dnsData(a),
+		})
+	}
+	return record, nil
+}
+
+func dnsName(name []byte) string {
+	if len(name) == 0 {
+		return "."
+	}
+	return string(name)
+}
+
+func dnsType(t layers.DNSType) string {
+	if name := t.String(); name != "Unknown" {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// dnsData formats the data of a resource record like dig does for the common types
+func dnsData(rr layers.DNSResourceRecord) string {
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		return rr.IP.String()
+	case layers.DNSTypeNS:
+		return string(rr.NS)
+	case layers.DNSTypeCNAME:
+		return string(rr.CNAME)
+	case layers.DNSTypePTR:
+		return string(rr.PTR)
+	case layers.DNSTypeMX:
+		return fmt.Sprintf("%d %s", rr.MX.Preference, rr.MX.Name)
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", rr.SRV.Priority, rr.SRV.Weight, rr.SRV.Port, rr.SRV.Name)
+	case layers.DNSTypeSOA:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", rr.SOA.MName, rr.SOA.RName, rr.SOA.Serial,
+			rr.SOA.Refresh, rr.SOA.Retry, rr.SOA.Expire, rr.SOA.Minimum)
+	case layers.DNSTypeTXT:
+		var txts []string
+		for _, txt := range rr.TXTs {
+			txts = append(txts, strconv.Quote(string(txt)))
+		}
+		return strings.Join(txts, " ")
+	}
+	return fmt.Sprintf("\\# %d %x", len(rr.Data), rr.Data)
+}
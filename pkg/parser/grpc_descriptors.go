@@ -0,0 +1,88 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"os"
+)
+
+// GRPCDescriptors are the protobuf descriptor sets of the services whose gRPC messages are rendered as JSON,
+// they are not changed after loading and shared by the decoders of all flows of an input
+type GRPCDescriptors struct {
+	files []*protoregistry.Files
+}
+
+// LoadGRPCDescriptors reads protobuf descriptor sets, as written by protoc --include_imports --descriptor_set_out,
+// nil is returned without paths
+func LoadGRPCDescriptors(paths []string) (*GRPCDescriptors, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	descriptors := &GRPCDescriptors{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		set := &descriptorpb.FileDescriptorSet{}
+		if err = proto.Unmarshal(data, set); err != nil {
+			return nil, fmt.Errorf("invalid descriptor set %s: %w", path, err)
+		}
+		files, err := protodesc.NewFiles(set)
+		if err != nil {
+			return nil, fmt.Errorf("invalid descriptor set %s: %w", path, err)
+		}
+		descriptors.files = append(descriptors.files, files)
+	}
+	return descriptors, nil
+}
+
+// messageType finds the type of the request or response messages of the method called with path
+func (g *GRPCDescriptors) messageType(path string, request bool) protoreflect.MessageDescriptor {
+	if g == nil {
+		return nil
+	}
+	service, method := splitGRPCPath(path)
+
+	for _, files := range g.files {
+		desc, err := files.FindDescriptorByName(protoreflect.FullName(service))
+		if err != nil {
+			continue
+		}
+		sd, ok := desc.(protoreflect.ServiceDescriptor)
+		if !ok {
+			continue
+		}
+		if md := sd.Methods().ByName(protoreflect.Name(method)); md != nil {
+			if request {
+				return md.Input()
+			}
+			return md.Output()
+		}
+	}
+	return nil
+}
+
+// render renders a message as JSON, nil is returned when its type is unknown or it cannot be decoded
+func (g *GRPCDescriptors) render(path string, request bool, data []byte) json.RawMessage {
+	desc := g.messageType(path, request)
+	if desc == nil {
+		return nil
+	}
+	msg := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil
+	}
+	rendered, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil
+	}
+	return rendered
+}
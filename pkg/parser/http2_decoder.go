@@ -0,0 +1,482 @@
+package parser
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	http2FrameHeaderLength = 9
+	// http2DefaultTableSize is the size of the HPACK dynamic table until SETTINGS change it
+	http2DefaultTableSize = 4096
+	// http2MaxStreams bounds the streams of a connection waiting for their end
+	http2MaxStreams = 1024
+)
+
+const (
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FrameRSTStream    = 0x3
+	http2FrameSettings     = 0x4
+	http2FramePushPromise  = 0x5
+	http2FrameContinuation = 0x9
+)
+
+const (
+	http2FlagEndStream  = 0x1
+	http2FlagAck        = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+)
+
+const http2SettingHeaderTableSize = 0x1
+
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+var errInvalidHTTP2 = errors.New("invalid HTTP/2 data")
+
+var http2ErrorCodes = []string{
+	"NO_ERROR",
+	"PROTOCOL_ERROR",
+	"INTERNAL_ERROR",
+	"FLOW_CONTROL_ERROR",
+	"SETTINGS_TIMEOUT",
+	"STREAM_CLOSED",
+	"FRAME_SIZE_ERROR",
+	"REFUSED_STREAM",
+	"CANCEL",
+	"COMPRESSION_ERROR",
+	"CONNECT_ERROR",
+	"ENHANCE_YOUR_CALM",
+	"INADEQUATE_SECURITY",
+	"HTTP_1_1_REQUIRED",
+}
+
+func init() {
+	RegisterDecoder(DecoderFactory{
+		Name:     "http2",
+		Protocol: model.ProtocolTCP,
+		Sniff:    isHTTP2,
+		New: func(options DecoderOptions) Decoder {
+			return newHTTP2Decoder(options.GRPCDescriptors)
+		},
+	})
+}
+
+// isHTTP2 sniffs for the connection preface a client sends when it knows the server speaks HTTP/2
+func isHTTP2(payload []byte) bool {
+	return bytes.HasPrefix(payload, http2Preface)
+}
+
+// http2Decoder decodes the frames of a cleartext HTTP/2 connection. The header blocks of every direction are
+// decompressed with their own HPACK table, the frames of the multiplexed streams are collected per stream and
+// one message is emitted for every request and every response when its stream ends
+type http2Decoder struct {
+	buffers [2]decoderBuffer
+	started [2]bool
+	tables  [2]*hpack.Decoder
+	// streams by id whose request or response is still being received in a direction
+	streams [2]map[uint32]*http2Stream
+	// block is the header block continued by CONTINUATION frames
+	block [2]*http2Block
+	// requests by stream id, to know the gRPC method and content type of their responses
+	requests map[uint32]*message.HTTP2Message
+	// ready holds the streams ended by the frames parsed so far
+	ready []*http2Stream
+	raw   bool
+	// descriptors render the gRPC messages, nil leaves them undecoded
+	descriptors *GRPCDescriptors
+}
+
+// http2Stream is the request or the response of a stream
+type http2Stream struct {
+	record *message.HTTP2Message
+	// dir is the direction the request or response is sent in
+	dir       int
+	headers   bool
+	body      []byte
+	timestamp time.Time
+}
+
+type http2Block struct {
+	streamID  uint32
+	endStream bool
+	promise   bool
+	fragment  []byte
+}
+
+func newHTTP2Decoder(descriptors *GRPCDescriptors) *http2Decoder {
+	d := &http2Decoder{requests: make(map[uint32]*message.HTTP2Message), descriptors: descriptors}
+	for i := range d.tables {
+		d.tables[i] = hpack.NewDecoder(http2DefaultTableSize, nil)
+		d.streams[i] = make(map[uint32]*http2Stream)
+	}
+	return d
+}
+
+func (d *http2Decoder) Decode(dir int, msg *message.NetMessage, final bool) (result []*message.NetMessage) {
+	if d.raw {
+		if len(msg.Payload) > 0 {
+			result = append(result, msg)
+		}
+		return
+	}
+
+	buf := &d.buffers[dir]
+	if len(buf.data) == 0 {
+		buf.timestamp = msg.Timestamp
+	}
+	buf.data = append(buf.data, msg.Payload...)
+	buf.packets = append(buf.packets, msg.Packets...)
+
+	if !d.started[dir] {
+		if len(buf.data) < len(http2Preface) && bytes.HasPrefix(http2Preface, buf.data) && !final {
+			return
+		}
+		buf.data = bytes.TrimPrefix(buf.data, http2Preface)
+		d.started[dir] = true
+	}
+
+	for len(buf.data) >= http2FrameHeaderLength {
+		length := int(buf.data[0])<<16 | int(buf.data[1])<<8 | int(buf.data[2])
+		if len(buf.data) < http2FrameHeaderLength+length {
+			if len(buf.data) < maxDecoderBufferSize {
+				break
+			}
+			return d.passThrough(dir, msg, result)
+		}
+
+		kind, flags := buf.data[3], buf.data[4]
+		streamID := binary.BigEndian.Uint32(buf.data[5:9]) & 0x7fffffff
+		payload := buf.data[http2FrameHeaderLength : http2FrameHeaderLength+length]
+		if err := d.frame(dir, kind, flags, streamID, payload, buf.timestamp); err != nil {
+			return d.passThrough(dir, msg, result)
+		}
+		buf.data = buf.data[http2FrameHeaderLength+length:]
+		buf.timestamp = msg.Timestamp
+		result = append(result, d.emit(dir, msg, buf)...)
+	}
+
+	if final {
+		for id := range d.streams[dir] {
+			d.end(dir, id)
+		}
+		result = append(result, d.emit(dir, msg, buf)...)
+	}
+	return
+}
+
+// passThrough gives up decoding the connection, the buffered data is passed through undecoded
+func (d *http2Decoder) passThrough(dir int, template *message.NetMessage, result []*message.NetMessage) []*message.NetMessage {
+	d.raw = true
+	buf := &d.buffers[dir]
+	msg := *template
+	msg.Packets = buf.packets
+	msg.Timestamp = buf.timestamp
+	msg.Payload = buf.data
+	msg.Record = nil
+	buf.data, buf.packets = nil, nil
+	return append(result, &msg)
+}
+
+// emit builds the messages of the ended streams, the packets buffered so far are attached to the first of them.
+// Streams of the other direction, ended by RST_STREAM, are emitted in the direction they were sent in
+func (d *http2Decoder) emit(dir int, template *message.NetMessage, buf *decoderBuffer) (result []*message.NetMessage) {
+	for _, s := range d.ready {
+		msg := *template
+		if s.dir != dir {
+			reverseMessage(&msg)
+		}
+		msg.Packets = buf.packets
+		msg.Timestamp = s.timestamp
+		msg.Payload = s.body
+		msg.Record = s.record
+		buf.packets = nil
+		result = append(result, &msg)
+	}
+	d.ready = nil
+	return
+}
+
+func (d *http2Decoder) frame(dir int, kind, flags byte, streamID uint32, payload []byte, timestamp time.Time) error {
+	if d.block[dir] != nil && kind != http2FrameContinuation {
+		return errInvalidHTTP2
+	}
+
+	switch kind {
+	case http2FrameData:
+		if streamID == 0 {
+			return errInvalidHTTP2
+		}
+		data, err := http2Unpad(flags, payload)
+		if err != nil {
+			return err
+		}
+		s := d.stream(dir, streamID, timestamp)
+		s.record.BodySize += len(data)
+		if len(s.body) < maxDecoderBufferSize {
+			s.body = append(s.body, data...)
+		}
+		if flags&http2FlagEndStream != 0 {
+			d.end(dir, streamID)
+		}
+	case http2FrameHeaders:
+		if streamID == 0 {
+			return errInvalidHTTP2
+		}
+		fragment, err := http2Unpad(flags, payload)
+		if err != nil {
+			return err
+		}
+		if flags&http2FlagPriority != 0 {
+			if len(fragment) < 5 {
+				return errInvalidHTTP2
+			}
+			fragment = fragment[5:]
+		}
+		block := &http2Block{streamID: streamID, endStream: flags&http2FlagEndStream != 0}
+		return d.headerBlock(dir, block, fragment, flags, timestamp)
+	case http2FramePushPromise:
+		fragment, err := http2Unpad(flags, payload)
+		if err != nil {
+			return err
+		}
+		if len(fragment) < 4 {
+			return errInvalidHTTP2
+		}
+		block := &http2Block{streamID: streamID, promise: true}
+		return d.headerBlock(dir, block, fragment[4:], flags, timestamp)
+	case http2FrameContinuation:
+		block := d.block[dir]
+		if block == nil || block.streamID != streamID {
+			return errInvalidHTTP2
+		}
+		d.block[dir] = nil
+		return d.headerBlock(dir, block, payload, flags, timestamp)
+	case http2FrameRSTStream:
+		if streamID == 0 || len(payload) != 4 {
+			return errInvalidHTTP2
+		}
+		code := binary.BigEndian.Uint32(payload)
+		reset := "0x" + strconv.FormatUint(uint64(code), 16)
+		if int(code) < len(http2ErrorCodes) {
+			reset = http2ErrorCodes[code]
+		}
+		// the reset ends the stream in both directions, a stream which already ended on both sides is emitted
+		// with the reset alone
+		other, ok := d.streams[1-dir][streamID]
+		if ok {
+			other.record.Reset = reset
+			d.end(1-dir, streamID)
+		}
+		if _, open := d.streams[dir][streamID]; open || !ok {
+			d.stream(dir, streamID, timestamp).record.Reset = reset
+			d.end(dir, streamID)
+		}
+	case http2FrameSettings:
+		if flags&http2FlagAck != 0 {
+			return nil
+		}
+		if streamID != 0 || len(payload)%6 != 0 {
+			return errInvalidHTTP2
+		}
+		for i := 0; i < len(payload); i += 6 {
+			if binary.BigEndian.Uint16(payload[i:]) == http2SettingHeaderTableSize {
+				// the table size limits the header blocks sent to the side announcing it
+				d.tables[1-dir].SetAllowedMaxDynamicTableSize(binary.BigEndian.Uint32(payload[i+2:]))
+			}
+		}
+	}
+	return nil
+}
+
+// headerBlock decodes a complete header block or waits for its CONTINUATION frames
+func (d *http2Decoder) headerBlock(dir int, block *http2Block, fragment []byte, flags byte, timestamp time.Time) error {
+	block.fragment = append(block.fragment, fragment...)
+	if flags&http2FlagEndHeaders == 0 {
+		if len(block.fragment) > maxDecoderBufferSize {
+			return errInvalidHTTP2
+		}
+		d.block[dir] = block
+		return nil
+	}
+
+	fields, err := d.tables[dir].DecodeFull(block.fragment)
+	if err != nil {
+		return err
+	}
+	if block.promise {
+		// the promised request only has to be decoded to keep the table in sync
+		return nil
+	}
+
+	s := d.stream(dir, block.streamID, timestamp)
+	if s.headers {
+		s.record.Trailer = make(http.Header)
+		for _, f := range fields {
+			s.record.Trailer.Add(f.Name, f.Value)
+		}
+	} else {
+		s.headers = true
+		readHTTP2Headers(s.record, fields)
+		if s.record.IsRequest() {
+			if len(d.requests) >= http2MaxStreams {
+				d.requests = make(map[uint32]*message.HTTP2Message)
+			}
+			d.requests[block.streamID] = s.record
+		}
+	}
+	if block.endStream {
+		d.end(dir, block.streamID)
+	}
+	return nil
+}
+
+func readHTTP2Headers(record *message.HTTP2Message, fields []hpack.HeaderField) {
+	for _, f := range fields {
+		switch f.Name {
+		case ":method":
+			record.Method = f.Value
+		case ":scheme":
+			record.Scheme = f.Value
+		case ":authority":
+			record.Authority = f.Value
+		case ":path":
+			record.Path = f.Value
+		case ":status":
+			record.Status, _ = strconv.Atoi(f.Value)
+		default:
+			record.Header.Add(f.Name, f.Value)
+		}
+	}
+}
+
+// stream returns the request or response being received on a stream, starting it with the current frame
+func (d *http2Decoder) stream(dir int, id uint32, timestamp time.Time) *http2Stream {
+	s, ok := d.streams[dir][id]
+	if !ok {
+		if len(d.streams[dir]) >= http2MaxStreams {
+			d.streams[dir] = make(map[uint32]*http2Stream)
+		}
+		s = &http2Stream{
+			record:    &message.HTTP2Message{StreamID: id, Header: make(http.Header)},
+			dir:       dir,
+			timestamp: timestamp,
+		}
+		d.streams[dir][id] = s
+	}
+	return s
+}
+
+// end completes the request or response of a stream, the messages of gRPC calls are decoded from its body
+func (d *http2Decoder) end(dir int, id uint32) {
+	s, ok := d.streams[dir][id]
+	if !ok {
+		return
+	}
+	delete(d.streams[dir], id)
+
+	record := s.record
+	request := record
+	if !record.IsRequest() {
+		request = d.requests[id]
+		delete(d.requests, id)
+	}
+	contentType := record.Header.Get("Content-Type")
+	if contentType == "" && request != nil {
+		contentType = request.Header.Get("Content-Type")
+	}
+	if strings.HasPrefix(contentType, "application/grpc") && request != nil {
+		record.GRPC = decodeGRPC(d.descriptors, request.Path, record, s.body)
+	}
+	d.ready = append(d.ready, s)
+}
+
+// decodeGRPC splits the body of a gRPC request or response into its length prefixed messages
+func decodeGRPC(descriptors *GRPCDescriptors, path string, record *message.HTTP2Message, body []byte) *message.GRPCCall {
+	call := &message.GRPCCall{Messages: []message.GRPCMessage{}}
+	call.Service, call.Method = splitGRPCPath(path)
+	encoding := record.Header.Get("Grpc-Encoding")
+
+	for len(body) >= 5 {
+		msg := message.GRPCMessage{Compressed: body[0] == 1, Size: int(binary.BigEndian.Uint32(body[1:5]))}
+		if len(body) < 5+msg.Size {
+			// the body was larger than what is buffered
+			call.Messages = append(call.Messages, msg)
+			break
+		}
+		data := body[5 : 5+msg.Size]
+		if msg.Compressed {
+			data = decompressGRPC(encoding, data)
+		}
+		if data != nil {
+			msg.JSON = descriptors.render(path, record.IsRequest(), data)
+		}
+		call.Messages = append(call.Messages, msg)
+		body = body[5+msg.Size:]
+	}
+
+	// a response without messages carries its status in the headers instead of the trailers
+	status := record.Trailer.Get("Grpc-Status")
+	statusMessage := record.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, statusMessage = record.Header.Get("Grpc-Status"), record.Header.Get("Grpc-Message")
+	}
+	if code, err := strconv.Atoi(status); err == nil {
+		call.Status = &code
+		call.StatusMessage = statusMessage
+		if unescaped, err := url.PathUnescape(statusMessage); err == nil {
+			call.StatusMessage = unescaped
+		}
+	}
+	return call
+}
+
+// decompressGRPC decompresses a gzip compressed message, nil is returned for other encodings and for messages
+// which decompress to more than the decoders buffer
+func decompressGRPC(encoding string, data []byte) []byte {
+	if encoding != "gzip" {
+		return nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	decoded, err := io.ReadAll(io.LimitReader(reader, maxDecoderBufferSize+1))
+	if err != nil || len(decoded) > maxDecoderBufferSize {
+		return nil
+	}
+	return decoded
+}
+
+// splitGRPCPath returns the full service name and the method name of a path like /package.Service/Method
+func splitGRPCPath(path string) (string, string) {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// http2Unpad removes the padding of DATA, HEADERS and PUSH_PROMISE frames
+func http2Unpad(flags byte, payload []byte) ([]byte, error) {
+	if flags&http2FlagPadded == 0 {
+		return payload, nil
+	}
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, errInvalidHTTP2
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
@@ -0,0 +1,170 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"net/http"
+	"strings"
+)
+
+var httpMethods = []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS", "PATCH", "CONNECT", "TRACE"}
+
+func init() {
+	RegisterDecoder(DecoderFactory{
+		Name:     "http",
+		Protocol: model.ProtocolTCP,
+		Ports:    []uint16{80},
+		Sniff:    isHTTP,
+		New: func(options DecoderOptions) Decoder {
+			return newFrameDecoder(&httpParser{descriptors: options.GRPCDescriptors})
+		},
+	})
+}
+
+// isHTTP sniffs the first bytes of a connection for an HTTP/1.x request or response line
+func isHTTP(payload []byte) bool {
+	if bytes.HasPrefix(payload, []byte("HTTP/1.")) {
+		return true
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(payload, []byte(method+" ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpParser parses the HTTP/1.x messages of one connection,
+// it supports pipelining, chunked transfer encoding and gzip/deflate content encoding
+type httpParser struct {
+	// methods of the requests waiting for a response, needed to know whether a response has a body
+	methods []string
+	// set after a protocol switch, all further data is passed through undecoded
+	switched bool
+	// set after a switch to cleartext HTTP/2
+	h2c bool
+	// descriptors are handed over to the HTTP/2 decoder
+	descriptors *GRPCDescriptors
+}
+
+// upgrade hands connections which switched to cleartext HTTP/2 over to the HTTP/2 decoder
+func (p *httpParser) upgrade() Decoder {
+	return newHTTP2Decoder(p.descriptors)
+}
+
+// parse decodes the HTTP message at the start of data and returns it together with the number of bytes it used
+func (p *httpParser) parse(_ bool, data []byte, final bool) (message.Record, int, error) {
+	// HTTP/2 starts after an upgrade to h2c or right away when the client knows the server speaks it
+	if p.h2c || bytes.HasPrefix(data, http2Preface) {
+		return nil, 0, errUpgrade
+	}
+	if p.switched {
+		return nil, len(data), nil
+	}
+
+	reader := bytes.NewReader(data)
+	br := bufio.NewReader(reader)
+	consumed := func() int {
+		return len(data) - reader.Len() - br.Buffered()
+	}
+
+	if bytes.HasPrefix(data, []byte("HTTP/")) {
+		method := http.MethodGet
+		if len(p.methods) > 0 {
+			method = p.methods[0]
+		}
+
+		resp, err := http.ReadResponse(br, &http.Request{Method: method})
+		if err != nil {
+			return nil, 0, parseError(err)
+		}
+		// without length or chunking the body ends with the connection
+		if resp.Body != http.NoBody && resp.ContentLength == -1 && len(resp.TransferEncoding) == 0 && !final {
+			return nil, 0, errIncomplete
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, 0, parseError(err)
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusSwitchingProtocols:
+			p.switched = true
+			p.h2c = strings.EqualFold(resp.Header.Get("Upgrade"), "h2c")
+		case resp.StatusCode >= 200 && len(p.methods) > 0:
+			p.methods = p.methods[1:]
+		}
+
+		return &message.HTTPMessage{
+			Proto:      resp.Proto,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Header:     resp.Header,
+			Body:       decodeBody(resp.Header, body),
+		}, consumed(), nil
+	}
+
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, 0, parseError(err)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, 0, parseError(err)
+	}
+	p.methods = append(p.methods, req.Method)
+
+	return &message.HTTPMessage{
+		Method: req.Method,
+		URL:    req.RequestURI,
+		Proto:  req.Proto,
+		Header: req.Header,
+		Body:   decodeBody(req.Header, body),
+	}, consumed(), nil
+}
+
+// parseError tells apart data which has not fully arrived yet from data which is not HTTP
+func parseError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errIncomplete
+	}
+	return err
+}
+
+// decodeBody decompresses gzip or deflate encoded bodies, the original body is kept if that fails
+func decodeBody(header http.Header, body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+
+	var reader io.Reader
+	var err error
+	switch strings.ToLower(header.Get("Content-Encoding")) {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate is supposed to be zlib wrapped, but some servers send raw deflate
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return body
+	}
+	if err != nil {
+		return body
+	}
+
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
@@ -0,0 +1,540 @@
+package parser
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"strconv"
+)
+
+const (
+	kafkaProduce      = 0
+	kafkaFetch        = 1
+	kafkaMetadata     = 3
+	kafkaOffsetCommit = 8
+	// kafkaMaxPendingRequests bounds the requests of a connection waiting for their response
+	kafkaMaxPendingRequests = 1024
+)
+
+var errInvalidKafka = errors.New("invalid Kafka data")
+
+var kafkaAPIKeys = []string{
+	"Produce", "Fetch", "ListOffsets", "Metadata", "LeaderAndIsr", "StopReplica", "UpdateMetadata",
+	"ControlledShutdown", "OffsetCommit", "OffsetFetch", "FindCoordinator", "JoinGroup", "Heartbeat", "LeaveGroup",
+	"SyncGroup", "DescribeGroups", "ListGroups", "SaslHandshake", "ApiVersions", "CreateTopics", "DeleteTopics",
+	"DeleteRecords", "InitProducerId", "OffsetForLeaderEpoch", "AddPartitionsToTxn", "AddOffsetsToTxn", "EndTxn",
+	"WriteTxnMarkers", "TxnOffsetCommit", "DescribeAcls", "CreateAcls", "DeleteAcls", "DescribeConfigs",
+	"AlterConfigs", "AlterReplicaLogDirs", "DescribeLogDirs", "SaslAuthenticate", "CreatePartitions",
+	"CreateDelegationToken", "RenewDelegationToken", "ExpireDelegationToken", "DescribeDelegationToken",
+	"DeleteGroups", "ElectLeaders", "IncrementalAlterConfigs", "AlterPartitionReassignments",
+	"ListPartitionReassignments", "OffsetDelete", "DescribeClientQuotas", "AlterClientQuotas",
+	"DescribeUserScramCredentials", "AlterUserScramCredentials",
+}
+
+var kafkaErrors = map[int16]string{
+	-1:  "UNKNOWN_SERVER_ERROR",
+	1:   "OFFSET_OUT_OF_RANGE",
+	2:   "CORRUPT_MESSAGE",
+	3:   "UNKNOWN_TOPIC_OR_PARTITION",
+	4:   "INVALID_FETCH_SIZE",
+	5:   "LEADER_NOT_AVAILABLE",
+	6:   "NOT_LEADER_OR_FOLLOWER",
+	7:   "REQUEST_TIMED_OUT",
+	8:   "BROKER_NOT_AVAILABLE",
+	9:   "REPLICA_NOT_AVAILABLE",
+	10:  "MESSAGE_TOO_LARGE",
+	12:  "OFFSET_METADATA_TOO_LARGE",
+	14:  "COORDINATOR_LOAD_IN_PROGRESS",
+	15:  "COORDINATOR_NOT_AVAILABLE",
+	16:  "NOT_COORDINATOR",
+	17:  "INVALID_TOPIC_EXCEPTION",
+	19:  "NOT_ENOUGH_REPLICAS",
+	20:  "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	22:  "ILLEGAL_GENERATION",
+	25:  "UNKNOWN_MEMBER_ID",
+	27:  "REBALANCE_IN_PROGRESS",
+	28:  "INVALID_COMMIT_OFFSET_SIZE",
+	29:  "TOPIC_AUTHORIZATION_FAILED",
+	30:  "GROUP_AUTHORIZATION_FAILED",
+	31:  "CLUSTER_AUTHORIZATION_FAILED",
+	35:  "UNSUPPORTED_VERSION",
+	36:  "TOPIC_ALREADY_EXISTS",
+	41:  "NOT_CONTROLLER",
+	58:  "SASL_AUTHENTICATION_FAILED",
+	74:  "FENCED_LEADER_EPOCH",
+	75:  "UNKNOWN_LEADER_EPOCH",
+	100: "UNKNOWN_TOPIC_ID",
+}
+
+// kafkaFlexibleVersions are the first versions of the decoded APIs using compact fields and tagged fields
+var kafkaFlexibleVersions = map[int16]int16{kafkaProduce: 9, kafkaFetch: 12, kafkaMetadata: 9, kafkaOffsetCommit: 8}
+
+func init() {
+	RegisterDecoder(DecoderFactory{
+		Name:     "kafka",
+		Protocol: model.ProtocolTCP,
+		Ports:    []uint16{9092},
+		Sniff:    isKafka,
+		New: func(DecoderOptions) Decoder {
+			return newFrameDecoder(&kafkaParser{pending: make(map[int32]kafkaRequest)})
+		},
+	})
+}
+
+// isKafka sniffs for a request whose length prefix matches the payload and whose header has a known API key
+func isKafka(payload []byte) bool {
+	if len(payload) < 14 || int(binary.BigEndian.Uint32(payload)) != len(payload)-4 {
+		return false
+	}
+	apiKey := int16(binary.BigEndian.Uint16(payload[4:6]))
+	version := int16(binary.BigEndian.Uint16(payload[6:8]))
+	clientID := int16(binary.BigEndian.Uint16(payload[12:14]))
+	return apiKey >= 0 && int(apiKey) < len(kafkaAPIKeys) && version >= 0 && version < 20 &&
+		clientID >= -1 && int(clientID) <= len(payload)-14
+}
+
+// kafkaRequest is what a response needs to know about its request to be decoded
+type kafkaRequest struct {
+	apiKey   int16
+	version  int16
+	clientID string
+}
+
+// kafkaParser parses the requests and responses of one connection, responses are matched to their requests
+// by correlation id
+type kafkaParser struct {
+	pending map[int32]kafkaRequest
+}
+
+func (p *kafkaParser) parse(request bool, data []byte, _ bool) (message.Record, int, error) {
+	if len(data) < 4 {
+		return nil, 0, errIncomplete
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	if size < 4 || size > maxDecoderBufferSize {
+		return nil, 0, errInvalidKafka
+	}
+	if len(data) < 4+size {
+		return nil, 0, errIncomplete
+	}
+
+	r := &kafkaReader{data: data[4 : 4+size]}
+	record := &message.KafkaMessage{Size: size}
+	if request {
+		apiKey, version := r.int16(), r.int16()
+		record.CorrelationID = r.int32()
+		record.ClientID = r.nullableString()
+		if r.err != nil || apiKey < 0 || version < 0 {
+			return nil, 0, errInvalidKafka
+		}
+		record.APIKey, record.APIVersion = kafkaAPIName(apiKey), version
+		if len(p.pending) >= kafkaMaxPendingRequests {
+			p.pending = make(map[int32]kafkaRequest)
+		}
+		p.pending[record.CorrelationID] = kafkaRequest{apiKey: apiKey, version: version, clientID: record.ClientID}
+
+		if flexible, ok := kafkaFlexibleVersions[apiKey]; ok {
+			r.flexible = version >= flexible
+			r.tags()
+			readKafkaRequest(r, record, apiKey, version)
+		}
+	} else {
+		record.Response = true
+		record.CorrelationID = r.int32()
+		if r.err != nil {
+			return nil, 0, errInvalidKafka
+		}
+		if req, ok := p.pending[record.CorrelationID]; ok {
+			delete(p.pending, record.CorrelationID)
+			record.APIKey, record.APIVersion, record.ClientID = kafkaAPIName(req.apiKey), req.version, req.clientID
+			if flexible, ok := kafkaFlexibleVersions[req.apiKey]; ok {
+				r.flexible = req.version >= flexible
+				r.tags()
+				readKafkaResponse(r, record, req.apiKey, req.version)
+			}
+		}
+	}
+
+	record.Error = kafkaErrorName(record.ErrorCode)
+	for i := range record.Topics {
+		topic := &record.Topics[i]
+		topic.Error = kafkaErrorName(topic.ErrorCode)
+		for j := range topic.Partitions {
+			topic.Partitions[j].Error = kafkaErrorName(topic.Partitions[j].ErrorCode)
+		}
+	}
+	return record, 4 + size, nil
+}
+
+// readKafkaRequest reads the topics of a request, the fields which are not of interest are skipped.
+// Data which does not match the version keeps what was read until then
+func readKafkaRequest(r *kafkaReader, record *message.KafkaMessage, apiKey, v int16) {
+	switch apiKey {
+	case kafkaProduce:
+		if v >= 3 {
+			r.nullableString() // transactional id
+		}
+		r.skip(2 + 4) // acks, timeout
+		r.topics(record, func(r *kafkaReader) message.KafkaPartition {
+			p := message.KafkaPartition{Partition: r.int32()}
+			p.Records = kafkaRecordCount(r.bytes())
+			return p
+		})
+	case kafkaFetch:
+		if v < 15 {
+			r.skip(4) // replica id
+		}
+		r.skip(4 + 4) // max wait, min bytes
+		if v >= 3 {
+			r.skip(4) // max bytes
+		}
+		if v >= 4 {
+			r.skip(1) // isolation level
+		}
+		if v >= 7 {
+			r.skip(4 + 4) // session id and epoch
+		}
+		r.fetchTopics(record, v, func(r *kafkaReader) message.KafkaPartition {
+			p := message.KafkaPartition{Partition: r.int32()}
+			if v >= 9 {
+				r.skip(4) // current leader epoch
+			}
+			r.skip(8) // fetch offset
+			if v >= 12 {
+				r.skip(4) // last fetched epoch
+			}
+			if v >= 5 {
+				r.skip(8) // log start offset
+			}
+			r.skip(4) // partition max bytes
+			return p
+		})
+	case kafkaMetadata:
+		for n := r.arrayLength(); n > 0 && r.err == nil; n-- {
+			var topic message.KafkaTopic
+			if v >= 10 {
+				id := r.topicID()
+				if topic.Name = r.nullableString(); topic.Name == "" {
+					topic.Name = id
+				}
+			} else {
+				topic.Name = r.nullableString()
+			}
+			r.tags()
+			if r.err == nil {
+				record.Topics = append(record.Topics, topic)
+			}
+		}
+	case kafkaOffsetCommit:
+		record.GroupID = r.nullableString()
+		if v >= 1 {
+			r.skip(4)          // generation id
+			r.nullableString() // member id
+		}
+		if v >= 7 {
+			r.nullableString() // group instance id
+		}
+		if v >= 2 && v <= 4 {
+			r.skip(8) // retention time
+		}
+		r.topics(record, func(r *kafkaReader) message.KafkaPartition {
+			p := message.KafkaPartition{Partition: r.int32()}
+			r.skip(8) // committed offset
+			if v >= 6 {
+				r.skip(4) // committed leader epoch
+			}
+			if v == 1 {
+				r.skip(8) // commit timestamp
+			}
+			r.nullableString() // metadata
+			return p
+		})
+	}
+}
+
+// readKafkaResponse reads the topics and error codes of a response
+func readKafkaResponse(r *kafkaReader, record *message.KafkaMessage, apiKey, v int16) {
+	switch apiKey {
+	case kafkaProduce:
+		r.topics(record, func(r *kafkaReader) message.KafkaPartition {
+			p := message.KafkaPartition{Partition: r.int32(), ErrorCode: r.int16()}
+			r.skip(8) // base offset
+			if v >= 2 {
+				r.skip(8) // log append time
+			}
+			if v >= 5 {
+				r.skip(8) // log start offset
+			}
+			if v >= 8 {
+				for n := r.arrayLength(); n > 0 && r.err == nil; n-- {
+					r.skip(4)          // batch index
+					r.nullableString() // batch index error message
+					r.tags()
+				}
+				r.nullableString() // error message
+			}
+			return p
+		})
+	case kafkaFetch:
+		if v >= 1 {
+			r.skip(4) // throttle time
+		}
+		if v >= 7 {
+			record.ErrorCode = r.int16()
+			r.skip(4) // session id
+		}
+		r.fetchTopics(record, v, func(r *kafkaReader) message.KafkaPartition {
+			p := message.KafkaPartition{Partition: r.int32(), ErrorCode: r.int16()}
+			r.skip(8) // high watermark
+			if v >= 4 {
+				r.skip(8) // last stable offset
+				if v >= 5 {
+					r.skip(8) // log start offset
+				}
+				for n := r.arrayLength(); n > 0 && r.err == nil; n-- {
+					r.skip(8 + 8) // aborted transaction producer id and first offset
+					r.tags()
+				}
+			}
+			if v >= 11 {
+				r.skip(4) // preferred read replica
+			}
+			p.Records = kafkaRecordCount(r.bytes())
+			return p
+		})
+	case kafkaMetadata:
+		if v >= 3 {
+			r.skip(4) // throttle time
+		}
+		for n := r.arrayLength(); n > 0 && r.err == nil; n-- {
+			r.skip(4)          // node id
+			r.nullableString() // host
+			r.skip(4)          // port
+			if v >= 1 {
+				r.nullableString() // rack
+			}
+			r.tags()
+		}
+		if v >= 2 {
+			r.nullableString() // cluster id
+		}
+		if v >= 1 {
+			r.skip(4) // controller id
+		}
+		for n := r.arrayLength(); n > 0 && r.err == nil; n-- {
+			topic := message.KafkaTopic{ErrorCode: r.int16(), Name: r.nullableString()}
+			if v >= 10 {
+				if id := r.topicID(); topic.Name == "" {
+					topic.Name = id
+				}
+			}
+			if v >= 1 {
+				r.skip(1) // is internal
+			}
+			for n := r.arrayLength(); n > 0 && r.err == nil; n-- {
+				p := message.KafkaPartition{ErrorCode: r.int16(), Partition: r.int32()}
+				r.skip(4) // leader id
+				if v >= 7 {
+					r.skip(4) // leader epoch
+				}
+				r.int32Array() // replica nodes
+				r.int32Array() // isr nodes
+				if v >= 5 {
+					r.int32Array() // offline replicas
+				}
+				r.tags()
+				topic.Partitions = append(topic.Partitions, p)
+			}
+			if v >= 8 {
+				r.skip(4) // topic authorized operations
+			}
+			r.tags()
+			if r.err == nil {
+				record.Topics = append(record.Topics, topic)
+			}
+		}
+	case kafkaOffsetCommit:
+		if v >= 3 {
+			r.skip(4) // throttle time
+		}
+		r.topics(record, func(r *kafkaReader) message.KafkaPartition {
+			return message.KafkaPartition{Partition: r.int32(), ErrorCode: r.int16()}
+		})
+	}
+}
+
+// kafkaRecordCount counts the records of the record batches, or of the messages of the old message sets,
+// in the records field of Produce and Fetch. A batch cut off at the end of a fetch is not counted
+func kafkaRecordCount(data []byte) int {
+	count := 0
+	// both formats start with the offset, the length and 4 bytes before the magic byte
+	for len(data) >= 17 {
+		length := int(int32(binary.BigEndian.Uint32(data[8:12])))
+		if length < 0 || len(data) < 12+length {
+			break
+		}
+		if data[16] == 2 && length >= 49 {
+			count += int(int32(binary.BigEndian.Uint32(data[57:61])))
+		} else {
+			count++
+		}
+		data = data[12+length:]
+	}
+	return count
+}
+
+func kafkaAPIName(apiKey int16) string {
+	if int(apiKey) < len(kafkaAPIKeys) {
+		return kafkaAPIKeys[apiKey]
+	}
+	return strconv.Itoa(int(apiKey))
+}
+
+func kafkaErrorName(code int16) string {
+	if code == 0 {
+		return ""
+	}
+	if name, ok := kafkaErrors[code]; ok {
+		return name
+	}
+	return strconv.Itoa(int(code))
+}
+
+// kafkaReader reads the fields of a request or response, flexible versions use compact lengths and tagged
+// fields. The first read beyond the data sets err, later reads return zero values
+type kafkaReader struct {
+	data     []byte
+	flexible bool
+	err      error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.err = errInvalidKafka
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *kafkaReader) skip(n int) {
+	r.next(n)
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) uvarint() int {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 || v > uint64(len(r.data)) {
+		r.err = errInvalidKafka
+		return 0
+	}
+	r.data = r.data[n:]
+	return int(v)
+}
+
+// length reads the length of a string, bytes or array, -1 stands for null
+func (r *kafkaReader) length(size int) int {
+	if r.flexible {
+		return r.uvarint() - 1
+	}
+	if size == 2 {
+		return int(r.int16())
+	}
+	return int(r.int32())
+}
+
+func (r *kafkaReader) nullableString() string {
+	if n := r.length(2); n > 0 {
+		return string(r.next(n))
+	}
+	return ""
+}
+
+func (r *kafkaReader) bytes() []byte {
+	if n := r.length(4); n > 0 {
+		return r.next(n)
+	}
+	return nil
+}
+
+// arrayLength reads the number of elements of an array, null arrays are empty. Every element takes at least
+// one byte
+func (r *kafkaReader) arrayLength() int {
+	n := r.length(4)
+	if n > len(r.data) {
+		r.err = errInvalidKafka
+		return 0
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+func (r *kafkaReader) int32Array() {
+	r.skip(4 * r.arrayLength())
+}
+
+// topicID reads a topic uuid in the base64 form Kafka prints it in
+func (r *kafkaReader) topicID() string {
+	return base64.RawURLEncoding.EncodeToString(r.next(16))
+}
+
+// tags skips the tagged fields ending every structure of flexible versions
+func (r *kafkaReader) tags() {
+	if !r.flexible {
+		return
+	}
+	for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+		r.uvarint()
+		r.skip(r.uvarint())
+	}
+}
+
+// topics reads the common array of topics by name with an array of partitions each
+func (r *kafkaReader) topics(record *message.KafkaMessage, partition func(r *kafkaReader) message.KafkaPartition) {
+	r.topicArray(record, r.nullableString, partition)
+}
+
+// fetchTopics reads the topics of Fetch, which are identified by uuid since version 13
+func (r *kafkaReader) fetchTopics(record *message.KafkaMessage, v int16, partition func(r *kafkaReader) message.KafkaPartition) {
+	name := r.nullableString
+	if v >= 13 {
+		name = r.topicID
+	}
+	r.topicArray(record, name, partition)
+}
+
+func (r *kafkaReader) topicArray(record *message.KafkaMessage, name func() string, partition func(r *kafkaReader) message.KafkaPartition) {
+	for n := r.arrayLength(); n > 0 && r.err == nil; n-- {
+		topic := message.KafkaTopic{Name: name()}
+		for n := r.arrayLength(); n > 0 && r.err == nil; n-- {
+			p := partition(r)
+			r.tags()
+			if r.err == nil {
+				topic.Partitions = append(topic.Partitions, p)
+			}
+		}
+		r.tags()
+		record.Topics = append(record.Topics, topic)
+	}
+}
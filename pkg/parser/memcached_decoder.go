@@ -0,0 +1,443 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	memcachedRequestMagic  = 0x80
+	memcachedResponseMagic = 0x81
+	memcachedHeaderLength  = 24
+	// memcachedMaxLineLength rejects data without line breaks, a multi-get line holds many keys of up to 250 bytes
+	memcachedMaxLineLength = 64 << 10
+	// maxMemcachedPendingCommands bounds the commands of a connection waiting for their response
+	maxMemcachedPendingCommands = 1024
+)
+
+var errInvalidMemcached = errors.New("invalid memcached data")
+
+// memcachedCommands are the ASCII commands, the value tells how their arguments are laid out
+var memcachedCommands = map[string]memcachedSyntax{
+	"set": memcachedStorage, "add": memcachedStorage, "replace": memcachedStorage, "append": memcachedStorage,
+	"prepend": memcachedStorage, "cas": memcachedStorage,
+	"get": memcachedRetrieval, "gets": memcachedRetrieval, "gat": memcachedTouchRetrieval, "gats": memcachedTouchRetrieval,
+	"delete": memcachedKey, "incr": memcachedKey, "decr": memcachedKey, "touch": memcachedKey,
+	"mg": memcachedMeta, "md": memcachedMeta, "ma": memcachedMeta, "ms": memcachedMetaStorage, "mn": memcachedOther,
+	"me": memcachedMeta, "stats": memcachedOther, "version": memcachedOther, "flush_all": memcachedOther,
+	"verbosity": memcachedOther, "quit": memcachedOther, "cache_memlimit": memcachedOther,
+}
+
+// memcachedResponses are the first words of single line ASCII responses
+var memcachedResponses = map[string]bool{
+	"STORED": true, "NOT_STORED": true, "EXISTS": true, "NOT_FOUND": true, "DELETED": true, "TOUCHED": true,
+	"END": true, "OK": true, "ERROR": true, "CLIENT_ERROR": true, "SERVER_ERROR": true, "VERSION": true,
+	"HD": true, "EN": true, "NF": true, "NS": true, "EX": true, "MN": true, "ME": true, "RESET": true,
+}
+
+var memcachedOpcodes = map[byte]string{
+	0x00: "get", 0x01: "set", 0x02: "add", 0x03: "replace", 0x04: "delete", 0x05: "incr", 0x06: "decr",
+	0x07: "quit", 0x08: "flush", 0x09: "getq", 0x0a: "noop", 0x0b: "version", 0x0c: "getk", 0x0d: "getkq",
+	0x0e: "append", 0x0f: "prepend", 0x10: "stat", 0x11: "setq", 0x12: "addq", 0x13: "replaceq", 0x14: "deleteq",
+	0x15: "incrq", 0x16: "decrq", 0x17: "quitq", 0x18: "flushq", 0x19: "appendq", 0x1a: "prependq",
+	0x1b: "verbosity", 0x1c: "touch", 0x1d: "gat", 0x1e: "gatq", 0x20: "sasl_list_mechs", 0x21: "sasl_auth",
+	0x22: "sasl_step", 0x23: "gatk", 0x24: "gatkq",
+}
+
+// memcachedQuietOpcodes are the binary commands which are answered on errors only or, for gets, on hits
+var memcachedQuietOpcodes = map[byte]bool{
+	0x09: true, 0x0d: true, 0x11: true, 0x12: true, 0x13: true, 0x14: true, 0x15: true, 0x16: true, 0x17: true,
+	0x18: true, 0x19: true, 0x1a: true, 0x1e: true, 0x24: true,
+}
+
+// memcachedMetaResponses are the responses a quiet meta command may still be answered with
+var memcachedMetaResponses = map[string]bool{
+	"VA": true, "HD": true, "EN": true, "NF": true, "NS": true, "EX": true,
+	"ERROR": true, "CLIENT_ERROR": true, "SERVER_ERROR": true,
+}
+
+var memcachedStatus = map[uint16]string{
+	0x00: "SUCCESS", 0x01: "KEY_ENOENT", 0x02: "KEY_EEXISTS", 0x03: "E2BIG", 0x04: "EINVAL", 0x05: "NOT_STORED",
+	0x06: "DELTA_BADVAL", 0x20: "AUTH_ERROR", 0x21: "AUTH_CONTINUE", 0x81: "UNKNOWN_COMMAND", 0x82: "ENOMEM",
+}
+
+// memcachedRetrievals are the commands whose responses count as hits or misses
+var memcachedRetrievals = map[string]bool{
+	"get": true, "gets": true, "gat": true, "gats": true, "mg": true,
+	"getq": true, "getk": true, "getkq": true, "gatq": true, "gatk": true, "gatkq": true,
+}
+
+type memcachedSyntax int
+
+const (
+	memcachedOther memcachedSyntax = iota
+	memcachedStorage
+	memcachedRetrieval
+	memcachedTouchRetrieval
+	memcachedKey
+	memcachedMeta
+	memcachedMetaStorage
+)
+
+func init() {
+	RegisterDecoder(DecoderFactory{
+		Name:     "memcached",
+		Protocol: model.ProtocolTCP,
+		Ports:    []uint16{11211},
+		Sniff:    isMemcached,
+		New: func(DecoderOptions) Decoder {
+			return newMemcachedDecoder()
+		},
+	})
+}
+
+// isMemcached sniffs for a binary request or one of the common ASCII commands
+func isMemcached(payload []byte) bool {
+	if len(payload) >= memcachedHeaderLength && payload[0] == memcachedRequestMagic {
+		_, known := memcachedOpcodes[payload[1]]
+		return known && int(binary.BigEndian.Uint32(payload[8:12])) == len(payload)-memcachedHeaderLength
+	}
+	line, _, found := bytes.Cut(payload, []byte("\r\n"))
+	if !found {
+		return false
+	}
+	command, _, _ := strings.Cut(string(line), " ")
+	_, ok := memcachedCommands[command]
+	return ok
+}
+
+// memcachedCommand is what a response takes over from its command
+type memcachedCommand struct {
+	timestamp time.Time
+	command   string
+	keys      []string
+	seq       int
+	quiet     bool
+}
+
+// memcachedDecoder decodes the commands and responses of one connection. ASCII responses answer the commands
+// in order, binary responses name their command by opaque. Quiet commands are only answered on errors or, for
+// gets, on hits. Clients end a batch of them with mn or noop, whose response counts the quiet gets which were
+// not answered as misses
+type memcachedDecoder struct {
+	frames  *frameDecoder
+	pending []memcachedCommand
+	opaques map[uint32]memcachedCommand
+	seq     int
+}
+
+func newMemcachedDecoder() *memcachedDecoder {
+	return &memcachedDecoder{frames: newFrameDecoder(memcachedParser{}), opaques: make(map[uint32]memcachedCommand)}
+}
+
+func (d *memcachedDecoder) Decode(dir int, msg *message.NetMessage, final bool) []*message.NetMessage {
+	result := d.frames.Decode(dir, msg, final)
+	for _, m := range result {
+		if record, ok := m.Record.(*message.MemcachedMessage); ok {
+			d.match(record, m.Timestamp)
+		}
+	}
+	return result
+}
+
+func (d *memcachedDecoder) match(record *message.MemcachedMessage, timestamp time.Time) {
+	if !record.Response {
+		if record.NoReply {
+			return
+		}
+		d.seq++
+		command := memcachedCommand{timestamp: timestamp, command: record.Command, keys: record.Keys, seq: d.seq, quiet: record.Quiet}
+		if record.Binary {
+			if len(d.opaques) >= maxMemcachedPendingCommands {
+				d.opaques = make(map[uint32]memcachedCommand)
+			}
+			d.opaques[record.Opaque] = command
+		} else {
+			if len(d.pending) >= maxMemcachedPendingCommands {
+				d.pending = d.pending[1:]
+			}
+			d.pending = append(d.pending, command)
+		}
+		return
+	}
+
+	var command memcachedCommand
+	// unanswered are the commands sent before the answered one which will not be answered anymore
+	var unanswered []memcachedCommand
+	if record.Binary {
+		var ok bool
+		if command, ok = d.opaques[record.Opaque]; !ok {
+			return
+		}
+		delete(d.opaques, record.Opaque)
+		if command.command == "noop" {
+			for opaque, c := range d.opaques {
+				if c.seq < command.seq {
+					unanswered = append(unanswered, c)
+					delete(d.opaques, opaque)
+				}
+			}
+			sort.Slice(unanswered, func(i, j int) bool { return unanswered[i].seq < unanswered[j].seq })
+		}
+	} else {
+		i := d.next(record)
+		if i == len(d.pending) {
+			return
+		}
+		command = d.pending[i]
+		if command.quiet {
+			d.pending = append(d.pending[:i:i], d.pending[i+1:]...)
+		} else {
+			unanswered, d.pending = d.pending[:i], d.pending[i+1:]
+		}
+	}
+
+	record.Command, record.Keys = command.command, command.keys
+	record.LatencyMs = float64(timestamp.Sub(command.timestamp)) / float64(time.Millisecond)
+	if record.Command == "mn" || record.Command == "noop" {
+		for _, c := range unanswered {
+			if c.quiet && memcachedRetrievals[c.command] {
+				record.Keys = append(record.Keys, c.keys...)
+				record.Misses++
+			}
+		}
+		return
+	}
+	if !memcachedRetrievals[record.Command] {
+		return
+	}
+	switch {
+	case !record.Binary && record.Command != "mg":
+		record.Misses = len(record.Keys) - record.Hits
+	case record.Status == "EN" || record.Status == "KEY_ENOENT":
+		record.Misses = 1
+	case record.Status == "VA" || record.Status == "HD" || record.Status == "SUCCESS":
+		record.Hits = 1
+	}
+}
+
+// next returns the index of the pending command an ASCII response answers. It is taken for a quiet command when
+// the first command which is always answered cannot have sent it, or when it names the key of the quiet command
+func (d *memcachedDecoder) next(record *message.MemcachedMessage) int {
+	n := 0
+	for n < len(d.pending) && d.pending[n].quiet {
+		n++
+	}
+	if n == 0 || !memcachedMetaResponses[record.Status] {
+		return n
+	}
+	if len(record.Keys) == 1 {
+		for i, c := range d.pending[:n] {
+			if len(c.keys) == 1 && c.keys[0] == record.Keys[0] {
+				return i
+			}
+		}
+	}
+	if n == len(d.pending) || d.pending[n].command == "mn" {
+		return 0
+	}
+	return n
+}
+
+// memcachedParser parses the ASCII and the binary protocol, which one is used is told by the first byte
+type memcachedParser struct{}
+
+func (memcachedParser) parse(request bool, data []byte, _ bool) (message.Record, int, error) {
+	if data[0] == memcachedRequestMagic || data[0] == memcachedResponseMagic {
+		return parseMemcachedBinary(request, data)
+	}
+	if request {
+		return parseMemcachedCommand(data)
+	}
+	return parseMemcachedResponse(data)
+}
+
+func parseMemcachedBinary(request bool, data []byte) (message.Record, int, error) {
+	if len(data) < memcachedHeaderLength {
+		return nil, 0, errIncomplete
+	}
+	if (data[0] == memcachedRequestMagic) != request {
+		return nil, 0, errInvalidMemcached
+	}
+	keyLength := int(binary.BigEndian.Uint16(data[2:4]))
+	extrasLength := int(data[4])
+	bodyLength := int(binary.BigEndian.Uint32(data[8:12]))
+	if bodyLength < keyLength+extrasLength || bodyLength > maxDecoderBufferSize {
+		return nil, 0, errInvalidMemcached
+	}
+	size := memcachedHeaderLength + bodyLength
+	if len(data) < size {
+		return nil, 0, errIncomplete
+	}
+
+	record := &message.MemcachedMessage{
+		Command:   memcachedOpcodes[data[1]],
+		ValueSize: bodyLength - keyLength - extrasLength,
+		Response:  !request,
+		Binary:    true,
+		Opaque:    binary.BigEndian.Uint32(data[12:16]),
+		Size:      size,
+	}
+	if record.Command == "" {
+		record.Command = "0x" + strconv.FormatUint(uint64(data[1]), 16)
+	}
+	if keyLength > 0 {
+		start := memcachedHeaderLength + extrasLength
+		record.Keys = []string{string(data[start : start+keyLength])}
+	}
+	if request {
+		record.Quiet = memcachedQuietOpcodes[data[1]]
+	} else {
+		status := binary.BigEndian.Uint16(data[6:8])
+		if record.Status = memcachedStatus[status]; record.Status == "" {
+			record.Status = "0x" + strconv.FormatUint(uint64(status), 16)
+		}
+	}
+	return record, size, nil
+}
+
+func parseMemcachedCommand(data []byte) (message.Record, int, error) {
+	line, next, err := readMemcachedLine(data, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return nil, 0, errInvalidMemcached
+	}
+	syntax, ok := memcachedCommands[words[0]]
+	if !ok {
+		return nil, 0, errInvalidMemcached
+	}
+
+	record := &message.MemcachedMessage{Command: words[0]}
+	last := words[len(words)-1]
+	switch syntax {
+	case memcachedStorage, memcachedMetaStorage:
+		sizeIndex := 4
+		if syntax == memcachedMetaStorage {
+			sizeIndex = 2
+		}
+		if len(words) <= sizeIndex {
+			return nil, 0, errInvalidMemcached
+		}
+		size, err := strconv.Atoi(words[sizeIndex])
+		if err != nil || size < 0 || size > maxDecoderBufferSize {
+			return nil, 0, errInvalidMemcached
+		}
+		if len(data) < next+size+2 {
+			return nil, 0, errIncomplete
+		}
+		record.Keys, record.ValueSize = words[1:2], size
+		next += size + 2
+	case memcachedRetrieval:
+		record.Keys = words[1:]
+	case memcachedTouchRetrieval:
+		if len(words) > 2 {
+			record.Keys = words[2:]
+		}
+	case memcachedKey, memcachedMeta:
+		if len(words) > 1 {
+			record.Keys = words[1:2]
+		}
+	}
+	switch syntax {
+	case memcachedMeta, memcachedMetaStorage:
+		for _, flag := range words[1:] {
+			record.Quiet = record.Quiet || flag == "q"
+		}
+	default:
+		record.NoReply = last == "noreply"
+	}
+	record.Size = next
+	return record, next, nil
+}
+
+// parseMemcachedResponse parses a response, retrievals and stats continue up to END
+func parseMemcachedResponse(data []byte) (message.Record, int, error) {
+	line, next, err := readMemcachedLine(data, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	word, _, _ := strings.Cut(line, " ")
+	record := &message.MemcachedMessage{Response: true, Status: word}
+
+	switch word {
+	case "VALUE", "STAT":
+		for {
+			if word == "VALUE" {
+				fields := strings.Fields(line)
+				if len(fields) < 4 {
+					return nil, 0, errInvalidMemcached
+				}
+				size, err := strconv.Atoi(fields[3])
+				if err != nil || size < 0 || size > maxDecoderBufferSize {
+					return nil, 0, errInvalidMemcached
+				}
+				if len(data) < next+size+2 {
+					return nil, 0, errIncomplete
+				}
+				next += size + 2
+				record.Hits++
+				record.ValueSize += size
+			}
+			if line, next, err = readMemcachedLine(data, next); err != nil {
+				return nil, 0, err
+			}
+			if line == "END" {
+				break
+			}
+			if word, _, _ = strings.Cut(line, " "); word != record.Status {
+				return nil, 0, errInvalidMemcached
+			}
+		}
+	case "VA":
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, 0, errInvalidMemcached
+		}
+		size, err := strconv.Atoi(fields[1])
+		if err != nil || size < 0 || size > maxDecoderBufferSize {
+			return nil, 0, errInvalidMemcached
+		}
+		if len(data) < next+size+2 {
+			return nil, 0, errIncomplete
+		}
+		next += size + 2
+		record.ValueSize = size
+		readMemcachedMetaKey(record, fields[2:])
+	case "HD", "EN", "NF", "NS", "EX":
+		readMemcachedMetaKey(record, strings.Fields(line)[1:])
+	default:
+		// incr and decr answer with the new value
+		if _, err := strconv.ParseUint(word, 10, 64); err != nil && !memcachedResponses[word] {
+			return nil, 0, errInvalidMemcached
+		}
+	}
+	record.Size = next
+	return record, next, nil
+}
+
+// readMemcachedMetaKey takes the key returned with the k flag of a meta command
+func readMemcachedMetaKey(record *message.MemcachedMessage, flags []string) {
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, "k") && len(flag) > 1 {
+			record.Keys = []string{flag[1:]}
+		}
+	}
+}
+
+func readMemcachedLine(data []byte, pos int) (string, int, error) {
+	line, next, err := readLine(data, pos)
+	if err == errIncomplete && len(data)-pos > memcachedMaxLineLength {
+		return "", 0, errInvalidMemcached
+	}
+	return line, next, err
+}
@@ -0,0 +1,360 @@
+package parser
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"io"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mongoOpReply      = 1
+	mongoOpQuery      = 2004
+	mongoOpCompressed = 2012
+	mongoOpMsg        = 2013
+)
+
+const (
+	mongoHeaderLength = 16
+	// mongoMaxRenderedDocument limits the size of the documents rendered as JSON
+	mongoMaxRenderedDocument = 64 << 10
+	// maxMongoPendingRequests bounds the requests of a connection waiting for their reply
+	maxMongoPendingRequests = 1024
+)
+
+const (
+	mongoMsgChecksumPresent = 1 << 0
+	mongoMsgMoreToCome      = 1 << 1
+	mongoCompressorZlib     = 2
+)
+
+var errInvalidMongo = errors.New("invalid MongoDB data")
+
+var mongoOpCodes = map[int32]string{
+	mongoOpReply:      "OP_REPLY",
+	2001:              "OP_UPDATE",
+	2002:              "OP_INSERT",
+	mongoOpQuery:      "OP_QUERY",
+	2005:              "OP_GET_MORE",
+	2006:              "OP_DELETE",
+	2007:              "OP_KILL_CURSORS",
+	mongoOpCompressed: "OP_COMPRESSED",
+	mongoOpMsg:        "OP_MSG",
+}
+
+var mongoCompressors = map[byte]string{0: "noop", 1: "snappy", mongoCompressorZlib: "zlib", 3: "zstd"}
+
+func init() {
+	RegisterDecoder(DecoderFactory{
+		Name:     "mongodb",
+		Protocol: model.ProtocolTCP,
+		Ports:    []uint16{27017},
+		Sniff:    isMongoDB,
+		New: func(DecoderOptions) Decoder {
+			return newMongoDecoder()
+		},
+	})
+}
+
+// isMongoDB sniffs for a request whose length matches the payload and which uses one of the opcodes of commands
+func isMongoDB(payload []byte) bool {
+	if len(payload) < mongoHeaderLength || int(binary.LittleEndian.Uint32(payload)) != len(payload) {
+		return false
+	}
+	switch int32(binary.LittleEndian.Uint32(payload[12:16])) {
+	case mongoOpMsg, mongoOpQuery, mongoOpCompressed:
+		return binary.LittleEndian.Uint32(payload[8:12]) == 0
+	}
+	return false
+}
+
+// mongoRequest is what a reply takes over from its request
+type mongoRequest struct {
+	timestamp  time.Time
+	command    string
+	database   string
+	collection string
+}
+
+// mongoDecoder decodes the messages of one connection and pairs replies with their requests by request id
+type mongoDecoder struct {
+	frames  *frameDecoder
+	pending map[int32]mongoRequest
+}
+
+func newMongoDecoder() *mongoDecoder {
+	return &mongoDecoder{frames: newFrameDecoder(mongoParser{}), pending: make(map[int32]mongoRequest)}
+}
+
+func (d *mongoDecoder) Decode(dir int, msg *message.NetMessage, final bool) []*message.NetMessage {
+	result := d.frames.Decode(dir, msg, final)
+	for _, m := range result {
+		if record, ok := m.Record.(*message.MongoDBMessage); ok {
+			d.match(record, m.Request, m.Timestamp)
+		}
+	}
+	return result
+}
+
+func (d *mongoDecoder) match(record *message.MongoDBMessage, request bool, timestamp time.Time) {
+	if len(d.pending) >= maxMongoPendingRequests {
+		d.pending = make(map[int32]mongoRequest)
+	}
+	if request {
+		d.pending[record.RequestID] = mongoRequest{
+			timestamp:  timestamp,
+			command:    record.Command,
+			database:   record.Database,
+			collection: record.Collection,
+		}
+		return
+	}
+
+	req, ok := d.pending[record.ResponseTo]
+	if !ok {
+		return
+	}
+	delete(d.pending, record.ResponseTo)
+	record.Command, record.Database, record.Collection = req.command, req.database, req.collection
+	record.DurationMs = float64(timestamp.Sub(req.timestamp)) / float64(time.Millisecond)
+	if record.MoreToCome {
+		// the next reply of an exhaust cursor answers this one
+		req.timestamp = timestamp
+		d.pending[record.RequestID] = req
+	}
+}
+
+// mongoParser parses OP_MSG, the legacy OP_QUERY and OP_REPLY and zlib compressed messages, the other opcodes
+// are only named
+type mongoParser struct{}
+
+func (mongoParser) parse(request bool, data []byte, _ bool) (message.Record, int, error) {
+	if len(data) < 4 {
+		return nil, 0, errIncomplete
+	}
+	length := int(int32(binary.LittleEndian.Uint32(data)))
+	if length < mongoHeaderLength || length > maxDecoderBufferSize {
+		return nil, 0, errInvalidMongo
+	}
+	if len(data) < length {
+		return nil, 0, errIncomplete
+	}
+
+	opCode := int32(binary.LittleEndian.Uint32(data[12:16]))
+	if _, ok := mongoOpCodes[opCode]; !ok {
+		return nil, 0, errInvalidMongo
+	}
+	record := &message.MongoDBMessage{
+		RequestID:  int32(binary.LittleEndian.Uint32(data[4:8])),
+		ResponseTo: int32(binary.LittleEndian.Uint32(data[8:12])),
+		Size:       length,
+	}
+	if err := readMongoBody(record, request, opCode, data[mongoHeaderLength:length]); err != nil {
+		return nil, 0, err
+	}
+	return record, length, nil
+}
+
+func readMongoBody(record *message.MongoDBMessage, request bool, opCode int32, body []byte) error {
+	record.OpCode = mongoOpCodes[opCode]
+	switch opCode {
+	case mongoOpMsg:
+		return readMongoMsg(record, request, body)
+	case mongoOpQuery:
+		if len(body) < 4 {
+			return errInvalidMongo
+		}
+		collection, rest := readCString(body[4:])
+		if len(rest) < 8 {
+			return errInvalidMongo
+		}
+		doc, _, err := readBSONDocument(rest[8:])
+		if err != nil {
+			return err
+		}
+		database, name, _ := strings.Cut(collection, ".")
+		record.Database = database
+		if name == "$cmd" {
+			readMongoCommand(record, doc)
+		} else {
+			record.Command, record.Collection = "query", name
+		}
+		record.Document = renderBSON(doc)
+	case mongoOpReply:
+		if len(body) < 20 {
+			return errInvalidMongo
+		}
+		if binary.LittleEndian.Uint32(body[16:20]) > 0 {
+			doc, _, err := readBSONDocument(body[20:])
+			if err != nil {
+				return err
+			}
+			readMongoReply(record, doc)
+			record.Document = renderBSON(doc)
+		}
+	case mongoOpCompressed:
+		if len(body) < 9 {
+			return errInvalidMongo
+		}
+		original := int32(binary.LittleEndian.Uint32(body[0:4]))
+		compressor := body[8]
+		if _, ok := mongoOpCodes[original]; !ok || compressor != mongoCompressorZlib {
+			record.Compressor = mongoCompressors[compressor]
+			if record.Compressor == "" {
+				record.Compressor = strconv.Itoa(int(compressor))
+			}
+			return nil
+		}
+		reader, err := zlib.NewReader(bytes.NewReader(body[9:]))
+		if err != nil {
+			return err
+		}
+		decompressed, err := io.ReadAll(io.LimitReader(reader, maxDecoderBufferSize))
+		if err != nil {
+			return err
+		}
+		return readMongoBody(record, request, original, decompressed)
+	}
+	return nil
+}
+
+// readMongoMsg reads the sections of OP_MSG, the document of the body section is the command or the reply
+func readMongoMsg(record *message.MongoDBMessage, request bool, body []byte) error {
+	if len(body) < 4 {
+		return errInvalidMongo
+	}
+	flags := binary.LittleEndian.Uint32(body)
+	record.MoreToCome = flags&mongoMsgMoreToCome != 0
+	if flags&mongoMsgChecksumPresent != 0 {
+		if len(body) < 8 {
+			return errInvalidMongo
+		}
+		body = body[:len(body)-4]
+	}
+
+	for pos := 4; pos < len(body); {
+		kind := body[pos]
+		pos++
+		switch kind {
+		case 0:
+			doc, n, err := readBSONDocument(body[pos:])
+			if err != nil {
+				return err
+			}
+			pos += n
+			if request {
+				readMongoCommand(record, doc)
+			} else {
+				readMongoReply(record, doc)
+			}
+			record.Document = renderBSON(doc)
+		case 1:
+			if len(body) < pos+4 {
+				return errInvalidMongo
+			}
+			size := int(int32(binary.LittleEndian.Uint32(body[pos:])))
+			if size < 4 || len(body) < pos+size {
+				return errInvalidMongo
+			}
+			identifier, docs := readCString(body[pos+4 : pos+size])
+			sequence := message.MongoDBSequence{Identifier: identifier}
+			for len(docs) > 0 {
+				_, n, err := readBSONDocument(docs)
+				if err != nil {
+					return err
+				}
+				docs = docs[n:]
+				sequence.Documents++
+			}
+			record.Sequences = append(record.Sequences, sequence)
+			pos += size
+		default:
+			return errInvalidMongo
+		}
+	}
+	return nil
+}
+
+// readMongoCommand takes the command from the first field of a command document, its value names the collection
+// for most commands and getMore names it in a field of its own
+func readMongoCommand(record *message.MongoDBMessage, doc bson.Raw) {
+	elements, err := doc.Elements()
+	if err != nil || len(elements) == 0 {
+		return
+	}
+	record.Command = elements[0].Key()
+	if collection, ok := elements[0].Value().StringValueOK(); ok {
+		record.Collection = collection
+	} else if collection, ok := doc.Lookup("collection").StringValueOK(); ok {
+		record.Collection = collection
+	}
+	if database, ok := doc.Lookup("$db").StringValueOK(); ok {
+		record.Database = database
+	}
+}
+
+// readMongoReply reads ok and the error of a failed command or, for writes, of the first failed document
+func readMongoReply(record *message.MongoDBMessage, doc bson.Raw) {
+	if value, err := doc.LookupErr("ok"); err == nil {
+		var ok bool
+		switch value.Type {
+		case bson.TypeDouble:
+			ok = value.Double() == 1
+		case bson.TypeInt32:
+			ok = value.Int32() == 1
+		case bson.TypeInt64:
+			ok = value.Int64() == 1
+		case bson.TypeBoolean:
+			ok = value.Boolean()
+		}
+		record.OK = &ok
+	}
+
+	errorDoc := doc
+	if writeErrors, ok := doc.Lookup("writeErrors").ArrayOK(); ok {
+		if first, err := writeErrors.IndexErr(0); err == nil {
+			if firstDoc, ok := first.Value().DocumentOK(); ok {
+				errorDoc = firstDoc
+			}
+		}
+	}
+	if code, ok := errorDoc.Lookup("code").AsInt32OK(); ok {
+		record.ErrorCode = code
+	}
+	record.ErrorName, _ = errorDoc.Lookup("codeName").StringValueOK()
+	record.ErrorMessage, _ = errorDoc.Lookup("errmsg").StringValueOK()
+}
+
+// readBSONDocument returns the validated document at the start of data and its length
+func readBSONDocument(data []byte) (bson.Raw, int, error) {
+	if len(data) < 5 {
+		return nil, 0, errInvalidMongo
+	}
+	size := int(int32(binary.LittleEndian.Uint32(data)))
+	if size < 5 || size > len(data) {
+		return nil, 0, errInvalidMongo
+	}
+	doc := bson.Raw(data[:size])
+	if err := doc.Validate(); err != nil {
+		return nil, 0, err
+	}
+	return doc, size, nil
+}
+
+func renderBSON(doc bson.Raw) []byte {
+	if len(doc) > mongoMaxRenderedDocument {
+		return nil
+	}
+	rendered, err := bson.MarshalExtJSON(doc, false, false)
+	if err != nil {
+		return nil
+	}
+	return rendered
+}
@@ -0,0 +1,284 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"time"
+)
+
+const (
+	mqttConnect     = 1
+	mqttConnAck     = 2
+	mqttPublish     = 3
+	mqttPubAck      = 4
+	mqttPubRec      = 5
+	mqttPubRel      = 6
+	mqttPubComp     = 7
+	mqttSubscribe   = 8
+	mqttSubAck      = 9
+	mqttUnsubscribe = 10
+	mqttUnsubAck    = 11
+	mqttDisconnect  = 14
+	mqttAuth        = 15
+)
+
+const (
+	mqttVersion311 = 4
+	mqttVersion5   = 5
+	// maxMQTTPendingPackets bounds the packets of a connection waiting for their acknowledgement
+	maxMQTTPendingPackets = 1024
+)
+
+var errInvalidMQTT = errors.New("invalid MQTT data")
+
+var mqttPacketTypes = []string{"", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+	"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH"}
+
+var mqttVersions = map[byte]string{3: "3.1", mqttVersion311: "3.1.1", mqttVersion5: "5.0"}
+
+func init() {
+	RegisterDecoder(DecoderFactory{
+		Name:     "mqtt",
+		Protocol: model.ProtocolTCP,
+		Ports:    []uint16{1883},
+		Sniff:    isMQTT,
+		New: func(DecoderOptions) Decoder {
+			return newMQTTDecoder()
+		},
+	})
+}
+
+// isMQTT sniffs for the CONNECT packet a connection starts with
+func isMQTT(payload []byte) bool {
+	if len(payload) < 2 || payload[0] != mqttConnect<<4 {
+		return false
+	}
+	_, n := readMQTTLength(payload[1:])
+	if n <= 0 {
+		return false
+	}
+	name := payload[1+n:]
+	return bytes.HasPrefix(name, []byte("\x00\x04MQTT")) || bytes.HasPrefix(name, []byte("\x00\x06MQIsdp"))
+}
+
+// mqttPacketKey identifies a packet waiting for its acknowledgement, packet ids are chosen by each side
+type mqttPacketKey struct {
+	request bool
+	id      uint16
+}
+
+// mqttDecoder decodes the control packets of one connection and measures how long it took to acknowledge
+// PUBLISH with QoS 1 or 2, SUBSCRIBE and UNSUBSCRIBE
+type mqttDecoder struct {
+	frames  *frameDecoder
+	pending map[mqttPacketKey]time.Time
+}
+
+func newMQTTDecoder() *mqttDecoder {
+	return &mqttDecoder{
+		frames:  newFrameDecoder(&mqttParser{version: mqttVersion311}),
+		pending: make(map[mqttPacketKey]time.Time),
+	}
+}
+
+func (d *mqttDecoder) Decode(dir int, msg *message.NetMessage, final bool) []*message.NetMessage {
+	result := d.frames.Decode(dir, msg, final)
+	for _, m := range result {
+		if record, ok := m.Record.(*message.MQTTMessage); ok {
+			d.match(record, m.Request, m.Timestamp)
+		}
+	}
+	return result
+}
+
+// match remembers when a packet expecting an acknowledgement was sent and sets the latency of the acknowledgement
+func (d *mqttDecoder) match(record *message.MQTTMessage, request bool, timestamp time.Time) {
+	switch record.Type {
+	case mqttPacketTypes[mqttPublish], mqttPacketTypes[mqttSubscribe], mqttPacketTypes[mqttUnsubscribe]:
+		if record.PacketID == 0 {
+			return
+		}
+		key := mqttPacketKey{request: request, id: record.PacketID}
+		if _, ok := d.pending[key]; ok && record.Dup {
+			// a retransmission keeps the time of the first attempt
+			return
+		}
+		if len(d.pending) >= maxMQTTPendingPackets {
+			d.pending = make(map[mqttPacketKey]time.Time)
+		}
+		d.pending[key] = timestamp
+	case mqttPacketTypes[mqttPubAck], mqttPacketTypes[mqttPubComp], mqttPacketTypes[mqttSubAck],
+		mqttPacketTypes[mqttUnsubAck]:
+		key := mqttPacketKey{request: !request, id: record.PacketID}
+		if sent, ok := d.pending[key]; ok {
+			delete(d.pending, key)
+			record.LatencyMs = float64(timestamp.Sub(sent)) / float64(time.Millisecond)
+		}
+	}
+}
+
+// mqttParser parses the control packets of MQTT 3.1, 3.1.1 and 5.0, the version is taken from CONNECT
+type mqttParser struct {
+	version byte
+}
+
+func (p *mqttParser) parse(_ bool, data []byte, _ bool) (message.Record, int, error) {
+	if len(data) < 2 {
+		return nil, 0, errIncomplete
+	}
+	length, n := readMQTTLength(data[1:])
+	if n == 0 {
+		return nil, 0, errIncomplete
+	}
+	kind := data[0] >> 4
+	if n < 0 || kind == 0 || length > maxDecoderBufferSize {
+		return nil, 0, errInvalidMQTT
+	}
+	size := 1 + n + length
+	if len(data) < size {
+		return nil, 0, errIncomplete
+	}
+
+	record := &message.MQTTMessage{Type: mqttPacketTypes[kind], Size: size}
+	r := &mqttReader{data: data[1+n : size]}
+	switch kind {
+	case mqttConnect:
+		p.readConnect(r, record)
+	case mqttConnAck:
+		r.skip(1) // acknowledge flags
+		record.ReasonCodes = []int{int(r.byte())}
+	case mqttPublish:
+		flags := data[0] & 0x0f
+		record.Dup, record.QoS, record.Retain = flags&0x08 != 0, int(flags>>1&0x03), flags&0x01 != 0
+		record.Topic = r.string()
+		if record.QoS > 0 {
+			record.PacketID = r.uint16()
+		}
+		p.skipProperties(r)
+		record.PayloadSize = len(r.data)
+	case mqttPubAck, mqttPubRec, mqttPubRel, mqttPubComp:
+		record.PacketID = r.uint16()
+		if len(r.data) > 0 {
+			record.ReasonCodes = []int{int(r.byte())}
+		}
+	case mqttSubscribe:
+		record.PacketID = r.uint16()
+		p.skipProperties(r)
+		for len(r.data) > 0 && r.err == nil {
+			topic := r.string()
+			record.Subscriptions = append(record.Subscriptions, message.MQTTSubscription{Topic: topic, QoS: int(r.byte() & 0x03)})
+		}
+	case mqttUnsubscribe:
+		record.PacketID = r.uint16()
+		p.skipProperties(r)
+		for len(r.data) > 0 && r.err == nil {
+			record.Subscriptions = append(record.Subscriptions, message.MQTTSubscription{Topic: r.string()})
+		}
+	case mqttSubAck, mqttUnsubAck:
+		record.PacketID = r.uint16()
+		p.skipProperties(r)
+		for _, code := range r.data {
+			record.ReasonCodes = append(record.ReasonCodes, int(code))
+		}
+	case mqttDisconnect, mqttAuth:
+		if len(r.data) > 0 {
+			record.ReasonCodes = []int{int(r.byte())}
+		}
+	}
+	if r.err != nil {
+		return nil, 0, errInvalidMQTT
+	}
+	return record, size, nil
+}
+
+func (p *mqttParser) readConnect(r *mqttReader, record *message.MQTTMessage) {
+	r.string() // protocol name
+	version := r.byte()
+	flags := r.byte()
+	record.KeepAlive = r.uint16()
+	if r.err != nil {
+		return
+	}
+	p.version = version
+	record.ProtocolVersion = mqttVersions[version]
+
+	p.skipProperties(r)
+	record.ClientID = r.string()
+	if flags&0x04 != 0 {
+		p.skipProperties(r) // will properties
+		r.string()          // will topic
+		r.string()          // will payload
+	}
+	if flags&0x80 != 0 {
+		record.Username = r.string()
+	}
+}
+
+// skipProperties skips the properties MQTT 5 adds to most packets
+func (p *mqttParser) skipProperties(r *mqttReader) {
+	if p.version < mqttVersion5 || r.err != nil {
+		return
+	}
+	length, n := readMQTTLength(r.data)
+	if n <= 0 {
+		r.err = errInvalidMQTT
+		return
+	}
+	r.skip(n + length)
+}
+
+// readMQTTLength reads a variable byte integer, n is 0 when it is incomplete and -1 when it is too long
+func readMQTTLength(data []byte) (length int, n int) {
+	for i := 0; i < 4; i++ {
+		if i == len(data) {
+			return 0, 0
+		}
+		length |= int(data[i]&0x7f) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return length, i + 1
+		}
+	}
+	return 0, -1
+}
+
+// mqttReader reads the fields of a control packet, the first read beyond the data sets err
+type mqttReader struct {
+	data []byte
+	err  error
+}
+
+func (r *mqttReader) next(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errInvalidMQTT
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *mqttReader) skip(n int) {
+	r.next(n)
+}
+
+func (r *mqttReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *mqttReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// string reads a length prefixed UTF-8 string or binary data
+func (r *mqttReader) string() string {
+	return string(r.next(int(r.uint16())))
+}
@@ -0,0 +1,598 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"time"
+)
+
+const (
+	mysqlMaxPacketSize = 0xffffff
+	// mysqlMaxColumns is far above the column limit of MySQL and rejects data which is not a result set
+	mysqlMaxColumns = 8192
+
+	mysqlHandshakeProtocolVersion = 0x0a
+	mysqlSSLRequestLength         = 32
+	mysqlHandshakeResponseMinimum = 32
+
+	mysqlClientConnectWithDB      = 0x00000008
+	mysqlClientSSL                = 0x00000800
+	mysqlClientSecureConnection   = 0x00008000
+	mysqlClientPluginAuthLenenc   = 0x00200000
+	mysqlClientDeprecateEOF       = 0x01000000
+	mysqlClientQueryAttributes    = 0x08000000
+	mysqlServerMoreResultsExists  = 0x0008
+	mysqlServerStatusCursorExists = 0x0040
+)
+
+// mysqlCommandLogin stands for the handshake response of the client, it is not a command code of the protocol
+const mysqlCommandLogin byte = 0xff
+
+var errInvalidMySQL = errors.New("invalid MySQL data")
+
+var mysqlCommands = map[byte]string{
+	0x01:              "COM_QUIT",
+	0x02:              "COM_INIT_DB",
+	0x03:              "COM_QUERY",
+	0x04:              "COM_FIELD_LIST",
+	0x05:              "COM_CREATE_DB",
+	0x06:              "COM_DROP_DB",
+	0x07:              "COM_REFRESH",
+	0x09:              "COM_STATISTICS",
+	0x0a:              "COM_PROCESS_INFO",
+	0x0c:              "COM_PROCESS_KILL",
+	0x0d:              "COM_DEBUG",
+	0x0e:              "COM_PING",
+	0x11:              "COM_CHANGE_USER",
+	0x16:              "COM_STMT_PREPARE",
+	0x17:              "COM_STMT_EXECUTE",
+	0x18:              "COM_STMT_SEND_LONG_DATA",
+	0x19:              "COM_STMT_CLOSE",
+	0x1a:              "COM_STMT_RESET",
+	0x1b:              "COM_SET_OPTION",
+	0x1c:              "COM_STMT_FETCH",
+	0x1f:              "COM_RESET_CONNECTION",
+	mysqlCommandLogin: "LOGIN",
+}
+
+// mysqlNoResponse are the commands the server does not answer
+var mysqlNoResponse = map[byte]bool{0x01: true, 0x18: true, 0x19: true}
+
+func init() {
+	RegisterDecoder(DecoderFactory{
+		Name:     "mysql",
+		Protocol: model.ProtocolTCP,
+		Ports:    []uint16{3306},
+		Sniff:    isMySQL,
+		New: func(DecoderOptions) Decoder {
+			return newMySQLDecoder()
+		},
+	})
+}
+
+// isMySQL sniffs for the initial handshake of the server or a query sent in a single packet
+func isMySQL(payload []byte) bool {
+	if len(payload) < 6 || payload[3] != 0 {
+		return false
+	}
+	length := int(payload[0]) | int(payload[1])<<8 | int(payload[2])<<16
+	if length != len(payload)-4 {
+		return false
+	}
+	switch payload[4] {
+	case mysqlHandshakeProtocolVersion:
+		return bytes.IndexByte(payload[5:], 0) > 0
+	case 0x03, 0x16:
+		return true
+	}
+	return false
+}
+
+// mysqlDecoder sets the time the server took to answer on the responses, it is measured from the command the
+// parser matched the response to, so commands which are not answered do not shift the following ones
+type mysqlDecoder struct {
+	frames *frameDecoder
+	parser *mysqlParser
+}
+
+func newMySQLDecoder() *mysqlDecoder {
+	parser := newMySQLParser()
+	return &mysqlDecoder{frames: newFrameDecoder(parser), parser: parser}
+}
+
+func (d *mysqlDecoder) Decode(dir int, msg *message.NetMessage, final bool) []*message.NetMessage {
+	result := d.frames.Decode(dir, msg, final)
+	for _, m := range result {
+		if record, ok := m.Record.(*message.MySQLMessage); ok {
+			d.parser.match(record, m.Request, m.Timestamp)
+		}
+	}
+	return result
+}
+
+// mysqlCommand is a command waiting for its response
+type mysqlCommand struct {
+	code  byte
+	query string
+	// request is the record of the command, timestamp when it was sent is known once it has been emitted
+	request   *message.MySQLMessage
+	timestamp time.Time
+}
+
+// authenticates tells whether the server may answer the command with further authentication steps
+func (c *mysqlCommand) authenticates() bool {
+	return c.code == mysqlCommandLogin || c.code == 0x11
+}
+
+// mysqlParser follows the commands and responses of one connection, responses are matched to the commands
+// in order and a result set is gathered into a single message. Connections switching to TLS are passed through
+type mysqlParser struct {
+	pending []*mysqlCommand
+	// answered are the commands completed by the responses parsed but not matched yet
+	answered map[*message.MySQLMessage]*mysqlCommand
+	// prepared statements by id, to show the SQL of executed statements
+	statements map[uint32]string
+	// capabilities of the client, known once the handshake was seen
+	capabilities uint32
+	loggedIn     bool
+	tls          bool
+}
+
+func newMySQLParser() *mysqlParser {
+	return &mysqlParser{statements: make(map[uint32]string), answered: make(map[*message.MySQLMessage]*mysqlCommand)}
+}
+
+// match stamps a command with the time it was sent and sets the duration on the response completing it
+func (p *mysqlParser) match(record *message.MySQLMessage, request bool, timestamp time.Time) {
+	if request {
+		for i := len(p.pending) - 1; i >= 0; i-- {
+			if p.pending[i].request == record {
+				p.pending[i].timestamp = timestamp
+				return
+			}
+		}
+		return
+	}
+
+	command, ok := p.answered[record]
+	if !ok {
+		return
+	}
+	delete(p.answered, record)
+	if !command.timestamp.IsZero() {
+		record.DurationMs = float64(timestamp.Sub(command.timestamp)) / float64(time.Millisecond)
+	}
+}
+
+func (p *mysqlParser) parse(request bool, data []byte, _ bool) (message.Record, int, error) {
+	if p.tls {
+		return nil, len(data), nil
+	}
+	if request {
+		return p.parseCommand(data)
+	}
+	return p.parseResponse(data)
+}
+
+func (p *mysqlParser) parseCommand(data []byte) (message.Record, int, error) {
+	payload, seq, n, err := readMySQLPacket(data, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(payload) == 0 {
+		return nil, 0, errInvalidMySQL
+	}
+
+	// commands start a new sequence, anything else belongs to the handshake or a LOAD DATA LOCAL transfer
+	if seq != 0 {
+		return p.parseClientData(payload, n)
+	}
+
+	name, ok := mysqlCommands[payload[0]]
+	if !ok || payload[0] == mysqlCommandLogin {
+		return nil, 0, errInvalidMySQL
+	}
+	record := &message.MySQLMessage{Command: name, Size: n}
+	command := &mysqlCommand{code: payload[0], request: record}
+
+	switch payload[0] {
+	case 0x02:
+		record.Database = string(payload[1:])
+	case 0x03:
+		record.Query = p.queryText(payload[1:])
+		command.query = record.Query
+	case 0x16:
+		record.Query = string(payload[1:])
+		command.query = record.Query
+	case 0x17, 0x18, 0x19, 0x1a, 0x1c:
+		if len(payload) >= 5 {
+			record.StatementID = binary.LittleEndian.Uint32(payload[1:5])
+			record.Query = p.statements[record.StatementID]
+			command.query = record.Query
+		}
+		if payload[0] == 0x19 {
+			delete(p.statements, record.StatementID)
+		}
+	}
+
+	if !mysqlNoResponse[payload[0]] {
+		p.pending = append(p.pending, command)
+	}
+	return record, n, nil
+}
+
+// queryText strips the query attributes which precede the SQL when the client negotiated them,
+// queries sent with attributes are kept as they are
+func (p *mysqlParser) queryText(payload []byte) string {
+	if p.capabilities&mysqlClientQueryAttributes == 0 {
+		return string(payload)
+	}
+	count, pos, ok := readLenencInt(payload, 0)
+	if !ok || count != 0 {
+		return string(payload)
+	}
+	// parameter_set_count is always 1
+	if _, pos, ok = readLenencInt(payload, pos); !ok {
+		return string(payload)
+	}
+	return string(payload[pos:])
+}
+
+// parseClientData handles the packets of the client which are not commands
+func (p *mysqlParser) parseClientData(payload []byte, n int) (message.Record, int, error) {
+	if p.loggedIn {
+		return &message.MySQLMessage{Command: "DATA", Size: n}, n, nil
+	}
+
+	if len(payload) < mysqlHandshakeResponseMinimum || p.capabilities != 0 {
+		return &message.MySQLMessage{Command: "AUTH", Size: n}, n, nil
+	}
+
+	p.capabilities = binary.LittleEndian.Uint32(payload[0:4])
+	if len(payload) == mysqlSSLRequestLength && p.capabilities&mysqlClientSSL != 0 {
+		p.tls = true
+		return &message.MySQLMessage{Command: "SSL_REQUEST", Size: n}, n, nil
+	}
+
+	record := &message.MySQLMessage{Command: mysqlCommands[mysqlCommandLogin], Size: n}
+	p.pending = append(p.pending, &mysqlCommand{code: mysqlCommandLogin, request: record})
+
+	// capabilities, max packet size, character set and 23 filler bytes precede the user name
+	pos := mysqlHandshakeResponseMinimum
+	user, pos, ok := readNulString(payload, pos)
+	if !ok {
+		return record, n, nil
+	}
+	record.User = user
+
+	var authLength uint64
+	switch {
+	case p.capabilities&mysqlClientPluginAuthLenenc != 0:
+		authLength, pos, ok = readLenencInt(payload, pos)
+	case p.capabilities&mysqlClientSecureConnection != 0 && pos < len(payload):
+		authLength, pos = uint64(payload[pos]), pos+1
+	default:
+		_, pos, ok = readNulString(payload, pos)
+	}
+	// the length comes from the wire and may point past the packet or overflow int
+	if authLength > uint64(len(payload)-pos) {
+		return record, n, nil
+	}
+	pos += int(authLength)
+	if ok && p.capabilities&mysqlClientConnectWithDB != 0 && pos < len(payload) {
+		record.Database, _, _ = readNulString(payload, pos)
+	}
+	return record, n, nil
+}
+
+func (p *mysqlParser) parseResponse(data []byte) (message.Record, int, error) {
+	payload, seq, n, err := readMySQLPacket(data, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(payload) == 0 {
+		return nil, 0, errInvalidMySQL
+	}
+
+	command := &mysqlCommand{}
+	if len(p.pending) > 0 {
+		command = p.pending[0]
+	} else if seq == 0 && payload[0] == mysqlHandshakeProtocolVersion {
+		version, _, _ := readNulString(payload, 1)
+		return &message.MySQLMessage{Command: "CONNECT", Status: "HANDSHAKE", ServerVersion: version, Size: n}, n, nil
+	}
+
+	record := &message.MySQLMessage{Command: mysqlCommands[command.code], Query: command.query}
+	done := true
+	switch {
+	case payload[0] == 0xff:
+		p.readErr(record, payload)
+	case command.authenticates() && payload[0] == 0xfe:
+		record.Status, done = "AUTH_SWITCH", false
+	case command.authenticates() && payload[0] == 0x01:
+		record.Status, done = "AUTH_MORE_DATA", false
+	case command.code == 0x16 && payload[0] == 0x00:
+		n, err = p.readPrepareOK(record, command, data, payload, n)
+	case payload[0] == 0x00 && command.code != 0x1c:
+		p.readOK(record, payload)
+	case payload[0] == 0xfe && len(payload) < 9:
+		record.Status = "OK"
+	case payload[0] == 0xfb:
+		// the client sends the file of LOAD DATA LOCAL before the final OK
+		record.Status, done = "LOCAL_INFILE", false
+	case command.code == 0x09:
+		record.Status = "OK"
+	case command.code == 0x04 || command.code == 0x1c:
+		record.Status = "RESULTSET"
+		_, n, err = p.readRows(record, data, 0)
+	default:
+		n, err = p.readResultSets(record, data)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if done && len(p.pending) > 0 {
+		if command.code == mysqlCommandLogin {
+			p.loggedIn = true
+		}
+		p.pending = p.pending[1:]
+		p.answered[record] = command
+	}
+	record.Size = n
+	return record, n, nil
+}
+
+func (p *mysqlParser) readOK(record *message.MySQLMessage, payload []byte) uint16 {
+	record.Status = "OK"
+	pos := 1
+	record.AffectedRows, pos, _ = readLenencInt(payload, pos)
+	record.LastInsertID, pos, _ = readLenencInt(payload, pos)
+	if pos+2 <= len(payload) {
+		return binary.LittleEndian.Uint16(payload[pos:])
+	}
+	return 0
+}
+
+func (p *mysqlParser) readErr(record *message.MySQLMessage, payload []byte) {
+	record.Status = "ERR"
+	if len(payload) < 3 {
+		return
+	}
+	record.ErrorCode = binary.LittleEndian.Uint16(payload[1:3])
+	rest := payload[3:]
+	if len(rest) >= 6 && rest[0] == '#' {
+		record.SQLState, rest = string(rest[1:6]), rest[6:]
+	}
+	record.ErrorMessage = string(rest)
+}
+
+// readPrepareOK reads the answer to COM_STMT_PREPARE with the definitions of the parameters and columns following it
+func (p *mysqlParser) readPrepareOK(record *message.MySQLMessage, command *mysqlCommand, data, payload []byte, n int) (int, error) {
+	if len(payload) < 9 {
+		return 0, errInvalidMySQL
+	}
+	record.Status = "OK"
+	record.StatementID = binary.LittleEndian.Uint32(payload[1:5])
+	record.Columns = int(binary.LittleEndian.Uint16(payload[5:7]))
+	params := int(binary.LittleEndian.Uint16(payload[7:9]))
+	p.statements[record.StatementID] = command.query
+
+	var err error
+	for _, count := range []int{params, record.Columns} {
+		if count == 0 {
+			continue
+		}
+		if n, err = skipMySQLPackets(data, n, count); err != nil {
+			return 0, err
+		}
+		if n, err = p.skipEOF(data, n); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// readResultSets reads one result set, or several when the server announces more results, e.g. for procedures
+func (p *mysqlParser) readResultSets(record *message.MySQLMessage, data []byte) (int, error) {
+	pos := 0
+	for {
+		payload, _, next, err := readMySQLPacket(data, pos)
+		if err != nil {
+			return 0, err
+		}
+		if len(payload) == 0 {
+			return 0, errInvalidMySQL
+		}
+
+		var status uint16
+		switch payload[0] {
+		case 0x00:
+			resultSet := record.Status == "RESULTSET"
+			status = p.readOK(record, payload)
+			if resultSet {
+				record.Status = "RESULTSET"
+			}
+			pos = next
+		case 0xff:
+			p.readErr(record, payload)
+			return next, nil
+		default:
+			columns, _, ok := readLenencInt(payload, 0)
+			if !ok || columns == 0 || columns > mysqlMaxColumns {
+				return 0, errInvalidMySQL
+			}
+			if record.Columns == 0 {
+				record.Columns = int(columns)
+			}
+			if pos, err = skipMySQLPackets(data, next, int(columns)); err != nil {
+				return 0, err
+			}
+			record.Status = "RESULTSET"
+			if status, pos, err = p.readIntermediateEOF(data, pos); err != nil {
+				return 0, err
+			}
+			// a cursor was opened, the rows are fetched with COM_STMT_FETCH
+			if status&mysqlServerStatusCursorExists != 0 {
+				return pos, nil
+			}
+			if status, pos, err = p.readRows(record, data, pos); err != nil {
+				return 0, err
+			}
+		}
+
+		if status&mysqlServerMoreResultsExists == 0 || record.Status == "ERR" {
+			return pos, nil
+		}
+	}
+}
+
+// readRows counts the rows up to the packet ending the result set and returns the status flags it carries
+func (p *mysqlParser) readRows(record *message.MySQLMessage, data []byte, pos int) (uint16, int, error) {
+	for {
+		payload, _, next, err := readMySQLPacket(data, pos)
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(payload) == 0 {
+			return 0, 0, errInvalidMySQL
+		}
+
+		switch {
+		case payload[0] == 0xff:
+			p.readErr(record, payload)
+			return 0, next, nil
+		case payload[0] == 0xfe && len(payload) < mysqlMaxPacketSize:
+			if p.eofFormat(payload) {
+				return eofStatus(payload), next, nil
+			}
+			// the OK packet replacing EOF does not change the status of the response
+			ok := &message.MySQLMessage{}
+			return p.readOK(ok, payload), next, nil
+		}
+		record.Rows++
+		pos = next
+	}
+}
+
+// readIntermediateEOF reads the EOF packet following column definitions unless the client deprecated it
+func (p *mysqlParser) readIntermediateEOF(data []byte, pos int) (uint16, int, error) {
+	if p.capabilities&mysqlClientDeprecateEOF != 0 {
+		return 0, pos, nil
+	}
+
+	payload, _, next, err := readMySQLPacket(data, pos)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(payload) > 0 && payload[0] == 0xfe && len(payload) < 9 {
+		return eofStatus(payload), next, nil
+	}
+	// without the handshake it is not known whether EOF packets are sent
+	if p.capabilities == 0 {
+		return 0, pos, nil
+	}
+	return 0, 0, errInvalidMySQL
+}
+
+func (p *mysqlParser) skipEOF(data []byte, pos int) (int, error) {
+	_, next, err := p.readIntermediateEOF(data, pos)
+	return next, err
+}
+
+// eofFormat tells whether a packet starting with 0xfe is an EOF packet or an OK packet replacing it
+func (p *mysqlParser) eofFormat(payload []byte) bool {
+	if p.capabilities != 0 {
+		return p.capabilities&mysqlClientDeprecateEOF == 0
+	}
+	return len(payload) == 5
+}
+
+func eofStatus(payload []byte) uint16 {
+	if len(payload) < 5 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(payload[3:5])
+}
+
+func skipMySQLPackets(data []byte, pos int, count int) (int, error) {
+	for i := 0; i < count; i++ {
+		_, _, next, err := readMySQLPacket(data, pos)
+		if err != nil {
+			return 0, err
+		}
+		pos = next
+	}
+	return pos, nil
+}
+
+// readMySQLPacket returns the payload and sequence id of the packet at pos and the position following it,
+// payloads split into several packets of the maximum size are joined
+func readMySQLPacket(data []byte, pos int) (payload []byte, seq byte, next int, err error) {
+	for first := true; ; first = false {
+		if len(data) < pos+4 {
+			return nil, 0, 0, errIncomplete
+		}
+		length := int(data[pos]) | int(data[pos+1])<<8 | int(data[pos+2])<<16
+		if first {
+			seq = data[pos+3]
+		}
+		if len(data) < pos+4+length {
+			return nil, 0, 0, errIncomplete
+		}
+
+		chunk := data[pos+4 : pos+4+length]
+		if first && length < mysqlMaxPacketSize {
+			return chunk, seq, pos + 4 + length, nil
+		}
+		payload = append(payload, chunk...)
+		pos += 4 + length
+		if length < mysqlMaxPacketSize {
+			return payload, seq, pos, nil
+		}
+	}
+}
+
+// readLenencInt reads a length encoded integer, NULL is read as 0
+func readLenencInt(data []byte, pos int) (uint64, int, bool) {
+	if pos < 0 || pos >= len(data) {
+		return 0, pos, false
+	}
+
+	var size int
+	switch data[pos] {
+	case 0xfb:
+		return 0, pos + 1, true
+	case 0xfc:
+		size = 2
+	case 0xfd:
+		size = 3
+	case 0xfe:
+		size = 8
+	default:
+		return uint64(data[pos]), pos + 1, true
+	}
+	if pos+1+size > len(data) {
+		return 0, pos, false
+	}
+
+	var value uint64
+	for i := size; i > 0; i-- {
+		value = value<<8 | uint64(data[pos+i])
+	}
+	return value, pos + 1 + size, true
+}
+
+func readNulString(data []byte, pos int) (string, int, bool) {
+	if pos < 0 || pos > len(data) {
+		return "", pos, false
+	}
+	end := bytes.IndexByte(data[pos:], 0)
+	if end < 0 {
+		return string(data[pos:]), len(data), false
+	}
+	return string(data[pos : pos+end]), pos + end + 1, true
+}
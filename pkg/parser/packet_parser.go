@@ -1,44 +1,115 @@
 package parser
 
 import (
+	"encoding/binary"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
 	"net"
 	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"time"
 )
 
+// maxConnectionIdle is how long a connection without FIN or RST is kept without packets, the decoders of its flows
+// keep state such as HPACK tables, TLS keys or the MySQL handshake which is lost when it is closed
+const maxConnectionIdle = 10 * time.Minute
+
 type MessageParser struct {
-	messages chan *message.NetMessage
-	packets  chan gopacket.Packet
-	close    chan struct{}
-	port     uint16
-	ips      []net.IP
+	messages  chan *message.NetMessage
+	packets   chan gopacket.Packet
+	done      chan struct{}
+	protocol  string
+	ports     model.Ports
+	ips       []net.IP
+	iface     string
+	forced    map[uint16]string
+	options   DecoderOptions
+	datagrams map[string]*datagramFlow
+	expiry    time.Duration
+	assembler *reassembly.Assembler
+	streams   map[*tcpStream]struct{}
+	tracker   *responseTracker
+
+	// packet time of the latest packet and when it was processed, used to expire idle connections
+	// consistently for live capture and for files read faster than real time
+	lastTimestamp time.Time
+	lastArrival   time.Time
 }
 
-func NewMessageParser(messages chan *message.NetMessage, port uint16, ips []net.IP) (parser *MessageParser) {
+// NewMessageParser creates a parser for the packets of the given protocol, tcp or udp, or both when it is empty
+func NewMessageParser(messages chan *message.NetMessage, protocol string, ports model.Ports, ips []net.IP, expiry time.Duration) (parser *MessageParser) {
 	parser = new(MessageParser)
 
 	parser.messages = messages
 	parser.packets = make(chan gopacket.Packet, 1000)
-	parser.close = make(chan struct{}, 1)
-	parser.port = port
+	parser.done = make(chan struct{})
+	parser.protocol = protocol
+	parser.ports = ports
 	parser.ips = ips
+	parser.datagrams = make(map[string]*datagramFlow)
+	parser.expiry = expiry
+	parser.streams = make(map[*tcpStream]struct{})
+	parser.assembler = reassembly.NewAssembler(reassembly.NewStreamPool(&tcpStreamFactory{parser: parser}))
 
 	go parser.wait()
 
 	return parser
 }
 
+// TrackResponse makes the parser pair each request with its response, requests which are not answered
+// within the timeout are emitted alone. It must be called before the first packet is handled
+func (parser *MessageParser) TrackResponse(timeout time.Duration) {
+	parser.tracker = newResponseTracker(timeout, parser.send)
+}
+
+// SetInterface sets the name of the interface the packets are captured on, it is kept on every message
+func (parser *MessageParser) SetInterface(name string) {
+	parser.iface = name
+}
+
+// ForceDecoders decodes the flows using one of the ports with the named decoder instead of picking one,
+// it must be called before the first packet is handled
+func (parser *MessageParser) ForceDecoders(decoders map[uint16]string) {
+	parser.forced = decoders
+}
+
+// SetDecoderOptions sets the options the decoders of the flows are created with,
+// it must be called before the first packet is handled
+func (parser *MessageParser) SetDecoderOptions(options DecoderOptions) {
+	parser.options = options
+}
+
 func (parser *MessageParser) PacketHandler(packet gopacket.Packet) {
 	parser.packets <- packet
 }
 
+// Close stops accepting packets and waits until the pending ones have been processed
+// and all connections have been flushed
+func (parser *MessageParser) Close() {
+	close(parser.packets)
+	<-parser.done
+}
+
 func (parser *MessageParser) wait() {
+	defer close(parser.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case packet := <-parser.packets:
+		case packet, ok := <-parser.packets:
+			if !ok {
+				parser.assembler.FlushAll()
+				if parser.tracker != nil {
+					parser.tracker.flush()
+				}
+				return
+			}
 			parser.processPacket(packet)
-		case <-parser.close:
-			return
+		case <-ticker.C:
+			parser.flushExpired()
 		}
 	}
 }
@@ -48,9 +119,160 @@ func (parser *MessageParser) processPacket(packet gopacket.Packet) {
 		return
 	}
 
-	//可以在这里把packet解析并转换其他结构体
-	msg := &message.NetMessage{
-		Packet: packet,
+	networkLayer := packet.NetworkLayer()
+	if networkLayer == nil {
+		return
+	}
+
+	timestamp := packet.Metadata().Timestamp
+	if timestamp.After(parser.lastTimestamp) {
+		parser.lastTimestamp = timestamp
+	}
+	parser.lastArrival = time.Now()
+
+	switch transport := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		if parser.protocol == model.ProtocolUDP {
+			return
+		}
+		parser.assembler.AssembleWithContext(networkLayer.NetworkFlow(), transport, &packetContext{packet: packet})
+	case *layers.UDP:
+		if parser.protocol == model.ProtocolTCP {
+			return
+		}
+		parser.emitDatagram(&message.NetMessage{
+			Packets:   []gopacket.Packet{packet},
+			Network:   networkLayer.NetworkFlow(),
+			Transport: transport.TransportFlow(),
+			Timestamp: timestamp,
+			Payload:   transport.Payload,
+		})
+	}
+}
+
+// datagramFlow keeps the decoder of the UDP datagrams exchanged between two endpoints
+type datagramFlow struct {
+	decoder  Decoder
+	lastSeen time.Time
+}
+
+// emitDatagram decodes a UDP datagram with the decoder picked for the first datagram of its flow,
+// every datagram is complete on its own and decoded as final
+func (parser *MessageParser) emitDatagram(msg *message.NetMessage) {
+	parser.describe(msg)
+	flow, ok := parser.datagrams[msg.ConnectionID]
+	if !ok {
+		flow = &datagramFlow{decoder: parser.newDecoder(msg.Protocol, msg.SrcPort, msg.DstPort, msg.Payload)}
+		parser.datagrams[msg.ConnectionID] = flow
+	}
+	flow.lastSeen = msg.Timestamp
+
+	if flow.decoder == nil {
+		parser.emit(msg)
+		return
+	}
+	dir := 1
+	if msg.Request {
+		dir = 0
+	}
+	for _, decoded := range flow.decoder.Decode(dir, msg, true) {
+		parser.emit(decoded)
 	}
+}
+
+// flushExpired skips the gaps of connections waiting for missing packets longer than the expiry and emits the data
+// of connections idle for as long, only connections idle for maxConnectionIdle are closed
+func (parser *MessageParser) flushExpired() {
+	if parser.lastTimestamp.IsZero() {
+		return
+	}
+
+	now := parser.lastTimestamp.Add(time.Since(parser.lastArrival))
+	parser.assembler.FlushWithOptions(reassembly.FlushOptions{
+		T:  now.Add(-parser.expiry),
+		TC: now.Add(-maxConnectionIdle),
+	})
+	for stream := range parser.streams {
+		stream.flushIdle(now.Add(-parser.expiry))
+	}
+	for id, flow := range parser.datagrams {
+		if flow.lastSeen.Before(now.Add(-maxConnectionIdle)) {
+			delete(parser.datagrams, id)
+		}
+	}
+	if parser.tracker != nil {
+		parser.tracker.expire(now)
+	}
+}
+
+func (parser *MessageParser) emit(msg *message.NetMessage) {
+	parser.describe(msg)
+	if parser.tracker == nil {
+		parser.send(msg)
+		return
+	}
+
+	if msg.Request {
+		parser.tracker.request(msg)
+	} else {
+		parser.tracker.response(msg)
+	}
+}
+
+func (parser *MessageParser) send(msg *message.NetMessage) {
 	parser.messages <- msg
 }
+
+// describe fills the flow metadata of a message built from its network and transport flows,
+// messages are described before they are decoded and decoded messages again when they are emitted
+func (parser *MessageParser) describe(msg *message.NetMessage) {
+	msg.Protocol = model.ProtocolUDP
+	if msg.Transport.EndpointType() == layers.EndpointTCPPort {
+		msg.Protocol = model.ProtocolTCP
+	}
+	msg.SrcIP = net.IP(msg.Network.Src().Raw())
+	msg.DstIP = net.IP(msg.Network.Dst().Raw())
+	msg.SrcPort = endpointPort(msg.Transport.Src())
+	msg.DstPort = endpointPort(msg.Transport.Dst())
+	msg.Interface = parser.iface
+	msg.ConnectionID = message.ConnectionID(msg.Protocol, msg.Network, msg.Transport)
+	msg.Request = parser.isRequest(msg)
+	msg.Direction = parser.direction(msg)
+}
+
+// direction tells apart messages received by the local service from those it sends by the interface addresses,
+// when both or none of the addresses are local, e.g. on loopback or for files, requests are the incoming messages
+func (parser *MessageParser) direction(msg *message.NetMessage) message.Direction {
+	srcLocal, dstLocal := parser.isLocal(msg.SrcIP), parser.isLocal(msg.DstIP)
+	if srcLocal == dstLocal {
+		dstLocal = msg.Request
+	}
+	if dstLocal {
+		return message.DirectionIncoming
+	}
+	return message.DirectionOutgoing
+}
+
+func (parser *MessageParser) isLocal(ip net.IP) bool {
+	for _, local := range parser.ips {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRequest reports whether the message was sent to one of the captured ports. When both ports are captured,
+// e.g. when capturing all ports, the lower port is assumed to be the service as clients usually use an ephemeral one
+func (parser *MessageParser) isRequest(msg *message.NetMessage) bool {
+	src, dst := msg.SrcPort, msg.DstPort
+	srcCaptured, dstCaptured := parser.ports.Contains(src), parser.ports.Contains(dst)
+	if srcCaptured == dstCaptured {
+		return dst < src
+	}
+	return dstCaptured
+}
+
+func endpointPort(endpoint gopacket.Endpoint) uint16 {
+	return binary.BigEndian.Uint16(endpoint.Raw())
+}
@@ -0,0 +1,353 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"time"
+)
+
+const (
+	postgresProtocolVersion = 196608
+	postgresCancelRequest   = 80877102
+	postgresSSLRequest      = 80877103
+	postgresGSSENCRequest   = 80877104
+	// postgresMaxStartupLength rejects untyped data which is not a startup message
+	postgresMaxStartupLength = 10000
+	// maxPostgresPendingRequests bounds the requests of a connection waiting for ReadyForQuery
+	maxPostgresPendingRequests = 1024
+)
+
+var errInvalidPostgres = errors.New("invalid PostgreSQL data")
+
+var postgresFrontendMessages = map[byte]string{
+	'Q': "Query",
+	'P': "Parse",
+	'B': "Bind",
+	'E': "Execute",
+	'D': "Describe",
+	'C': "Close",
+	'S': "Sync",
+	'H': "Flush",
+	'X': "Terminate",
+	'p': "PasswordMessage",
+	'd': "CopyData",
+	'c': "CopyDone",
+	'f': "CopyFail",
+	'F': "FunctionCall",
+}
+
+var postgresBackendMessages = map[byte]string{
+	'R': "Authentication",
+	'S': "ParameterStatus",
+	'K': "BackendKeyData",
+	'Z': "ReadyForQuery",
+	'T': "RowDescription",
+	'D': "DataRow",
+	'C': "CommandComplete",
+	'E': "ErrorResponse",
+	'N': "NoticeResponse",
+	'1': "ParseComplete",
+	'2': "BindComplete",
+	'3': "CloseComplete",
+	'n': "NoData",
+	't': "ParameterDescription",
+	's': "PortalSuspended",
+	'I': "EmptyQueryResponse",
+	'G': "CopyInResponse",
+	'H': "CopyOutResponse",
+	'W': "CopyBothResponse",
+	'd': "CopyData",
+	'c': "CopyDone",
+	'A': "NotificationResponse",
+	'V': "FunctionCallResponse",
+	'v': "NegotiateProtocolVersion",
+}
+
+// postgresFrontendEnds are the messages after which the client waits for the server
+var postgresFrontendEnds = map[byte]bool{'Q': true, 'S': true, 'p': true, 'c': true, 'f': true, 'X': true, 'F': true}
+
+// postgresSyncs are the messages the server answers with ReadyForQuery once it has processed everything before them
+var postgresSyncs = map[string]bool{"Query": true, "Sync": true, "FunctionCall": true}
+
+var postgresTransactionStatus = map[byte]string{'I': "idle", 'T': "transaction", 'E': "failed"}
+
+func init() {
+	RegisterDecoder(DecoderFactory{
+		Name:     "postgresql",
+		Protocol: model.ProtocolTCP,
+		Ports:    []uint16{5432},
+		Sniff:    isPostgreSQL,
+		New: func(DecoderOptions) Decoder {
+			return &postgresDecoder{frames: newFrameDecoder(&postgresParser{statements: make(map[string]string)})}
+		},
+	})
+}
+
+// postgresDecoder sets the time the server took on the groups ending with ReadyForQuery, measured from the
+// group of the client ending with the Query, Sync or FunctionCall they answer
+type postgresDecoder struct {
+	frames  *frameDecoder
+	pending []time.Time
+}
+
+func (d *postgresDecoder) Decode(dir int, msg *message.NetMessage, final bool) []*message.NetMessage {
+	result := d.frames.Decode(dir, msg, final)
+	for _, m := range result {
+		if record, ok := m.Record.(*message.PostgreSQLMessage); ok && len(record.Messages) > 0 {
+			timestamp := m.Timestamp
+			if !m.Request && len(m.Packets) > 0 {
+				// the group is complete with the packet carrying ReadyForQuery
+				timestamp = m.Packets[len(m.Packets)-1].Metadata().Timestamp
+			}
+			d.match(record, m.Request, timestamp)
+		}
+	}
+	return result
+}
+
+func (d *postgresDecoder) match(record *message.PostgreSQLMessage, request bool, timestamp time.Time) {
+	last := record.Messages[len(record.Messages)-1]
+	if request {
+		if postgresSyncs[last] {
+			if len(d.pending) >= maxPostgresPendingRequests {
+				d.pending = nil
+			}
+			d.pending = append(d.pending, timestamp)
+		}
+		return
+	}
+
+	if last != "ReadyForQuery" || len(d.pending) == 0 {
+		return
+	}
+	record.DurationMs = float64(timestamp.Sub(d.pending[0])) / float64(time.Millisecond)
+	d.pending = d.pending[1:]
+}
+
+// isPostgreSQL sniffs for the startup, SSL or GSS encryption request a connection starts with
+func isPostgreSQL(payload []byte) bool {
+	if len(payload) < 8 {
+		return false
+	}
+	length := binary.BigEndian.Uint32(payload[0:4])
+	switch binary.BigEndian.Uint32(payload[4:8]) {
+	case postgresSSLRequest, postgresGSSENCRequest:
+		return length == 8
+	case postgresProtocolVersion:
+		return int(length) == len(payload)
+	}
+	return false
+}
+
+// postgresParser groups the messages of one connection into requests and responses, connections which
+// switch to SSL or GSS encryption are passed through
+type postgresParser struct {
+	// prepared statements by name, to show the SQL of bound statements
+	statements map[string]string
+	// an encryption request waits for the single byte answer of the server
+	encryptionRequested bool
+	encrypted           bool
+}
+
+func (p *postgresParser) parse(request bool, data []byte, final bool) (message.Record, int, error) {
+	if p.encrypted {
+		return nil, len(data), nil
+	}
+	if request {
+		if data[0] == 0 {
+			return p.parseStartup(data)
+		}
+		return p.parseGroup(data, final, postgresFrontendMessages, p.readFrontend)
+	}
+
+	if p.encryptionRequested {
+		p.encryptionRequested = false
+		switch data[0] {
+		case 'S', 'G':
+			p.encrypted = true
+			fallthrough
+		case 'N':
+			return &message.PostgreSQLMessage{Messages: []string{"EncryptionResponse"}, Size: 1}, 1, nil
+		}
+	}
+	return p.parseGroup(data, final, postgresBackendMessages, p.readBackend)
+}
+
+// parseStartup reads the untyped messages sent before the startup completed
+func (p *postgresParser) parseStartup(data []byte) (message.Record, int, error) {
+	if len(data) < 8 {
+		return nil, 0, errIncomplete
+	}
+	length := int(binary.BigEndian.Uint32(data[0:4]))
+	if length < 8 || length > postgresMaxStartupLength {
+		return nil, 0, errInvalidPostgres
+	}
+	if len(data) < length {
+		return nil, 0, errIncomplete
+	}
+
+	record := &message.PostgreSQLMessage{Size: length}
+	switch binary.BigEndian.Uint32(data[4:8]) {
+	case postgresSSLRequest:
+		record.AddMessage("SSLRequest")
+		p.encryptionRequested = true
+	case postgresGSSENCRequest:
+		record.AddMessage("GSSENCRequest")
+		p.encryptionRequested = true
+	case postgresCancelRequest:
+		record.AddMessage("CancelRequest")
+	case postgresProtocolVersion:
+		record.AddMessage("StartupMessage")
+		params := bytes.Split(bytes.TrimRight(data[8:length], "\x00"), []byte{0})
+		for i := 0; i+1 < len(params); i += 2 {
+			switch string(params[i]) {
+			case "user":
+				record.User = string(params[i+1])
+			case "database":
+				record.Database = string(params[i+1])
+			}
+		}
+	default:
+		return nil, 0, errInvalidPostgres
+	}
+	return record, length, nil
+}
+
+// parseGroup reads messages until one after which the other side is expected to answer. At the end of
+// the connection the messages read so far form the group
+func (p *postgresParser) parseGroup(data []byte, final bool, names map[byte]string,
+	read func(record *message.PostgreSQLMessage, kind byte, body []byte) bool) (message.Record, int, error) {
+	record := &message.PostgreSQLMessage{}
+	pos := 0
+	for {
+		if pos == len(data) && final && pos > 0 {
+			break
+		}
+		kind, body, next, err := readPostgresMessage(data, pos)
+		if err == errIncomplete && final && pos > 0 {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		name, ok := names[kind]
+		if !ok {
+			return nil, 0, errInvalidPostgres
+		}
+
+		record.AddMessage(name)
+		pos = next
+		if read(record, kind, body) {
+			break
+		}
+	}
+	record.Size = pos
+	return record, pos, nil
+}
+
+// readFrontend reads a message of the client and reports whether the client waits for the server after it
+func (p *postgresParser) readFrontend(record *message.PostgreSQLMessage, kind byte, body []byte) bool {
+	switch kind {
+	case 'Q':
+		record.Query, _ = readCString(body)
+	case 'P':
+		statement, rest := readCString(body)
+		query, _ := readCString(rest)
+		p.statements[statement] = query
+		record.Statement, record.Query = statement, query
+	case 'B':
+		_, rest := readCString(body)
+		statement, _ := readCString(rest)
+		record.Statement = statement
+		if record.Query == "" {
+			record.Query = p.statements[statement]
+		}
+	case 'C':
+		if len(body) > 0 && body[0] == 'S' {
+			statement, _ := readCString(body[1:])
+			delete(p.statements, statement)
+		}
+	}
+	return postgresFrontendEnds[kind]
+}
+
+// readBackend reads a message of the server and reports whether the server waits for the client after it
+func (p *postgresParser) readBackend(record *message.PostgreSQLMessage, kind byte, body []byte) bool {
+	switch kind {
+	case 'T':
+		if len(body) >= 2 {
+			record.Columns = int(binary.BigEndian.Uint16(body))
+		}
+	case 'D':
+		record.Rows++
+	case 'C':
+		tag, _ := readCString(body)
+		record.CommandTags = append(record.CommandTags, tag)
+	case 'E':
+		if record.ErrorCode == "" {
+			readPostgresError(record, body)
+		}
+	case 'Z':
+		if len(body) > 0 {
+			record.TransactionStatus = postgresTransactionStatus[body[0]]
+		}
+		return true
+	case 'R':
+		// anything but AuthenticationOk asks the client for credentials
+		return len(body) < 4 || binary.BigEndian.Uint32(body) != 0
+	case 'G', 'W':
+		return true
+	case 'A':
+		// notifications are sent at any time, alone they are not an answer
+		return len(record.Messages) == 1
+	}
+	return false
+}
+
+// readPostgresError reads the severity, SQLSTATE code and message fields of an ErrorResponse
+func readPostgresError(record *message.PostgreSQLMessage, body []byte) {
+	for len(body) > 0 && body[0] != 0 {
+		field := body[0]
+		var value string
+		value, body = readCString(body[1:])
+		switch field {
+		case 'V':
+			record.ErrorSeverity = value
+		case 'S':
+			if record.ErrorSeverity == "" {
+				record.ErrorSeverity = value
+			}
+		case 'C':
+			record.ErrorCode = value
+		case 'M':
+			record.ErrorMessage = value
+		}
+	}
+}
+
+// readPostgresMessage returns the type and body of the message at pos and the position following it
+func readPostgresMessage(data []byte, pos int) (byte, []byte, int, error) {
+	if len(data) < pos+5 {
+		return 0, nil, 0, errIncomplete
+	}
+	length := int(binary.BigEndian.Uint32(data[pos+1 : pos+5]))
+	if length < 4 || length > maxDecoderBufferSize {
+		return 0, nil, 0, errInvalidPostgres
+	}
+	if len(data) < pos+1+length {
+		return 0, nil, 0, errIncomplete
+	}
+	return data[pos], data[pos+5 : pos+1+length], pos + 1 + length, nil
+}
+
+// readCString returns the NUL terminated string at the start of data and the data following it
+func readCString(data []byte) (string, []byte) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return string(data), nil
+	}
+	return string(data[:end]), data[end+1:]
+}
@@ -0,0 +1,219 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"strconv"
+	"strings"
+)
+
+// maxRESPDepth limits the nesting of aggregate replies
+const maxRESPDepth = 32
+
+var errInvalidRESP = errors.New("invalid RESP data")
+
+var respTypes = map[byte]string{
+	'+': "simple_string",
+	'-': "error",
+	':': "integer",
+	'$': "bulk_string",
+	'*': "array",
+	'_': "null",
+	'#': "boolean",
+	',': "double",
+	'(': "big_number",
+	'!': "bulk_error",
+	'=': "verbatim_string",
+	'%': "map",
+	'~': "set",
+	'>': "push",
+}
+
+// redisKeylessCommands do not take a key as their first argument
+var redisKeylessCommands = map[string]bool{
+	"AUTH": true, "CLIENT": true, "CLUSTER": true, "COMMAND": true, "CONFIG": true, "DBSIZE": true, "DISCARD": true,
+	"ECHO": true, "EVAL": true, "EVALSHA": true, "EXEC": true, "FLUSHALL": true, "FLUSHDB": true, "HELLO": true,
+	"INFO": true, "MULTI": true, "PING": true, "PSUBSCRIBE": true, "PUBLISH": true, "PUNSUBSCRIBE": true, "QUIT": true,
+	"READONLY": true, "SCAN": true, "SCRIPT": true, "SELECT": true, "SLOWLOG": true, "SUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "UNWATCH": true,
+}
+
+func init() {
+	RegisterDecoder(DecoderFactory{
+		Name:     "redis",
+		Protocol: model.ProtocolTCP,
+		Ports:    []uint16{6379},
+		Sniff:    isRedis,
+		New: func(DecoderOptions) Decoder {
+			return newFrameDecoder(&redisParser{})
+		},
+	})
+}
+
+// isRedis sniffs for a command sent as an array of bulk strings, e.g. *2\r\n$3\r\nGET\r\n
+func isRedis(payload []byte) bool {
+	line, rest, found := bytes.Cut(payload, []byte("\r\n"))
+	if !found || len(line) < 2 || line[0] != '*' {
+		return false
+	}
+	if _, err := strconv.Atoi(string(line[1:])); err != nil {
+		return false
+	}
+	return bytes.HasPrefix(rest, []byte("$"))
+}
+
+// respValue is a decoded RESP value, str holds the content of simple and bulk values
+type respValue struct {
+	kind  byte
+	str   string
+	items []respValue
+}
+
+// redisParser parses the commands and replies of one connection, replies are matched to the commands
+// in the order they were sent as Redis answers in order
+type redisParser struct {
+	commands []string
+}
+
+func (p *redisParser) parse(request bool, data []byte, _ bool) (message.Record, int, error) {
+	if request {
+		return p.parseCommand(data)
+	}
+	return p.parseReply(data)
+}
+
+func (p *redisParser) parseCommand(data []byte) (message.Record, int, error) {
+	var args []string
+	var n int
+	if data[0] == '*' {
+		value, next, err := readRESP(data, 0, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, item := range value.items {
+			args = append(args, item.str)
+		}
+		n = next
+	} else {
+		// inline commands are sent as a plain line, e.g. by telnet
+		line, next, err := readLine(data, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		args = strings.Fields(line)
+		n = next
+	}
+	if len(args) == 0 {
+		return nil, 0, errInvalidRESP
+	}
+
+	record := &message.RedisMessage{Command: strings.ToUpper(args[0]), Args: len(args) - 1, Size: n}
+	if len(args) > 1 && !redisKeylessCommands[record.Command] {
+		record.Key = args[1]
+	}
+	p.commands = append(p.commands, record.Command)
+	return record, n, nil
+}
+
+func (p *redisParser) parseReply(data []byte) (message.Record, int, error) {
+	value, n, err := readRESP(data, 0, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	record := &message.RedisMessage{ReplyType: respTypes[value.kind], Args: len(value.items), Size: n}
+	if value.kind == '%' {
+		record.Args /= 2
+	}
+	if value.kind == '-' || value.kind == '!' {
+		record.Error = value.str
+	}
+	// pushed data is not an answer to a command
+	if value.kind != '>' && len(p.commands) > 0 {
+		record.Command = p.commands[0]
+		p.commands = p.commands[1:]
+	}
+	return record, n, nil
+}
+
+// readRESP reads the value starting at pos and returns it together with the position following it
+func readRESP(data []byte, pos int, depth int) (value respValue, next int, err error) {
+	if depth > maxRESPDepth {
+		return value, 0, errInvalidRESP
+	}
+	if pos >= len(data) {
+		return value, 0, errIncomplete
+	}
+
+	value.kind = data[pos]
+	line, next, err := readLine(data, pos+1)
+	if err != nil {
+		return value, 0, err
+	}
+
+	switch value.kind {
+	case '+', '-', ':', '_', '#', ',', '(':
+		value.str = line
+		return value, next, nil
+	case '$', '!', '=':
+		size, err := strconv.Atoi(line)
+		if err != nil {
+			return value, 0, errInvalidRESP
+		}
+		// RESP2 null bulk string
+		if size < 0 {
+			value.kind = '_'
+			return value, next, nil
+		}
+		// a length beyond what the decoder buffers cannot be valid and would overflow the bounds below
+		if size > maxDecoderBufferSize {
+			return value, 0, errInvalidRESP
+		}
+		if len(data) < next+size+2 {
+			return value, 0, errIncomplete
+		}
+		if !bytes.Equal(data[next+size:next+size+2], []byte("\r\n")) {
+			return value, 0, errInvalidRESP
+		}
+		value.str = string(data[next : next+size])
+		return value, next + size + 2, nil
+	case '*', '%', '~', '>', '|':
+		count, err := strconv.Atoi(line)
+		if err != nil {
+			return value, 0, errInvalidRESP
+		}
+		// RESP2 null array
+		if count < 0 {
+			value.kind = '_'
+			return value, next, nil
+		}
+		if value.kind == '%' || value.kind == '|' {
+			count *= 2
+		}
+		for i := 0; i < count; i++ {
+			var item respValue
+			item, next, err = readRESP(data, next, depth+1)
+			if err != nil {
+				return value, 0, err
+			}
+			value.items = append(value.items, item)
+		}
+		// attributes are sent ahead of the reply they describe
+		if value.kind == '|' {
+			return readRESP(data, next, depth+1)
+		}
+		return value, next, nil
+	}
+	return value, 0, errInvalidRESP
+}
+
+// readLine returns the line starting at pos without its CRLF and the position following it
+func readLine(data []byte, pos int) (string, int, error) {
+	end := bytes.Index(data[pos:], []byte("\r\n"))
+	if end < 0 {
+		return "", 0, errIncomplete
+	}
+	return string(data[pos : pos+end]), pos + end + 2, nil
+}
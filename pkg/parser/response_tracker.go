@@ -0,0 +1,97 @@
+package parser
+
+import (
+	"github.com/google/gopacket"
+	"net-capture/pkg/message"
+	"time"
+)
+
+// maxPendingRequests bounds the requests waiting for a response on one connection, the oldest one is emitted
+// unanswered when another request arrives
+const maxPendingRequests = 1024
+
+// connectionKey identifies a connection by its flows in request direction
+type connectionKey [2]gopacket.Flow
+
+// responseTracker pairs every request with the next response sent back on the same connection,
+// requests without a response are emitted on their own once the timeout is exceeded
+type responseTracker struct {
+	timeout time.Duration
+	pending map[connectionKey][]*message.NetMessage
+	emit    func(msg *message.NetMessage)
+}
+
+func newResponseTracker(timeout time.Duration, emit func(msg *message.NetMessage)) *responseTracker {
+	return &responseTracker{
+		timeout: timeout,
+		pending: make(map[connectionKey][]*message.NetMessage),
+		emit:    emit,
+	}
+}
+
+func (t *responseTracker) request(msg *message.NetMessage) {
+	key := connectionKey{msg.Network, msg.Transport}
+	requests := t.expireConnection(key, msg.Timestamp)
+	if len(requests) >= maxPendingRequests {
+		t.emit(requests[0])
+		requests = requests[1:]
+	}
+	t.pending[key] = append(requests, msg)
+}
+
+func (t *responseTracker) response(msg *message.NetMessage) {
+	key := connectionKey{msg.Network.Reverse(), msg.Transport.Reverse()}
+	// requests which timed out by the time of the response are not paired with it
+	requests := t.expireConnection(key, msg.Timestamp)
+	if len(requests) == 0 {
+		// the request was sent before capturing started or has already timed out
+		t.emit(msg)
+		return
+	}
+
+	req := requests[0]
+	if len(requests) == 1 {
+		delete(t.pending, key)
+	} else {
+		t.pending[key] = requests[1:]
+	}
+
+	req.Response = msg
+	req.Latency = msg.Timestamp.Sub(req.Timestamp)
+	t.emit(req)
+}
+
+// expire emits the requests which are waiting for a response since before now minus the timeout
+func (t *responseTracker) expire(now time.Time) {
+	for key := range t.pending {
+		t.expireConnection(key, now)
+	}
+}
+
+// expireConnection emits the timed out requests of one connection and returns the ones still waiting
+func (t *responseTracker) expireConnection(key connectionKey, now time.Time) []*message.NetMessage {
+	requests := t.pending[key]
+	deadline := now.Add(-t.timeout)
+	i := 0
+	for ; i < len(requests) && requests[i].Timestamp.Before(deadline); i++ {
+		t.emit(requests[i])
+	}
+
+	if i == len(requests) {
+		delete(t.pending, key)
+		return nil
+	}
+	requests = requests[i:]
+	t.pending[key] = requests
+	return requests
+}
+
+// flush emits all requests still waiting for a response
+func (t *responseTracker) flush() {
+	for key, requests := range t.pending {
+		for _, req := range requests {
+			t.emit(req)
+		}
+		delete(t.pending, key)
+	}
+}
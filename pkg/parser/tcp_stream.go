@@ -0,0 +1,165 @@
+package parser
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+	"net-capture/pkg/message"
+	"time"
+)
+
+// maxMessageSize caps the bytes buffered for one direction, longer transfers are emitted in several messages
+const maxMessageSize = 5 << 20
+
+// packetContext passes the original packet through the assembler, so it can be kept on the message
+type packetContext struct {
+	packet gopacket.Packet
+}
+
+func (c *packetContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return c.packet.Metadata().CaptureInfo
+}
+
+type tcpStreamFactory struct {
+	parser *MessageParser
+}
+
+func (f *tcpStreamFactory) New(netFlow, tcpFlow gopacket.Flow, _ *layers.TCP, _ reassembly.AssemblerContext) reassembly.Stream {
+	s := &tcpStream{
+		parser:    f.parser,
+		network:   netFlow,
+		transport: tcpFlow,
+	}
+	f.parser.streams[s] = struct{}{}
+	return s
+}
+
+// tcpHalf holds what has been received in one direction since the last message was emitted
+type tcpHalf struct {
+	payload   []byte
+	packets   []gopacket.Packet
+	timestamp time.Time
+}
+
+// tcpStream collects the reassembled bytes of one connection, every time the sending side changes
+// the data buffered for the previous direction is emitted as one message
+type tcpStream struct {
+	parser    *MessageParser
+	network   gopacket.Flow
+	transport gopacket.Flow
+	current   reassembly.TCPFlowDirection
+	halves    [2]tcpHalf
+	// lastSeen is the time of the latest packet in either direction
+	lastSeen time.Time
+
+	// the ports and first data of a connection decide how it is decoded
+	sniffed bool
+	decoder Decoder
+}
+
+func (s *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, _ reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	// connections which were already established when capturing started have no SYN
+	*start = true
+	if ci.Timestamp.After(s.lastSeen) {
+		s.lastSeen = ci.Timestamp
+	}
+
+	if ctx, ok := ac.(*packetContext); ok {
+		half := s.half(dir)
+		half.packets = append(half.packets, ctx.packet)
+	}
+
+	if tcp.RST {
+		s.flush(dir.Reverse(), true)
+		s.flush(dir, true)
+	}
+	return true
+}
+
+func (s *tcpStream) ReassembledSG(sg reassembly.ScatterGather, _ reassembly.AssemblerContext) {
+	dir, _, end, _ := sg.Info()
+	length, _ := sg.Lengths()
+
+	if length > 0 {
+		if dir != s.current {
+			s.flush(s.current, false)
+			s.current = dir
+		}
+
+		half := s.half(dir)
+		if len(half.payload) == 0 {
+			half.timestamp = sg.CaptureInfo(0).Timestamp
+		}
+		half.payload = append(half.payload, sg.Fetch(length)...)
+		if len(half.payload) >= maxMessageSize {
+			s.flush(dir, false)
+		}
+	}
+
+	if end {
+		s.flush(dir, true)
+	}
+}
+
+func (s *tcpStream) ReassemblyComplete(_ reassembly.AssemblerContext) bool {
+	s.flush(s.current, true)
+	s.flush(s.current.Reverse(), true)
+	delete(s.parser.streams, s)
+	return true
+}
+
+// flushIdle emits the data buffered for both directions when no packet was seen since the deadline, the
+// connection and its decoder are kept for the data which follows
+func (s *tcpStream) flushIdle(deadline time.Time) {
+	if s.lastSeen.Before(deadline) {
+		s.flush(s.current, false)
+		s.flush(s.current.Reverse(), false)
+	}
+}
+
+func (s *tcpStream) half(dir reassembly.TCPFlowDirection) *tcpHalf {
+	return &s.halves[halfIndex(dir)]
+}
+
+func halfIndex(dir reassembly.TCPFlowDirection) int {
+	if dir == reassembly.TCPDirClientToServer {
+		return 0
+	}
+	return 1
+}
+
+// flush emits the data buffered for the given direction, control packets without payload are kept
+// until the direction sends data again. final is set once the direction will not send any more data
+func (s *tcpStream) flush(dir reassembly.TCPFlowDirection, final bool) {
+	half := s.half(dir)
+	if len(half.payload) == 0 && (!final || s.decoder == nil) {
+		return
+	}
+
+	msg := &message.NetMessage{
+		Packets:   half.packets,
+		Network:   s.network,
+		Transport: s.transport,
+		Timestamp: half.timestamp,
+		Payload:   half.payload,
+	}
+	if dir == reassembly.TCPDirServerToClient {
+		msg.Network = s.network.Reverse()
+		msg.Transport = s.transport.Reverse()
+	}
+	*half = tcpHalf{}
+	s.parser.describe(msg)
+
+	if !s.sniffed && len(msg.Payload) > 0 {
+		s.sniffed = true
+		s.decoder = s.parser.newDecoder(msg.Protocol, msg.SrcPort, msg.DstPort, msg.Payload)
+	}
+
+	if s.decoder == nil {
+		s.parser.emit(msg)
+		return
+	}
+	for _, decoded := range s.decoder.Decode(halfIndex(dir), msg, final) {
+		s.parser.emit(decoded)
+	}
+}
@@ -0,0 +1,617 @@
+package parser
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tlsChangeCipherSpec = 20
+	tlsAlert            = 21
+	tlsHandshake        = 22
+	tlsApplicationData  = 23
+	tlsHeartbeat        = 24
+
+	tlsClientHello         = 1
+	tlsServerHello         = 2
+	tlsEncryptedExtensions = 8
+	tlsCertificate         = 11
+	tlsFinished            = 20
+	tlsKeyUpdate           = 24
+
+	tlsExtensionServerName        = 0
+	tlsExtensionSupportedGroups   = 10
+	tlsExtensionECPointFormats    = 11
+	tlsExtensionALPN              = 16
+	tlsExtensionEncryptThenMAC    = 22
+	tlsExtensionSupportedVersions = 43
+
+	tlsVersion13 = 0x0304
+
+	tlsRecordHeaderSize = 5
+	// maxTLSRecordSize is the largest record length allowed for ciphertext
+	maxTLSRecordSize = 16384 + 2048
+	// maxTLSHandshakeSize bounds a handshake message reassembled from several records
+	maxTLSHandshakeSize = 1 << 17
+)
+
+var errInvalidTLS = errors.New("invalid TLS data")
+
+// tlsHelloRetryRequest is the random of a ServerHello asking the client for another ClientHello
+var tlsHelloRetryRequest = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+var tlsVersions = map[uint16]string{
+	0x0300:       "SSL 3.0",
+	0x0301:       "TLS 1.0",
+	0x0302:       "TLS 1.1",
+	0x0303:       "TLS 1.2",
+	tlsVersion13: "TLS 1.3",
+}
+
+var tlsHandshakeTypes = map[byte]string{
+	0:                      "HelloRequest",
+	tlsClientHello:         "ClientHello",
+	tlsServerHello:         "ServerHello",
+	4:                      "NewSessionTicket",
+	5:                      "EndOfEarlyData",
+	tlsEncryptedExtensions: "EncryptedExtensions",
+	tlsCertificate:         "Certificate",
+	12:                     "ServerKeyExchange",
+	13:                     "CertificateRequest",
+	14:                     "ServerHelloDone",
+	15:                     "CertificateVerify",
+	16:                     "ClientKeyExchange",
+	tlsFinished:            "Finished",
+	22:                     "CertificateStatus",
+	tlsKeyUpdate:           "KeyUpdate",
+}
+
+var tlsAlertDescriptions = map[byte]string{
+	0:   "close_notify",
+	10:  "unexpected_message",
+	20:  "bad_record_mac",
+	22:  "record_overflow",
+	40:  "handshake_failure",
+	42:  "bad_certificate",
+	43:  "unsupported_certificate",
+	44:  "certificate_revoked",
+	45:  "certificate_expired",
+	46:  "certificate_unknown",
+	47:  "illegal_parameter",
+	48:  "unknown_ca",
+	49:  "access_denied",
+	50:  "decode_error",
+	51:  "decrypt_error",
+	70:  "protocol_version",
+	71:  "insufficient_security",
+	80:  "internal_error",
+	86:  "inappropriate_fallback",
+	90:  "user_canceled",
+	100: "no_renegotiation",
+	109: "missing_extension",
+	110: "unsupported_extension",
+	112: "unrecognized_name",
+	116: "certificate_required",
+	120: "no_application_protocol",
+}
+
+func init() {
+	RegisterDecoder(DecoderFactory{
+		Name:     "tls",
+		Protocol: model.ProtocolTCP,
+		Ports:    []uint16{443},
+		Sniff:    isTLS,
+		New: func(options DecoderOptions) Decoder {
+			return newTLSDecoder(options)
+		},
+	})
+}
+
+// isTLS sniffs for the record carrying the ClientHello a connection starts with
+func isTLS(payload []byte) bool {
+	return len(payload) > tlsRecordHeaderSize && payload[0] == tlsHandshake && payload[1] == 3 &&
+		payload[tlsRecordHeaderSize] == tlsClientHello
+}
+
+// tlsDecoder decodes the records of a TLS connection and, when a key log has the secrets of the connection, passes
+// the decrypted application data on to the decoder of the protocol selected with ALPN or recognized from the data
+type tlsDecoder struct {
+	parser *tlsParser
+	frames *frameDecoder
+	// inner decodes the plaintext, it is picked with the first plaintext and nil keeps the plaintext undecoded
+	inner  Decoder
+	picked bool
+}
+
+func newTLSDecoder(options DecoderOptions) *tlsDecoder {
+	p := &tlsParser{options: options}
+	return &tlsDecoder{parser: p, frames: newFrameDecoder(p)}
+}
+
+func (d *tlsDecoder) Decode(dir int, msg *message.NetMessage, final bool) (result []*message.NetMessage) {
+	for _, m := range d.frames.Decode(dir, msg, final) {
+		plaintext, ok := m.Record.(*tlsPlaintext)
+		if !ok {
+			result = append(result, m)
+			continue
+		}
+		m.Payload, m.Record = plaintext.data, nil
+		if !d.picked {
+			d.picked = true
+			d.inner = d.parser.innerDecoder(m.Payload)
+		}
+		if d.inner == nil {
+			result = append(result, m)
+			continue
+		}
+		result = append(result, d.inner.Decode(dir, m, false)...)
+	}
+	if final && d.inner != nil {
+		flush := *msg
+		flush.Payload, flush.Packets = nil, nil
+		result = append(result, d.inner.Decode(dir, &flush, true)...)
+	}
+	return
+}
+
+// tlsPlaintext is the decrypted application data of consecutive records
+type tlsPlaintext struct {
+	data []byte
+}
+
+func (r *tlsPlaintext) Protocol() string {
+	return "tls"
+}
+
+func (r *tlsPlaintext) String() string {
+	return fmt.Sprintf("%d bytes decrypted application data\n", len(r.data))
+}
+
+// tlsParser groups consecutive records of one direction into a message and decodes the handshake as long as it
+// is not encrypted or can be decrypted. Index 0 of its fields is the client side, 1 the server side
+type tlsParser struct {
+	// handshakes holds the start of a handshake message continued in the next record
+	handshakes [2][]byte
+	encrypted  [2]bool
+	// tls13 is set once the server selected TLS 1.3, which encrypts everything after ServerHello
+	tls13 bool
+
+	// random, suite and etm are taken from the hello messages to decrypt the records with keys derived from the
+	// secrets in the key log
+	random [2][]byte
+	suite  *tlsCipherSuite
+	etm    bool
+	keys   [2]tlsKeys
+	// alpn is the application protocol selected by the server
+	alpn string
+
+	// options hold the key log and are passed on to the decoder of the decrypted application data
+	options DecoderOptions
+	// missed remembers when a secret was last not found in the key log, it is not looked up again before the key
+	// log is checked for new secrets
+	missed map[string]time.Time
+}
+
+// the kinds of messages parse groups records into
+const (
+	tlsGroupHandshake = iota
+	tlsGroupApplicationData
+	tlsGroupPlaintext
+)
+
+func (p *tlsParser) parse(request bool, data []byte, _ bool) (message.Record, int, error) {
+	side := 1
+	if request {
+		side = 0
+	}
+
+	record := &message.TLSMessage{}
+	var plaintext []byte
+	group := tlsGroupHandshake
+	pos := 0
+	for len(data)-pos >= tlsRecordHeaderSize {
+		header := data[pos : pos+tlsRecordHeaderSize]
+		kind, length := header[0], int(binary.BigEndian.Uint16(header[3:]))
+		if kind < tlsChangeCipherSpec || kind > tlsHeartbeat || header[1] != 3 || length > maxTLSRecordSize {
+			if pos == 0 {
+				return nil, 0, errInvalidTLS
+			}
+			break
+		}
+		end := pos + tlsRecordHeaderSize + length
+		if end > len(data) {
+			break
+		}
+
+		opened := tlsOpened{kind: kind, data: data[pos+tlsRecordHeaderSize : end]}
+		protected := p.protected(side, kind)
+		if protected {
+			opened = p.open(side, header, opened.data)
+		}
+		g := tlsGroupHandshake
+		if opened.kind == tlsApplicationData && opened.decrypted {
+			g = tlsGroupPlaintext
+		} else if opened.kind == tlsApplicationData {
+			g = tlsGroupApplicationData
+		}
+		// application data is reported apart from the records around it
+		if pos > 0 && g != group {
+			break
+		}
+		group = g
+
+		if protected {
+			p.commit(side, opened)
+		}
+		if g == tlsGroupPlaintext {
+			plaintext = append(plaintext, opened.data...)
+		} else {
+			p.readRecord(side, opened.kind, opened.data, opened.decrypted, record)
+		}
+		record.Records++
+		pos = end
+	}
+	if pos == 0 {
+		return nil, 0, errIncomplete
+	}
+	if group == tlsGroupPlaintext {
+		return &tlsPlaintext{data: plaintext}, pos, nil
+	}
+	record.Size = pos
+	return record, pos, nil
+}
+
+// innerDecoder creates the decoder of the decrypted application data
+func (p *tlsParser) innerDecoder(payload []byte) Decoder {
+	name := map[string]string{"h2": "http2", "http/1.1": "http"}[p.alpn]
+	if f, ok := lookupDecoder(name); ok {
+		return f.New(p.options)
+	}
+
+	decodersLock.RLock()
+	defer decodersLock.RUnlock()
+	if f, ok := sniffDecoder(model.ProtocolTCP, payload, "tls"); ok {
+		return f.New(p.options)
+	}
+	return nil
+}
+
+func (p *tlsParser) readRecord(side int, kind byte, body []byte, decrypted bool, record *message.TLSMessage) {
+	switch kind {
+	case tlsChangeCipherSpec:
+		record.Handshakes = append(record.Handshakes, "ChangeCipherSpec")
+		// TLS 1.3 only sends it for compatibility, its encrypted records are application data
+		if !p.tls13 {
+			p.encrypted[side] = true
+			p.keys[side].application = true
+		}
+	case tlsAlert:
+		if (p.encrypted[side] && !decrypted) || len(body) != 2 {
+			record.Alert = "encrypted"
+			return
+		}
+		level := "warning"
+		if body[0] == 2 {
+			level = "fatal"
+		}
+		description, ok := tlsAlertDescriptions[body[1]]
+		if !ok {
+			description = strconv.Itoa(int(body[1]))
+		}
+		record.Alert = level + " " + description
+	case tlsHandshake:
+		if p.encrypted[side] && !decrypted {
+			record.Handshakes = append(record.Handshakes, "EncryptedHandshake")
+			return
+		}
+		p.handshakes[side] = append(p.handshakes[side], body...)
+		p.readHandshakes(side, record)
+	case tlsApplicationData:
+		record.ApplicationData += len(body)
+	}
+}
+
+// readHandshakes decodes the complete handshake messages buffered for a side
+func (p *tlsParser) readHandshakes(side int, record *message.TLSMessage) {
+	data := p.handshakes[side]
+	for len(data) >= 4 {
+		length := int(data[1])<<16 | int(binary.BigEndian.Uint16(data[2:4]))
+		if length > maxTLSHandshakeSize {
+			data = nil
+			break
+		}
+		if len(data) < 4+length {
+			break
+		}
+		kind, body := data[0], data[4:4+length]
+		data = data[4+length:]
+
+		name, ok := tlsHandshakeTypes[kind]
+		if !ok {
+			name = fmt.Sprintf("Handshake(%d)", kind)
+		}
+		if (kind == tlsClientHello || kind == tlsServerHello) && len(body) >= 34 {
+			p.random[side] = append([]byte(nil), body[2:34]...)
+		}
+		r := &tlsReader{data: body}
+		switch kind {
+		case tlsClientHello:
+			readClientHello(r, record)
+		case tlsServerHello:
+			if p.readServerHello(r, record) {
+				name = "HelloRetryRequest"
+			}
+		case tlsEncryptedExtensions:
+			p.readEncryptedExtensions(r, record)
+		case tlsCertificate:
+			readCertificate(r, record, p.tls13)
+		case tlsFinished:
+			p.finishHandshake(side)
+		case tlsKeyUpdate:
+			p.updateKeys(side)
+		}
+		record.Handshakes = append(record.Handshakes, name)
+	}
+	if len(data) == 0 {
+		data = nil
+	}
+	p.handshakes[side] = data
+}
+
+// readClientHello takes the offered parameters and the JA3 fingerprint from a ClientHello
+func readClientHello(r *tlsReader, record *message.TLSMessage) {
+	version := r.uint16()
+	r.skip(32)  // random
+	r.vector(1) // session id
+	ciphers := r.vector(2).uint16s()
+	r.vector(1) // compression methods
+	if r.err != nil {
+		return
+	}
+	record.Version = tlsVersionName(version)
+	for _, c := range ciphers {
+		if !isGREASE(c) {
+			record.CipherSuites = append(record.CipherSuites, tls.CipherSuiteName(c))
+		}
+	}
+
+	var extensions, curves []uint16
+	var points []byte
+	ext := r.vector(2)
+	for len(ext.data) > 0 && ext.err == nil {
+		kind := ext.uint16()
+		body := ext.vector(2)
+		extensions = append(extensions, kind)
+		switch kind {
+		case tlsExtensionServerName:
+			names := body.vector(2)
+			for len(names.data) > 0 && names.err == nil {
+				nameType, name := names.byte(), names.vector(2)
+				if nameType == 0 && name.err == nil {
+					record.ServerName = string(name.data)
+				}
+			}
+		case tlsExtensionALPN:
+			record.ALPN = readALPN(body)
+		case tlsExtensionSupportedGroups:
+			curves = body.vector(2).uint16s()
+		case tlsExtensionECPointFormats:
+			points = body.vector(1).data
+		case tlsExtensionSupportedVersions:
+			for _, v := range body.vector(1).uint16s() {
+				if !isGREASE(v) {
+					record.SupportedVersions = append(record.SupportedVersions, tlsVersionName(v))
+				}
+			}
+		}
+	}
+
+	record.JA3 = strings.Join([]string{strconv.Itoa(int(version)), joinJA3(ciphers), joinJA3(extensions),
+		joinJA3(curves), joinJA3(bytesToUint16s(points))}, ",")
+	record.JA3Hash = md5Hex(record.JA3)
+}
+
+// readServerHello takes the selected parameters and the JA3S fingerprint from a ServerHello and reports whether
+// it is a HelloRetryRequest
+func (p *tlsParser) readServerHello(r *tlsReader, record *message.TLSMessage) bool {
+	version := r.uint16()
+	random := r.next(32)
+	r.vector(1) // session id
+	cipher := r.uint16()
+	r.skip(1) // compression method
+	if r.err != nil {
+		return false
+	}
+	retry := bytes.Equal(random, tlsHelloRetryRequest)
+	record.CipherSuite = tls.CipherSuiteName(cipher)
+	p.suite = nil
+	if suite, ok := tlsCipherSuites[cipher]; ok {
+		p.suite = &suite
+	}
+
+	selected := version
+	var extensions []uint16
+	ext := r.vector(2)
+	for len(ext.data) > 0 && ext.err == nil {
+		kind := ext.uint16()
+		body := ext.vector(2)
+		extensions = append(extensions, kind)
+		switch kind {
+		case tlsExtensionALPN:
+			record.ALPN = readALPN(body)
+			if len(record.ALPN) == 1 {
+				p.alpn = record.ALPN[0]
+			}
+		case tlsExtensionEncryptThenMAC:
+			p.etm = true
+		case tlsExtensionSupportedVersions:
+			if v := body.uint16(); body.err == nil {
+				selected = v
+			}
+		}
+	}
+	record.Version = tlsVersionName(selected)
+	if selected == tlsVersion13 {
+		p.tls13 = true
+		if !retry {
+			p.encrypted[1] = true
+		}
+	}
+
+	record.JA3S = strings.Join([]string{strconv.Itoa(int(version)), strconv.Itoa(int(cipher)), joinJA3(extensions)}, ",")
+	record.JA3SHash = md5Hex(record.JA3S)
+	return retry
+}
+
+// readEncryptedExtensions takes the application protocol the server selected in TLS 1.3
+func (p *tlsParser) readEncryptedExtensions(r *tlsReader, record *message.TLSMessage) {
+	ext := r.vector(2)
+	for len(ext.data) > 0 && ext.err == nil {
+		kind := ext.uint16()
+		body := ext.vector(2)
+		if kind == tlsExtensionALPN {
+			record.ALPN = readALPN(body)
+			if len(record.ALPN) == 1 {
+				p.alpn = record.ALPN[0]
+			}
+		}
+	}
+}
+
+// readCertificate decodes the first certificate of the chain, which is the one of the server
+func readCertificate(r *tlsReader, record *message.TLSMessage, tls13 bool) {
+	if tls13 {
+		r.vector(1) // certificate request context
+	}
+	chain := r.vector(3)
+	der := chain.vector(3)
+	if der.err != nil {
+		return
+	}
+	cert, err := x509.ParseCertificate(der.data)
+	if err != nil {
+		return
+	}
+	record.Certificate = &message.TLSCertificate{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		DNSNames:  cert.DNSNames,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+}
+
+func readALPN(r *tlsReader) []string {
+	var protocols []string
+	list := r.vector(2)
+	for len(list.data) > 0 && list.err == nil {
+		if protocol := list.vector(1); protocol.err == nil {
+			protocols = append(protocols, string(protocol.data))
+		}
+	}
+	return protocols
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersions[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// isGREASE reports whether a value is one of the reserved values clients send to keep servers tolerant,
+// JA3 leaves them out
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// joinJA3 joins values in decimal with dashes as JA3 does, leaving out GREASE values
+func joinJA3(values []uint16) string {
+	var parts []string
+	for _, v := range values {
+		if !isGREASE(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+func bytesToUint16s(data []byte) []uint16 {
+	values := make([]uint16, len(data))
+	for i, b := range data {
+		values[i] = uint16(b)
+	}
+	return values
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// tlsReader reads the fields of a handshake message, the first read beyond the data sets err
+type tlsReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tlsReader) next(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errInvalidTLS
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlsReader) skip(n int) {
+	r.next(n)
+}
+
+func (r *tlsReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *tlsReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// vector reads data prefixed by its length of lengthSize bytes into a reader, which fails when r did
+func (r *tlsReader) vector(lengthSize int) *tlsReader {
+	length := 0
+	for _, b := range r.next(lengthSize) {
+		length = length<<8 | int(b)
+	}
+	data := r.next(length)
+	return &tlsReader{data: data, err: r.err}
+}
+
+// uint16s reads the rest of the data as a list of 16 bit values
+func (r *tlsReader) uint16s() []uint16 {
+	var values []uint16
+	for len(r.data) >= 2 && r.err == nil {
+		values = append(values, r.uint16())
+	}
+	return values
+}
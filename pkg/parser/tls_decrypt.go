@@ -0,0 +1,356 @@
+package parser
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"golang.org/x/crypto/chacha20poly1305"
+	"hash"
+	"time"
+)
+
+// tlsCipherSuite describes how the records of a cipher suite are protected
+type tlsCipherSuite struct {
+	keySize int
+	// ivSize is the size of the fixed part of the nonce of AEAD suites, CBC suites send the IV with each record
+	ivSize int
+	// chacha is set for ChaCha20-Poly1305 suites, all others use AES
+	chacha bool
+	// macSize is set for CBC suites
+	macSize int
+	// hash is used by the PRF of TLS 1.2 and the HKDF of TLS 1.3
+	hash func() hash.Hash
+}
+
+var tlsCipherSuites = map[uint16]tlsCipherSuite{
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            {keySize: 16, macSize: 20, hash: sha256.New},
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            {keySize: 32, macSize: 20, hash: sha256.New},
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         {keySize: 16, macSize: 32, hash: sha256.New},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    {keySize: 16, macSize: 20, hash: sha256.New},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    {keySize: 32, macSize: 20, hash: sha256.New},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      {keySize: 16, macSize: 20, hash: sha256.New},
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      {keySize: 32, macSize: 20, hash: sha256.New},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: {keySize: 16, macSize: 32, hash: sha256.New},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   {keySize: 16, macSize: 32, hash: sha256.New},
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         {keySize: 16, ivSize: 4, hash: sha256.New},
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         {keySize: 32, ivSize: 4, hash: sha512.New384},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: {keySize: 16, ivSize: 4, hash: sha256.New},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: {keySize: 32, ivSize: 4, hash: sha512.New384},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   {keySize: 16, ivSize: 4, hash: sha256.New},
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   {keySize: 32, ivSize: 4, hash: sha512.New384},
+	tls.TLS_AES_128_GCM_SHA256:                  {keySize: 16, ivSize: 12, hash: sha256.New},
+	tls.TLS_AES_256_GCM_SHA384:                  {keySize: 32, ivSize: 12, hash: sha512.New384},
+
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   {keySize: 32, ivSize: 12, chacha: true, hash: sha256.New},
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: {keySize: 32, ivSize: 12, chacha: true, hash: sha256.New},
+	tls.TLS_CHACHA20_POLY1305_SHA256:                  {keySize: 32, ivSize: 12, chacha: true, hash: sha256.New},
+}
+
+// tlsKeys are the keys protecting the records sent by one side of a connection
+type tlsKeys struct {
+	// application is set once the side protects its records with the keys of the application data, in TLS 1.2
+	// after ChangeCipherSpec, in TLS 1.3 after its Finished
+	application bool
+	// handshake and traffic are derived from the key log when a record needs them
+	handshake *tlsRecordCipher
+	traffic   *tlsRecordCipher
+	// updates counts the KeyUpdate messages of TLS 1.3 applied to the first traffic secret
+	updates int
+	// seq is the sequence number of the next record, also counted for records which could not be decrypted
+	seq uint64
+}
+
+// tlsOpened is the content of a protected record
+type tlsOpened struct {
+	kind      byte
+	data      []byte
+	decrypted bool
+	// application is set when a TLS 1.3 record of a side still in the handshake was decrypted with the traffic
+	// keys, which happens when the handshake secrets are missing
+	application bool
+}
+
+// protected reports whether a record sent by side goes through the record protection
+func (p *tlsParser) protected(side int, kind byte) bool {
+	if p.tls13 {
+		return kind == tlsApplicationData
+	}
+	return p.keys[side].application
+}
+
+// open decrypts a protected record without changing the state, commit accounts for the record when it is used
+func (p *tlsParser) open(side int, header, body []byte) tlsOpened {
+	opened := tlsOpened{kind: header[0], data: body}
+	keys := &p.keys[side]
+	if c := p.recordCipher(side, keys.application); c != nil {
+		if kind, data, err := c.open(keys.seq, header, body); err == nil {
+			return tlsOpened{kind: kind, data: data, decrypted: true}
+		}
+	}
+	if p.tls13 && !keys.application {
+		if c := p.recordCipher(side, true); c != nil {
+			if kind, data, err := c.open(0, header, body); err == nil {
+				return tlsOpened{kind: kind, data: data, decrypted: true, application: true}
+			}
+		}
+	}
+	return opened
+}
+
+func (p *tlsParser) commit(side int, opened tlsOpened) {
+	keys := &p.keys[side]
+	if opened.application {
+		keys.application, keys.seq = true, 0
+	}
+	keys.seq++
+}
+
+// finishHandshake switches a side of TLS 1.3 to the traffic keys after its Finished
+func (p *tlsParser) finishHandshake(side int) {
+	if keys := &p.keys[side]; p.tls13 && !keys.application {
+		keys.application, keys.seq = true, 0
+	}
+}
+
+// updateKeys switches a side of TLS 1.3 to the next traffic keys after its KeyUpdate
+func (p *tlsParser) updateKeys(side int) {
+	if keys := &p.keys[side]; p.tls13 && keys.application {
+		keys.updates++
+		keys.traffic, keys.seq = nil, 0
+	}
+}
+
+// recordCipher returns the handshake or traffic keys of a side, nil while they cannot be derived
+func (p *tlsParser) recordCipher(side int, application bool) *tlsRecordCipher {
+	keys := &p.keys[side]
+	if p.suite == nil || len(p.random[0]) == 0 || len(p.random[1]) == 0 {
+		return nil
+	}
+	if !p.tls13 {
+		if keys.traffic == nil {
+			p.deriveTLS12Keys()
+		}
+		return keys.traffic
+	}
+
+	if !application {
+		if keys.handshake == nil {
+			label := tlsKeyLogClientHandshakeSecret
+			if side == 1 {
+				label = tlsKeyLogServerHandshakeSecret
+			}
+			if secret := p.secret(label); secret != nil {
+				keys.handshake = newTLS13RecordCipher(p.suite, secret)
+			}
+		}
+		return keys.handshake
+	}
+	if keys.traffic == nil {
+		label := tlsKeyLogClientApplicationSecret
+		if side == 1 {
+			label = tlsKeyLogServerApplicationSecret
+		}
+		if secret := p.secret(label); secret != nil {
+			for i := 0; i < keys.updates; i++ {
+				secret = hkdfExpandLabel(p.suite.hash, secret, "traffic upd", len(secret))
+			}
+			keys.traffic = newTLS13RecordCipher(p.suite, secret)
+		}
+	}
+	return keys.traffic
+}
+
+// secret looks up the secret logged with label for the connection, a secret which was not found is looked up
+// again once the key log may have been read again
+func (p *tlsParser) secret(label string) []byte {
+	if p.options.TLSKeyLog == nil {
+		return nil
+	}
+	if missed, ok := p.missed[label]; ok && time.Since(missed) < tlsKeyLogCheckInterval {
+		return nil
+	}
+	secret := p.options.TLSKeyLog.secret(label, p.random[0])
+	if secret == nil {
+		if p.missed == nil {
+			p.missed = make(map[string]time.Time)
+		}
+		p.missed[label] = time.Now()
+	}
+	return secret
+}
+
+// deriveTLS12Keys expands the master secret of TLS 1.2 into the keys of both sides
+func (p *tlsParser) deriveTLS12Keys() {
+	master := p.secret(tlsKeyLogClientRandom)
+	if master == nil {
+		return
+	}
+	suite := p.suite
+	seed := append(append([]byte(nil), p.random[1]...), p.random[0]...)
+	block := tlsPRF(suite.hash, master, "key expansion", seed, 2*(suite.macSize+suite.keySize+suite.ivSize))
+
+	macs := 2 * suite.macSize
+	keys := block[macs : macs+2*suite.keySize]
+	ivs := block[macs+2*suite.keySize:]
+	for side := range p.keys {
+		key := keys[side*suite.keySize : (side+1)*suite.keySize]
+		iv := ivs[side*suite.ivSize : (side+1)*suite.ivSize]
+		p.keys[side].traffic = newTLS12RecordCipher(suite, key, iv, p.etm)
+	}
+}
+
+// tlsRecordCipher decrypts the records protected with one key
+type tlsRecordCipher struct {
+	aead  cipher.AEAD
+	block cipher.Block
+	iv    []byte
+	// macSize and etm are set for CBC suites, the MAC is not verified
+	macSize int
+	etm     bool
+	tls13   bool
+}
+
+func newTLS12RecordCipher(suite *tlsCipherSuite, key, iv []byte, etm bool) *tlsRecordCipher {
+	c := &tlsRecordCipher{iv: iv, macSize: suite.macSize, etm: etm}
+	var err error
+	if suite.chacha {
+		if c.aead, err = chacha20poly1305.New(key); err != nil {
+			return nil
+		}
+		return c
+	}
+	if c.block, err = aes.NewCipher(key); err != nil {
+		return nil
+	}
+	if suite.macSize == 0 {
+		if c.aead, err = cipher.NewGCM(c.block); err != nil {
+			return nil
+		}
+	}
+	return c
+}
+
+func newTLS13RecordCipher(suite *tlsCipherSuite, secret []byte) *tlsRecordCipher {
+	key := hkdfExpandLabel(suite.hash, secret, "key", suite.keySize)
+	var aead cipher.AEAD
+	var err error
+	if suite.chacha {
+		aead, err = chacha20poly1305.New(key)
+	} else if block, blockErr := aes.NewCipher(key); blockErr != nil {
+		err = blockErr
+	} else {
+		aead, err = cipher.NewGCM(block)
+	}
+	if err != nil {
+		return nil
+	}
+	return &tlsRecordCipher{aead: aead, iv: hkdfExpandLabel(suite.hash, secret, "iv", suite.ivSize), tls13: true}
+}
+
+// nonce is the fixed IV combined with the sequence number, as used by TLS 1.3 and the ChaCha20-Poly1305 suites
+func (c *tlsRecordCipher) nonce(sequence [8]byte) []byte {
+	nonce := append([]byte(nil), c.iv...)
+	for i := range sequence {
+		nonce[len(nonce)-8+i] ^= sequence[i]
+	}
+	return nonce
+}
+
+// open decrypts the record with the sequence number seq and returns its content type and plaintext
+func (c *tlsRecordCipher) open(seq uint64, header, body []byte) (byte, []byte, error) {
+	var sequence [8]byte
+	binary.BigEndian.PutUint64(sequence[:], seq)
+
+	if c.tls13 {
+		plaintext, err := c.aead.Open(nil, c.nonce(sequence), body, header)
+		if err != nil {
+			return 0, nil, err
+		}
+		// the content type follows the content and is followed by padding
+		for i := len(plaintext) - 1; i >= 0; i-- {
+			if plaintext[i] != 0 {
+				return plaintext[i], plaintext[:i], nil
+			}
+		}
+		return 0, nil, errInvalidTLS
+	}
+
+	if c.aead != nil {
+		// AES-GCM sends the rest of the nonce with each record, ChaCha20-Poly1305 has the whole nonce as IV
+		explicit := c.aead.NonceSize() - len(c.iv)
+		if len(body) < explicit+c.aead.Overhead() {
+			return 0, nil, errInvalidTLS
+		}
+		nonce := append(append([]byte(nil), c.iv...), body[:explicit]...)
+		if explicit == 0 {
+			nonce = c.nonce(sequence)
+		}
+		additional := append(sequence[:], header[:3]...)
+		additional = binary.BigEndian.AppendUint16(additional, uint16(len(body)-explicit-c.aead.Overhead()))
+		plaintext, err := c.aead.Open(nil, nonce, body[explicit:], additional)
+		return header[0], plaintext, err
+	}
+
+	if c.etm {
+		if len(body) < c.macSize {
+			return 0, nil, errInvalidTLS
+		}
+		body = body[:len(body)-c.macSize]
+	}
+	size := c.block.BlockSize()
+	if len(body) < 2*size || len(body)%size != 0 {
+		return 0, nil, errInvalidTLS
+	}
+	plaintext := make([]byte, len(body)-size)
+	cipher.NewCBCDecrypter(c.block, body[:size]).CryptBlocks(plaintext, body[size:])
+	trailer := int(plaintext[len(plaintext)-1]) + 1
+	if !c.etm {
+		trailer += c.macSize
+	}
+	if trailer > len(plaintext) {
+		return 0, nil, errInvalidTLS
+	}
+	return header[0], plaintext[:len(plaintext)-trailer], nil
+}
+
+// tlsPRF is the pseudorandom function of TLS 1.2
+func tlsPRF(h func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	result := make([]byte, 0, length+mac.Size())
+	a := seed
+	for len(result) < length {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		result = mac.Sum(result)
+	}
+	return result[:length]
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = append(append(append(info, byte(len(label))), label...), 0)
+
+	mac := hmac.New(h, secret)
+	result := make([]byte, 0, length+mac.Size())
+	var t []byte
+	for i := byte(1); len(result) < length; i++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		result = append(result, t...)
+	}
+	return result[:length]
+}
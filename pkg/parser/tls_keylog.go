@@ -0,0 +1,116 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// labels of the secrets in a key log file
+const (
+	tlsKeyLogClientRandom            = "CLIENT_RANDOM"
+	tlsKeyLogClientHandshakeSecret   = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	tlsKeyLogServerHandshakeSecret   = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	tlsKeyLogClientApplicationSecret = "CLIENT_TRAFFIC_SECRET_0"
+	tlsKeyLogServerApplicationSecret = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// tlsKeyLogCheckInterval is how often a key log file is checked for new secrets at most
+const tlsKeyLogCheckInterval = 100 * time.Millisecond
+
+// TLSKeyLog holds the secrets of an NSS key log file, secrets are looked up by the client random of a connection
+// and the file is only read again when a connection needs secrets which were not found
+type TLSKeyLog struct {
+	lock sync.Mutex
+	// path, offset and modTime remember how much of the file was read, clients only append to it
+	path    string
+	offset  int64
+	modTime time.Time
+	// checked is when the file was checked for new secrets last
+	checked time.Time
+	secrets map[string][]byte
+}
+
+// LoadTLSKeyLog reads a key log file in the NSS format, as written by browsers and other clients when SSLKEYLOGFILE
+// is set, the TLS decoder decrypts the connections it has secrets for. The file may not exist yet
+func LoadTLSKeyLog(path string) (*TLSKeyLog, error) {
+	k := &TLSKeyLog{path: path, secrets: make(map[string][]byte)}
+	if err := k.read(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return k, nil
+}
+
+// secret returns the secret logged with label for the connection with the client random, nil if it is unknown
+func (k *TLSKeyLog) secret(label string, clientRandom []byte) []byte {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	key := label + " " + string(clientRandom)
+	if secret, ok := k.secrets[key]; ok {
+		return secret
+	}
+	if now := time.Now(); now.Sub(k.checked) >= tlsKeyLogCheckInterval {
+		k.checked = now
+		// a file which cannot be read now is tried again with a later lookup
+		_ = k.read()
+	}
+	return k.secrets[key]
+}
+
+// read adds the lines appended to a file since it was read last, the whole file is read again when it got shorter
+func (k *TLSKeyLog) read() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	if info.Size() < k.offset {
+		k.offset = 0
+	} else if info.Size() == k.offset && info.ModTime().Equal(k.modTime) {
+		return nil
+	}
+
+	file, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	if _, err = file.Seek(k.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	// a line still being written is read the next time
+	end := bytes.LastIndexByte(data, '\n') + 1
+	for _, line := range strings.Split(string(data[:end]), "\n") {
+		k.add(line)
+	}
+	k.offset += int64(end)
+	k.modTime = info.ModTime()
+	return nil
+}
+
+// add parses a line of the form <label> <client random> <secret>, comments and unknown lines are ignored
+func (k *TLSKeyLog) add(line string) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+		return
+	}
+	clientRandom, err := hex.DecodeString(fields[1])
+	if err != nil || len(clientRandom) != 32 {
+		return
+	}
+	secret, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return
+	}
+	k.secrets[fields[0]+" "+string(clientRandom)] = secret
+}
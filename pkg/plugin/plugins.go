@@ -43,14 +43,25 @@ func (plugins *InOutPlugins) registerPlugin(constructor interface{}, options ...
 }
 
 // InitPlugins specify and initialize all available plugins
-func InitPlugins(inputConfig []model.InputConfig) *InOutPlugins {
+func InitPlugins(inputConfig []model.InputConfig, outputConfig []model.OutputConfig) *InOutPlugins {
 	plugins := new(InOutPlugins)
 
 	for _, i := range inputConfig {
-		plugins.registerPlugin(input.NewIPInput, i.Address)
+		plugins.registerPlugin(input.NewIPInput, i)
 	}
 
-	plugins.registerPlugin(output.NewStdOutput)
+	for _, o := range outputConfig {
+		switch o.Type {
+		case model.OutputTypeStdout:
+			plugins.registerPlugin(output.NewStdOutput)
+		case model.OutputTypePcap:
+			plugins.registerPlugin(output.NewPcapOutput, o.Pcap)
+		case model.OutputTypeJSON:
+			plugins.registerPlugin(output.NewJSONOutput, o.JSON)
+		case model.OutputTypeReplay:
+			plugins.registerPlugin(output.NewReplayOutput, o.Replay)
+		}
+	}
 
 	return plugins
 }
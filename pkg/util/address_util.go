@@ -0,0 +1,83 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"net-capture/pkg/model"
+	"strconv"
+	"strings"
+)
+
+// ParseInputAddress parses an input address like tcp://127.0.0.1:6666, [::1]:6666 or :8080,8443,9000-9010,
+// without a protocol prefix both tcp and udp are captured and port 0 captures all ports
+func ParseInputAddress(address string) (*model.InputAddress, error) {
+	addr := new(model.InputAddress)
+
+	if protocol, rest, found := strings.Cut(address, "://"); found {
+		switch protocol {
+		case model.ProtocolTCP, model.ProtocolUDP:
+		default:
+			return nil, fmt.Errorf("input address protocol %q not supported, only tcp or udp", protocol)
+		}
+		addr.Protocol = protocol
+		address = rest
+	}
+
+	if !strings.Contains(address, ":") {
+		return nil, fmt.Errorf("input address must contains port")
+	}
+
+	// IPv6 hosts have to be written in brackets like [::1]:6666
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("input address is not valid: %w", err)
+	}
+
+	if host != "" && host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("input address host not valid")
+		}
+		host = ip.String()
+	}
+
+	if port == "" {
+		return nil, fmt.Errorf("input address must contains port")
+	}
+
+	ports, err := parsePorts(port)
+	if err != nil {
+		return nil, err
+	}
+
+	addr.Host = host
+	addr.Ports = ports
+	return addr, nil
+}
+
+// parsePorts parses a comma separated list of ports and port ranges like 8080,8443,9000-9010
+func parsePorts(list string) (model.Ports, error) {
+	var ports model.Ports
+	for _, item := range strings.Split(list, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		if !isRange {
+			to = from
+		}
+
+		fromNum, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("input address port %q not valid", item)
+		}
+		toNum, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || toNum < fromNum {
+			return nil, fmt.Errorf("input address port %q not valid", item)
+		}
+
+		r := model.PortRange{From: uint16(fromNum), To: uint16(toNum)}
+		if !isRange && r.From == 0 {
+			r.To = 1<<16 - 1
+		}
+		ports = append(ports, r)
+	}
+	return ports, nil
+}
@@ -2,14 +2,17 @@ package util
 
 import (
 	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
 	"github.com/knadh/koanf"
 	"github.com/knadh/koanf/parsers/yaml"
 	"github.com/knadh/koanf/providers/file"
 	"net"
 	"net-capture/pkg/model"
+	"net-capture/pkg/parser"
+	"os"
 	"path"
 	"path/filepath"
-	"strings"
 )
 
 func GetConfig(configFile string) (*model.Config, error) {
@@ -23,6 +26,10 @@ func GetConfig(configFile string) (*model.Config, error) {
 		return nil, err
 	}
 
+	if err = checkOutput(&config); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
@@ -65,35 +72,112 @@ func checkInput(input []model.InputConfig) error {
 			return fmt.Errorf("input address cannot be empty")
 		}
 
-		parts := strings.Split(i.Address, ":")
-		if len(parts) > 2 {
-			return fmt.Errorf("input address is not valid")
+		if _, err := ParseInputAddress(i.Address); err != nil {
+			return err
+		}
+
+		if i.File != "" {
+			if _, err := os.Stat(i.File); err != nil {
+				return fmt.Errorf("input file not accessible: %w", err)
+			}
 		}
 
-		host := parts[0]
-		port := ""
+		if i.BPFFilter != "" {
+			if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 65535, i.BPFFilter); err != nil {
+				return fmt.Errorf("input bpf_filter %q not valid: %w", i.BPFFilter, err)
+			}
+		}
 
-		if len(parts) == 2 {
-			port = parts[1]
+		for _, d := range i.Decoders {
+			if !parser.HasDecoder(d.Name) {
+				return fmt.Errorf("input decoder %q not supported", d.Name)
+			}
+			if len(d.Ports) == 0 {
+				return fmt.Errorf("input decoder %q must have ports", d.Name)
+			}
 		}
 
-		if host != "" {
-			if host != "localhost" && !isIP(host) {
-				return fmt.Errorf("input address host not valid")
+		for _, descriptors := range i.GRPCDescriptors {
+			if _, err := os.Stat(descriptors); err != nil {
+				return fmt.Errorf("input grpc descriptors: %w", err)
 			}
 		}
 
-		if port == "" {
-			return fmt.Errorf("input address must contains port")
+		// the key log may be created later by the client
+		if i.TLSKeyLog != "" {
+			if info, err := os.Stat(i.TLSKeyLog); err == nil && info.IsDir() {
+				return fmt.Errorf("input tls_keylog %s is a directory", i.TLSKeyLog)
+			}
+		}
+	}
+
+	return nil
+}
+
+func checkOutput(config *model.Config) error {
+	// print to the console as before when no output is configured
+	if len(config.Output) == 0 {
+		config.Output = []model.OutputConfig{{Type: model.OutputTypeStdout}}
+		return nil
+	}
+
+	for _, o := range config.Output {
+		switch o.Type {
+		case model.OutputTypeStdout:
+		case model.OutputTypePcap:
+			if err := checkPcapOutput(o.Pcap); err != nil {
+				return err
+			}
+		case model.OutputTypeJSON:
+			if err := checkJSONOutput(o.JSON); err != nil {
+				return err
+			}
+		case model.OutputTypeReplay:
+			if err := checkReplayOutput(o.Replay); err != nil {
+				return err
+			}
+		case "":
+			return fmt.Errorf("output type cannot be empty")
+		default:
+			return fmt.Errorf("output type %q not supported", o.Type)
 		}
 	}
 
 	return nil
 }
 
-func isIP(ip string) bool {
-	if net.ParseIP(ip) == nil {
-		return false
+func checkPcapOutput(config model.PcapOutputConfig) error {
+	if config.Path == "" {
+		return fmt.Errorf("pcap output path cannot be empty")
+	}
+
+	if config.Format != "" && config.Format != "pcap" && config.Format != "pcapng" {
+		return fmt.Errorf("pcap output format only supports pcap or pcapng")
 	}
-	return true
+
+	if config.MaxSize < 0 || config.RotateInterval < 0 || config.MaxFiles < 0 {
+		return fmt.Errorf("pcap output max_size, rotate_interval and max_files cannot be negative")
+	}
+
+	return nil
+}
+
+func checkJSONOutput(config model.JSONOutputConfig) error {
+	switch config.PayloadEncoding {
+	case "", "auto", "text", "base64":
+		return nil
+	}
+	return fmt.Errorf("json output payload_encoding only supports auto, text or base64")
+}
+
+func checkReplayOutput(config model.ReplayOutputConfig) error {
+	if _, port, err := net.SplitHostPort(config.Target); err != nil || port == "" {
+		return fmt.Errorf("replay output target must be host:port")
+	}
+
+	if config.Rate < 0 || config.Timeout < 0 {
+		return fmt.Errorf("replay output rate and timeout cannot be negative")
+	}
+
+	return nil
 }
@@ -0,0 +1,38 @@
+package test
+
+import (
+	"net-capture/pkg/model"
+	"net-capture/pkg/util"
+	"reflect"
+	"testing"
+)
+
+func TestParseInputAddress(t *testing.T) {
+	cases := map[string]model.InputAddress{
+		":6666":                 {Ports: model.Ports{{From: 6666, To: 6666}}},
+		"127.0.0.1:7777":        {Host: "127.0.0.1", Ports: model.Ports{{From: 7777, To: 7777}}},
+		"tcp://:6666":           {Protocol: "tcp", Ports: model.Ports{{From: 6666, To: 6666}}},
+		"udp://127.0.0.1:7777":  {Protocol: "udp", Host: "127.0.0.1", Ports: model.Ports{{From: 7777, To: 7777}}},
+		":8080,8443,9000-9010":  {Ports: model.Ports{{From: 8080, To: 8080}, {From: 8443, To: 8443}, {From: 9000, To: 9010}}},
+		":0":                    {Ports: model.Ports{{From: 0, To: 65535}}},
+		"[::1]:6666":            {Host: "::1", Ports: model.Ports{{From: 6666, To: 6666}}},
+		"tcp://[::]:8080,8443":  {Protocol: "tcp", Host: "::", Ports: model.Ports{{From: 8080, To: 8080}, {From: 8443, To: 8443}}},
+		"[fd00:0::2]:9000-9010": {Host: "fd00::2", Ports: model.Ports{{From: 9000, To: 9010}}},
+	}
+	for address, expected := range cases {
+		addr, err := util.ParseInputAddress(address)
+		if err != nil {
+			t.Errorf("%s: %v", address, err)
+			continue
+		}
+		if !reflect.DeepEqual(*addr, expected) {
+			t.Errorf("%s: expected %+v, got %+v", address, expected, *addr)
+		}
+	}
+
+	for _, address := range []string{"sctp://:6666", "127.0.0.1", "example.com:80", ":port", ":70000", ":9010-9000", ":8080,", "::1:6666", "[::1]", "[::1:6666", "[fd00::zz]:80"} {
+		if _, err := util.ParseInputAddress(address); err == nil {
+			t.Errorf("%s: expected an error", address)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"net-capture/pkg/model"
+	"net-capture/pkg/util"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfig stores the yaml content in a temporary config file and returns its path
+func writeConfig(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestConfigOutput(t *testing.T) {
+	config, err := util.GetConfig(writeConfig(t, `
+input:
+  - address: :6666
+output:
+  - type: stdout
+  - type: pcap
+    pcap:
+      path: ./capture.pcapng
+      format: pcapng
+      rotate_interval: 1h
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Output) != 2 || config.Output[1].Type != model.OutputTypePcap {
+		t.Fatalf("unexpected outputs %+v", config.Output)
+	}
+	if config.Output[1].Pcap.Format != "pcapng" || config.Output[1].Pcap.RotateInterval.Hours() != 1 {
+		t.Errorf("unexpected pcap options %+v", config.Output[1].Pcap)
+	}
+}
+
+func TestConfigDefaultOutput(t *testing.T) {
+	config, err := util.GetConfig(writeConfig(t, `
+input:
+  - address: :6666
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Output) != 1 || config.Output[0].Type != model.OutputTypeStdout {
+		t.Errorf("expected stdout to be the default output, got %+v", config.Output)
+	}
+}
+
+func TestConfigInvalidOutput(t *testing.T) {
+	for _, content := range []string{
+		"input:\n  - address: :6666\noutput:\n  - type: unknown\n",
+		"input:\n  - address: :6666\noutput:\n  - type: pcap\n",
+		"input:\n  - address: :6666\noutput:\n  - type: pcap\n    pcap:\n      path: a.pcap\n      format: cap\n",
+	} {
+		if _, err := util.GetConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("expected an error for config:\n%s", content)
+		}
+	}
+}
+
+func TestConfigDecoders(t *testing.T) {
+	config, err := util.GetConfig(writeConfig(t, `
+input:
+  - address: :8080
+    decoders:
+      - name: http
+        ports: [8080, 8081]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoders := config.Input[0].Decoders; len(decoders) != 1 || decoders[0].Name != "http" || len(decoders[0].Ports) != 2 {
+		t.Errorf("unexpected decoders %+v", decoders)
+	}
+
+	if _, err := util.GetConfig(writeConfig(t, "input:\n  - address: :8080\n    decoders:\n      - name: unknown\n        ports: [8080]\n")); err == nil {
+		t.Errorf("expected an error for an unknown decoder")
+	}
+}
@@ -0,0 +1,71 @@
+package test
+
+import (
+	"net-capture/pkg/message"
+	"net-capture/pkg/parser"
+	"testing"
+)
+
+// lineRecord is the record of lineDecoder, one line of text
+type lineRecord struct {
+	Line string `json:"line"`
+}
+
+func (r *lineRecord) Protocol() string {
+	return "line"
+}
+
+func (r *lineRecord) String() string {
+	return r.Line
+}
+
+// lineDecoder decodes every message into a single lineRecord
+type lineDecoder struct{}
+
+func (d *lineDecoder) Decode(_ int, msg *message.NetMessage, _ bool) []*message.NetMessage {
+	if len(msg.Payload) == 0 {
+		return nil
+	}
+	msg.Record = &lineRecord{Line: string(msg.Payload)}
+	return []*message.NetMessage{msg}
+}
+
+func init() {
+	parser.RegisterDecoder(parser.DecoderFactory{
+		Name:  "line",
+		Ports: []uint16{7070},
+		New: func(parser.DecoderOptions) parser.Decoder {
+			return &lineDecoder{}
+		},
+	})
+}
+
+func TestDecoderClaimsFlowByPort(t *testing.T) {
+	conn := newTCPConn(7070)
+	messages := parsePackets(7070, conn.client(0, "hello"), conn.server(0, "world"))
+
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	for _, msg := range messages {
+		if record, ok := msg.Record.(*lineRecord); !ok || record.Line != string(msg.Payload) {
+			t.Errorf("message was not decoded by the line decoder: %+v", msg.Record)
+		}
+	}
+}
+
+func TestForcedDecoder(t *testing.T) {
+	conn := newTCPConn(8080)
+	forceLine := func(p *parser.MessageParser) { p.ForceDecoders(map[uint16]string{8080: "line"}) }
+	messages := parsePacketsWith(forceLine, 8080, conn.client(0, "GET / HTTP/1.1\r\n\r\n"))
+	if len(messages) != 1 || messages[0].Record == nil || messages[0].Record.Protocol() != "line" {
+		t.Errorf("expected the forced line decoder to claim the flow")
+	}
+
+	conn = newTCPConn(8080)
+	forceRaw := func(p *parser.MessageParser) { p.ForceDecoders(map[uint16]string{8080: parser.DecoderRaw}) }
+	messages = parsePacketsWith(forceRaw, 8080, conn.client(0, "GET / HTTP/1.1\r\n\r\n"))
+	if len(messages) != 1 || messages[0].Record != nil {
+		t.Errorf("expected the flow to stay undecoded")
+	}
+}
@@ -0,0 +1,112 @@
+package test
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"net-capture/pkg/message"
+	"testing"
+	"time"
+)
+
+func dnsPayload(t *testing.T, dns *layers.DNS) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func dnsQueryAndAnswer(t *testing.T) ([]byte, []byte) {
+	question := layers.DNSQuestion{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}
+	query := dnsPayload(t, &layers.DNS{ID: 0x1234, RD: true, Questions: []layers.DNSQuestion{question}})
+	answer := dnsPayload(t, &layers.DNS{
+		ID: 0x1234, QR: true, RD: true, RA: true, ResponseCode: layers.DNSResponseCodeNoErr,
+		Questions: []layers.DNSQuestion{question},
+		Answers: []layers.DNSResourceRecord{{
+			Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 300, IP: net.IP{93, 184, 216, 34},
+		}},
+	})
+	return query, answer
+}
+
+// udpPacket builds a datagram between clientIP:40000 and serverIP:53 sent at the given time
+func udpPacket(fromClient bool, payload []byte, timestamp time.Time) gopacket.Packet {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: clientIP, DstIP: serverIP}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	if !fromClient {
+		ip.SrcIP, ip.DstIP = serverIP, clientIP
+		udp.SrcPort, udp.DstPort = udp.DstPort, udp.SrcPort
+	}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+	_ = gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(payload))
+
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+	packet.Metadata().Timestamp = timestamp
+	packet.Metadata().CaptureLength = len(buf.Bytes())
+	packet.Metadata().Length = len(buf.Bytes())
+	return packet
+}
+
+func dnsRecords(t *testing.T, messages []*message.NetMessage) []*message.DNSMessage {
+	var records []*message.DNSMessage
+	for _, msg := range messages {
+		record, ok := msg.Record.(*message.DNSMessage)
+		if !ok {
+			t.Fatalf("message was not decoded as dns: %q", msg.Payload)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestDNSOverUDP(t *testing.T) {
+	query, answer := dnsQueryAndAnswer(t)
+	sent := time.Unix(1700000000, 0)
+	records := dnsRecords(t, parsePackets(53,
+		udpPacket(true, query, sent),
+		udpPacket(false, answer, sent.Add(15*time.Millisecond)),
+	))
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	q, a := records[0], records[1]
+	if q.Response || q.ID != 0x1234 || len(q.Questions) != 1 || q.Questions[0].Name != "example.com" || q.Questions[0].Type != "A" {
+		t.Errorf("unexpected query %+v", q)
+	}
+	if !a.Response || a.RCode != "NOERROR" || len(a.Answers) != 1 || a.Answers[0].Data != "93.184.216.34" || a.Answers[0].TTL != 300 {
+		t.Errorf("unexpected response %+v", a)
+	}
+	if a.LatencyMs != 15 {
+		t.Errorf("expected a latency of 15ms, got %f", a.LatencyMs)
+	}
+}
+
+func TestDNSOverTCP(t *testing.T) {
+	query, answer := dnsQueryAndAnswer(t)
+	withLength := func(data []byte) string {
+		prefix := make([]byte, 2)
+		binary.BigEndian.PutUint16(prefix, uint16(len(data)))
+		return string(prefix) + string(data)
+	}
+
+	c := &conversation{conn: newTCPConn(53)}
+	request := withLength(query)
+	c.send(true, request[:5])
+	c.send(true, request[5:])
+	c.send(false, withLength(answer))
+
+	records := dnsRecords(t, parsePackets(53, c.packets...))
+	if len(records) != 2 || records[0].Response || !records[1].Response || records[1].Answers[0].Data != "93.184.216.34" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	if records[1].LatencyMs <= 0 {
+		t.Errorf("expected a latency, got %f", records[1].LatencyMs)
+	}
+}
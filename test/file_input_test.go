@@ -0,0 +1,80 @@
+package test
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"net"
+	"net-capture/pkg/input"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePcap stores packets in a pcap file and returns its path
+func writePcap(t *testing.T, packets ...gopacket.Packet) string {
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	w := pcapgo.NewWriter(f)
+	if err = w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for _, packet := range packets {
+		if err = w.WritePacket(packet.Metadata().CaptureInfo, packet.Data()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestFileInputRealtime(t *testing.T) {
+	c := &conversation{conn: newTCPConn(8080)}
+	c.send(true, "GET /offline HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	// the response was captured 200ms after the request
+	c.conn.timestamp = c.conn.timestamp.Add(200 * time.Millisecond)
+	c.send(false, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	other := newTCPConn(8080)
+	other.clientIP = net.IP{10, 0, 0, 3}
+	packets := append(c.packets, other.client(0, "GET /filtered HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	path := writePcap(t, packets...)
+
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		t.Skipf("libpcap cannot read pcap files: %v", err)
+	}
+	handle.Close()
+
+	start := time.Now()
+	in := input.NewIPInput(model.InputConfig{Address: serverIP.String() + ":8080", File: path, Realtime: true, BPFFilter: "not host 10.0.0.3"})
+	var messages []*message.NetMessage
+	for {
+		msg, err := in.PluginRead()
+		if errors.Is(err, input.ErrorStopped) {
+			break
+		}
+		messages = append(messages, msg)
+	}
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("packets were not paced, reading took %s", elapsed)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if request, ok := messages[0].Record.(*message.HTTPMessage); !ok || request.URL != "/offline" || !messages[0].Request {
+		t.Errorf("unexpected request %q", messages[0].Payload)
+	}
+	if response, ok := messages[1].Record.(*message.HTTPMessage); !ok || response.StatusCode != 200 || string(response.Body) != "ok" {
+		t.Errorf("unexpected response %q", messages[1].Payload)
+	}
+}
@@ -0,0 +1,234 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"net-capture/pkg/message"
+	"net-capture/pkg/parser"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// http2Side writes the frames sent by one side of a connection, its header blocks share one HPACK table
+type http2Side struct {
+	buf     bytes.Buffer
+	framer  *http2.Framer
+	headers bytes.Buffer
+	encoder *hpack.Encoder
+}
+
+func newHTTP2Side() *http2Side {
+	s := &http2Side{}
+	s.framer = http2.NewFramer(&s.buf, nil)
+	s.encoder = hpack.NewEncoder(&s.headers)
+	return s
+}
+
+func (s *http2Side) writeHeaders(streamID uint32, endStream bool, fields ...string) {
+	s.headers.Reset()
+	for i := 0; i+1 < len(fields); i += 2 {
+		_ = s.encoder.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	_ = s.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: s.headers.Bytes(),
+		EndStream:     endStream,
+		EndHeaders:    true,
+	})
+}
+
+// flush returns the frames written since the last flush
+func (s *http2Side) flush() string {
+	data := s.buf.String()
+	s.buf.Reset()
+	return data
+}
+
+// grpcFrame prefixes a protobuf message with the gRPC compression flag and length
+func grpcFrame(msg string) []byte {
+	return append([]byte{0, 0, 0, 0, byte(len(msg))}, msg...)
+}
+
+func writeGreeterDescriptors(t *testing.T) string {
+	field := func(name string) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Field: []*descriptorpb.FieldDescriptorProto{{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(1),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+		}}}
+	}
+	request, reply := field("name"), field("message")
+	request.Name, reply.Name = proto.String("HelloRequest"), proto.String("HelloReply")
+
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:        proto.String("greeter.proto"),
+		Package:     proto.String("test"),
+		Syntax:      proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{request, reply},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Hello"),
+				InputType:  proto.String(".test.HelloRequest"),
+				OutputType: proto.String(".test.HelloReply"),
+			}},
+		}},
+	}}}
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "greeter.pb")
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGRPCOverHTTP2(t *testing.T) {
+	descriptors, err := parser.LoadGRPCDescriptors([]string{writeGreeterDescriptors(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := newHTTP2Side(), newHTTP2Side()
+	c := &conversation{conn: newTCPConn(50051)}
+
+	_ = client.framer.WriteSettings()
+	for _, id := range []uint32{1, 3} {
+		// the second request refers to the HPACK table filled by the first one
+		client.writeHeaders(id, false, ":method", "POST", ":scheme", "http", ":authority", "greeter:50051",
+			":path", "/test.Greeter/Hello", "content-type", "application/grpc", "te", "trailers")
+	}
+	_ = client.framer.WriteData(1, true, grpcFrame("\x0a\x05alice"))
+	_ = client.framer.WriteData(3, true, grpcFrame("\x0a\x03bob"))
+	c.send(true, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"+client.flush())
+
+	_ = server.framer.WriteSettings()
+	_ = server.framer.WriteSettingsAck()
+	server.writeHeaders(3, false, ":status", "200", "content-type", "application/grpc")
+	server.writeHeaders(1, false, ":status", "200", "content-type", "application/grpc")
+	_ = server.framer.WriteData(3, false, grpcFrame("\x0a\x09hello bob"))
+	server.writeHeaders(3, true, "grpc-status", "0")
+	server.writeHeaders(1, true, "grpc-status", "5", "grpc-message", "alice%20not%20found")
+	c.send(false, server.flush())
+
+	messages := parsePacketsWith(func(p *parser.MessageParser) {
+		p.SetDecoderOptions(parser.DecoderOptions{GRPCDescriptors: descriptors})
+	}, 50051, c.packets...)
+	records := make(map[bool]map[uint32]*message.HTTP2Message)
+	for _, msg := range messages {
+		record, ok := msg.Record.(*message.HTTP2Message)
+		if !ok {
+			t.Fatalf("message was not decoded as http2: %q", msg.Payload)
+		}
+		if record.IsRequest() != msg.Request {
+			t.Errorf("stream %d request %v in message with request %v", record.StreamID, record.IsRequest(), msg.Request)
+		}
+		if records[msg.Request] == nil {
+			records[msg.Request] = make(map[uint32]*message.HTTP2Message)
+		}
+		records[msg.Request][record.StreamID] = record
+	}
+	if len(messages) != 4 || len(records[true]) != 2 || len(records[false]) != 2 {
+		t.Fatalf("expected requests and responses of 2 streams, got %d messages", len(messages))
+	}
+
+	for id, name := range map[uint32]string{1: "alice", 3: "bob"} {
+		request := records[true][id]
+		if request.Method != "POST" || request.Path != "/test.Greeter/Hello" || request.Authority != "greeter:50051" {
+			t.Errorf("unexpected request %+v", request)
+		}
+		call := request.GRPC
+		if call == nil || call.Service != "test.Greeter" || call.Method != "Hello" || len(call.Messages) != 1 {
+			t.Fatalf("unexpected gRPC request %+v", call)
+		}
+		var rendered map[string]string
+		if err := json.Unmarshal(call.Messages[0].JSON, &rendered); err != nil || rendered["name"] != name {
+			t.Errorf("unexpected rendered request %s", call.Messages[0].JSON)
+		}
+	}
+
+	ok := records[false][3].GRPC
+	if ok == nil || ok.Method != "Hello" || ok.Status == nil || *ok.Status != 0 || len(ok.Messages) != 1 || ok.Messages[0].Size != 11 {
+		t.Fatalf("unexpected gRPC response %+v", ok)
+	}
+	var rendered map[string]string
+	if err := json.Unmarshal(ok.Messages[0].JSON, &rendered); err != nil || rendered["message"] != "hello bob" {
+		t.Errorf("unexpected rendered response %s", ok.Messages[0].JSON)
+	}
+	notFound := records[false][1].GRPC
+	if notFound == nil || notFound.Status == nil || *notFound.Status != 5 || notFound.StatusMessage != "alice not found" ||
+		len(notFound.Messages) != 0 {
+		t.Errorf("unexpected gRPC error response %+v", notFound)
+	}
+}
+
+func TestHTTP2Upgrade(t *testing.T) {
+	client, server := newHTTP2Side(), newHTTP2Side()
+	c := &conversation{conn: newTCPConn(80)}
+	c.send(true, "GET /index.html HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+
+	_ = server.framer.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100})
+	server.writeHeaders(1, false, ":status", "200", "content-type", "text/html")
+	_ = server.framer.WriteData(1, true, []byte("<html></html>"))
+	c.send(false, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"+server.flush())
+
+	_ = client.framer.WriteSettings()
+	client.writeHeaders(3, true, ":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/favicon.ico")
+	c.send(true, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"+client.flush())
+
+	messages := parsePackets(80, c.packets...)
+	if len(messages) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(messages))
+	}
+	if upgrade, ok := messages[1].Record.(*message.HTTPMessage); !ok || upgrade.StatusCode != 101 {
+		t.Fatalf("expected the HTTP/1.1 upgrade response, got %+v", messages[1].Record)
+	}
+	response, ok := messages[2].Record.(*message.HTTP2Message)
+	if !ok || response.StreamID != 1 || response.Status != 200 || response.BodySize != 13 || messages[2].Request {
+		t.Fatalf("unexpected upgraded response %+v", messages[2].Record)
+	}
+	if string(messages[2].Payload) != "<html></html>" {
+		t.Errorf("unexpected response body %q", messages[2].Payload)
+	}
+	request, ok := messages[3].Record.(*message.HTTP2Message)
+	if !ok || request.StreamID != 3 || request.Path != "/favicon.ico" || !messages[3].Request {
+		t.Errorf("unexpected request after the upgrade %+v", messages[3].Record)
+	}
+}
+
+func TestHTTP2ServerReset(t *testing.T) {
+	client, server := newHTTP2Side(), newHTTP2Side()
+	c := &conversation{conn: newTCPConn(8080)}
+
+	_ = client.framer.WriteSettings()
+	client.writeHeaders(1, false, ":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/upload")
+	_ = client.framer.WriteData(1, false, []byte("partial"))
+	c.send(true, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"+client.flush())
+
+	_ = server.framer.WriteSettings()
+	_ = server.framer.WriteRSTStream(1, http2.ErrCodeRefusedStream)
+	c.send(false, server.flush())
+
+	messages := parsePackets(8080, c.packets...)
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	msg := messages[0]
+	request, ok := msg.Record.(*message.HTTP2Message)
+	if !ok || request.Path != "/upload" || request.Reset != "REFUSED_STREAM" || string(msg.Payload) != "partial" {
+		t.Fatalf("unexpected reset request %+v", msg.Record)
+	}
+	if !msg.Request || !msg.SrcIP.Equal(clientIP) || msg.DstPort != 8080 {
+		t.Errorf("the request reset by the server was emitted as sent by %s:%d, request %v", msg.SrcIP, msg.SrcPort, msg.Request)
+	}
+}
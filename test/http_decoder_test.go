@@ -0,0 +1,57 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net-capture/pkg/message"
+	"testing"
+)
+
+func TestHTTPPipelinedChunkedGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write([]byte("hello gzip"))
+	_ = gz.Close()
+
+	requests := "GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"POST /second HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nbody"
+	chunked := fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", compressed.Len(), compressed.String())
+	first := "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n" + chunked
+	second := "HTTP/1.1 201 Created\r\nContent-Length: 7\r\n\r\ncreated"
+
+	conn := newTCPConn(8080)
+	messages := parsePackets(8080,
+		conn.client(0, requests[:30]),
+		conn.client(30, requests[30:]),
+		// the first response arrives split in two segments
+		conn.server(0, first[:40]),
+		conn.server(40, first[40:]+second),
+	)
+
+	if len(messages) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(messages))
+	}
+	for _, msg := range messages {
+		if _, ok := msg.Record.(*message.HTTPMessage); !ok {
+			t.Fatalf("message was not decoded as HTTP: %q", msg.Payload)
+		}
+	}
+
+	if httpRecord(messages[0]).Method != "GET" || httpRecord(messages[0]).URL != "/first" {
+		t.Errorf("unexpected first request %s %s", httpRecord(messages[0]).Method, httpRecord(messages[0]).URL)
+	}
+	if httpRecord(messages[1]).Method != "POST" || string(httpRecord(messages[1]).Body) != "body" {
+		t.Errorf("unexpected second request %s %q", httpRecord(messages[1]).Method, httpRecord(messages[1]).Body)
+	}
+	if httpRecord(messages[2]).StatusCode != 200 || string(httpRecord(messages[2]).Body) != "hello gzip" {
+		t.Errorf("unexpected first response %d %q", httpRecord(messages[2]).StatusCode, httpRecord(messages[2]).Body)
+	}
+	if httpRecord(messages[3]).StatusCode != 201 || string(httpRecord(messages[3]).Body) != "created" {
+		t.Errorf("unexpected second response %d %q", httpRecord(messages[3]).StatusCode, httpRecord(messages[3]).Body)
+	}
+}
+
+func httpRecord(msg *message.NetMessage) *message.HTTPMessage {
+	return msg.Record.(*message.HTTPMessage)
+}
@@ -0,0 +1,74 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"net-capture/pkg/output"
+	"net-capture/pkg/parser"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJSONOutput(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "capture.jsonl")
+	o := output.NewJSONOutput(model.JSONOutputConfig{Path: file})
+
+	conn := newTCPConn(8080)
+	messages := parsePacketsWith(func(p *parser.MessageParser) { p.TrackResponse(time.Minute) }, 8080,
+		conn.client(0, "GET /ping HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		conn.server(0, "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\n\x00\x01\x02"),
+	)
+	for _, msg := range messages {
+		if err := o.PluginWrite(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = o.Close()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// decoded records are read back as the types they were written from
+	type httpLine struct {
+		output.JSONMessage
+		Record   *message.HTTPMessage `json:"record"`
+		Response *struct {
+			output.JSONMessage
+			Record *message.HTTPMessage `json:"record"`
+		} `json:"response"`
+	}
+	var lines []httpLine
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line httpLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid json line %s: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) != 1 {
+		t.Fatalf("expected a single paired line, got %d", len(lines))
+	}
+	req := lines[0]
+	if req.SrcIP != clientIP.String() || req.DstPort != 8080 || req.Protocol != "tcp" || req.Direction != "request" {
+		t.Errorf("unexpected request metadata %+v", req)
+	}
+	if req.PayloadEncoding != "text" || req.AppProtocol != "http" || req.Record == nil || req.Record.URL != "/ping" {
+		t.Errorf("unexpected request payload %+v", req)
+	}
+	if req.Response == nil || req.Response.PayloadEncoding != "base64" || req.Response.Record == nil ||
+		req.Response.Record.StatusCode != 200 || string(req.Response.Record.Body) != "\x00\x01\x02" {
+		t.Errorf("unexpected response %+v", req.Response)
+	}
+	if req.LatencyMs <= 0 {
+		t.Errorf("expected a latency, got %f", req.LatencyMs)
+	}
+}
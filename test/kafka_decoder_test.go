@@ -0,0 +1,171 @@
+package test
+
+import (
+	"encoding/binary"
+	"net-capture/pkg/message"
+	"testing"
+)
+
+// kafkaFrame joins the fields of a request or response and prefixes them with their length
+func kafkaFrame(fields ...[]byte) string {
+	var data []byte
+	for _, f := range fields {
+		data = append(data, f...)
+	}
+	return string(binary.BigEndian.AppendUint32(nil, uint32(len(data)))) + string(data)
+}
+
+func kafkaInt16(v int16) []byte {
+	return binary.BigEndian.AppendUint16(nil, uint16(v))
+}
+
+func kafkaInt32(v int32) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(v))
+}
+
+func kafkaInt64(v int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(v))
+}
+
+func kafkaString(s string) []byte {
+	return append(kafkaInt16(int16(len(s))), s...)
+}
+
+// kafkaCompact is the compact string or array length of flexible versions
+func kafkaCompact(n int) []byte {
+	return binary.AppendUvarint(nil, uint64(n+1))
+}
+
+func kafkaCompactString(s string) []byte {
+	return append(kafkaCompact(len(s)), s...)
+}
+
+// kafkaRecordBatch is the header of a record batch holding count records, the records themselves are left out
+func kafkaRecordBatch(count int32) []byte {
+	batch := make([]byte, 61)
+	binary.BigEndian.PutUint32(batch[8:12], 49)
+	batch[16] = 2
+	binary.BigEndian.PutUint32(batch[57:61], uint32(count))
+	return batch
+}
+
+func kafkaRecords(batches ...[]byte) []byte {
+	var data []byte
+	for _, b := range batches {
+		data = append(data, b...)
+	}
+	return append(kafkaInt32(int32(len(data))), data...)
+}
+
+func kafkaRecordsOf(t *testing.T, messages []*message.NetMessage) []*message.KafkaMessage {
+	var records []*message.KafkaMessage
+	for _, msg := range messages {
+		record, ok := msg.Record.(*message.KafkaMessage)
+		if !ok {
+			t.Fatalf("message was not decoded as kafka: %q", msg.Payload)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestKafkaProduceAndFetch(t *testing.T) {
+	c := &conversation{conn: newTCPConn(9092)}
+	produce := kafkaFrame(kafkaInt16(0), kafkaInt16(3), kafkaInt32(7), kafkaString("producer-1"),
+		kafkaInt16(-1), kafkaInt16(1), kafkaInt32(30000),
+		kafkaInt32(1), kafkaString("orders"), kafkaInt32(1), kafkaInt32(2), kafkaRecords(kafkaRecordBatch(3)))
+	fetch := kafkaFrame(kafkaInt16(1), kafkaInt16(4), kafkaInt32(8), kafkaString("consumer-1"),
+		kafkaInt32(-1), kafkaInt32(500), kafkaInt32(1), kafkaInt32(52428800), []byte{0},
+		kafkaInt32(1), kafkaString("orders"), kafkaInt32(1), kafkaInt32(2), kafkaInt64(40), kafkaInt32(1048576))
+	c.send(true, produce+fetch)
+
+	c.send(false, kafkaFrame(kafkaInt32(7),
+		kafkaInt32(1), kafkaString("orders"), kafkaInt32(1), kafkaInt32(2), kafkaInt16(0), kafkaInt64(42), kafkaInt64(-1),
+		kafkaInt32(0)))
+	c.send(false, kafkaFrame(kafkaInt32(8), kafkaInt32(0),
+		kafkaInt32(1), kafkaString("orders"), kafkaInt32(2),
+		kafkaInt32(2), kafkaInt16(0), kafkaInt64(45), kafkaInt64(45), kafkaInt32(-1),
+		kafkaRecords(kafkaRecordBatch(3), kafkaRecordBatch(2)),
+		kafkaInt32(5), kafkaInt16(6), kafkaInt64(-1), kafkaInt64(-1), kafkaInt32(-1), kafkaRecords()))
+
+	records := kafkaRecordsOf(t, parsePackets(9092, c.packets...))
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+
+	request := records[0]
+	if request.APIKey != "Produce" || request.APIVersion != 3 || request.ClientID != "producer-1" || request.Response ||
+		len(request.Topics) != 1 || request.Topics[0].Name != "orders" || request.Topics[0].Partitions[0].Records != 3 {
+		t.Errorf("unexpected produce request %+v", request)
+	}
+	if fetch := records[1]; fetch.APIKey != "Fetch" || fetch.CorrelationID != 8 || len(fetch.Topics) != 1 ||
+		fetch.Topics[0].Partitions[0].Partition != 2 {
+		t.Errorf("unexpected fetch request %+v", fetch)
+	}
+
+	response := records[2]
+	if response.APIKey != "Produce" || response.CorrelationID != 7 || response.ClientID != "producer-1" || !response.Response ||
+		len(response.Topics) != 1 || response.Topics[0].Partitions[0].ErrorCode != 0 {
+		t.Errorf("unexpected produce response %+v", response)
+	}
+
+	fetched := records[3]
+	if fetched.APIKey != "Fetch" || fetched.ClientID != "consumer-1" || len(fetched.Topics) != 1 ||
+		len(fetched.Topics[0].Partitions) != 2 {
+		t.Fatalf("unexpected fetch response %+v", fetched)
+	}
+	if p := fetched.Topics[0].Partitions[0]; p.Partition != 2 || p.Records != 5 || p.Error != "" {
+		t.Errorf("unexpected fetched partition %+v", p)
+	}
+	if p := fetched.Topics[0].Partitions[1]; p.Partition != 5 || p.ErrorCode != 6 || p.Error != "NOT_LEADER_OR_FOLLOWER" {
+		t.Errorf("unexpected failed partition %+v", p)
+	}
+}
+
+func TestKafkaFlexibleVersions(t *testing.T) {
+	tags := []byte{0}
+	c := &conversation{conn: newTCPConn(9092)}
+	c.send(true, kafkaFrame(kafkaInt16(3), kafkaInt16(9), kafkaInt32(1), kafkaString("admin"), tags,
+		kafkaCompact(2), kafkaCompactString("orders"), tags, kafkaCompactString("missing"), tags, []byte{1, 0}, tags))
+	c.send(false, kafkaFrame(kafkaInt32(1), tags, kafkaInt32(0),
+		kafkaCompact(1), kafkaInt32(1), kafkaCompactString("kafka-1"), kafkaInt32(9092), kafkaCompact(-1), tags,
+		kafkaCompactString("cluster"), kafkaInt32(1),
+		kafkaCompact(2),
+		kafkaInt16(0), kafkaCompactString("orders"), []byte{0},
+		kafkaCompact(1), kafkaInt16(0), kafkaInt32(0), kafkaInt32(1), kafkaInt32(0),
+		kafkaCompact(1), kafkaInt32(1), kafkaCompact(1), kafkaInt32(1), kafkaCompact(0), tags,
+		kafkaInt32(0), tags,
+		kafkaInt16(3), kafkaCompactString("missing"), []byte{0}, kafkaCompact(0), kafkaInt32(0), tags,
+		kafkaInt32(0), tags))
+
+	c.send(true, kafkaFrame(kafkaInt16(8), kafkaInt16(8), kafkaInt32(2), kafkaString("consumer-1"), tags,
+		kafkaCompactString("billing"), kafkaInt32(4), kafkaCompactString("member-1"), kafkaCompact(-1),
+		kafkaCompact(1), kafkaCompactString("orders"),
+		kafkaCompact(1), kafkaInt32(0), kafkaInt64(100), kafkaInt32(-1), kafkaCompact(-1), tags, tags, tags))
+	c.send(false, kafkaFrame(kafkaInt32(2), tags, kafkaInt32(0),
+		kafkaCompact(1), kafkaCompactString("orders"), kafkaCompact(1), kafkaInt32(0), kafkaInt16(25), tags, tags, tags))
+
+	records := kafkaRecordsOf(t, parsePackets(9092, c.packets...))
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+
+	if metadata := records[0]; metadata.APIKey != "Metadata" || len(metadata.Topics) != 2 || metadata.Topics[1].Name != "missing" {
+		t.Errorf("unexpected metadata request %+v", metadata)
+	}
+	metadata := records[1]
+	if len(metadata.Topics) != 2 || metadata.Topics[0].Name != "orders" || len(metadata.Topics[0].Partitions) != 1 {
+		t.Fatalf("unexpected metadata response %+v", metadata)
+	}
+	if missing := metadata.Topics[1]; missing.Name != "missing" || missing.Error != "UNKNOWN_TOPIC_OR_PARTITION" {
+		t.Errorf("unexpected missing topic %+v", missing)
+	}
+
+	if commit := records[2]; commit.APIKey != "OffsetCommit" || commit.GroupID != "billing" || len(commit.Topics) != 1 ||
+		len(commit.Topics[0].Partitions) != 1 {
+		t.Errorf("unexpected offset commit %+v", commit)
+	}
+	if committed := records[3]; len(committed.Topics) != 1 || committed.Topics[0].Partitions[0].Error != "UNKNOWN_MEMBER_ID" {
+		t.Errorf("unexpected offset commit response %+v", committed)
+	}
+}
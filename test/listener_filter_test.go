@@ -0,0 +1,97 @@
+package test
+
+import (
+	"github.com/google/gopacket/pcap"
+	"net"
+	"net-capture/pkg/listener"
+	"net-capture/pkg/model"
+	"net-capture/pkg/util"
+	"testing"
+	"time"
+)
+
+func TestFilterHostAndExtraBPF(t *testing.T) {
+	l, err := listener.NewFileListener("capture.pcap", "", "10.0.0.2", model.Ports{{From: 8080, To: 8080}}, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.AddBPFFilter("not vlan")
+
+	expected := "(((tcp dst port 8080) or (udp dst port 8080)) and (dst host 10.0.0.2)) or " +
+		"(((tcp src port 8080) or (udp src port 8080)) and (src host 10.0.0.2))"
+	if filter := l.Filter(pcap.Interface{}); filter != "("+expected+") and (not vlan)" {
+		t.Errorf("unexpected filter %s", filter)
+	}
+}
+
+func TestFilterListenAllUsesInterfaceAddresses(t *testing.T) {
+	l, err := listener.NewFileListener("capture.pcap", "", "", model.Ports{{From: 8080, To: 8080}}, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ifi := pcap.Interface{Name: "eth0", Addresses: []pcap.InterfaceAddress{{IP: net.IP{10, 0, 0, 2}}, {IP: net.ParseIP("fd00::2")}}}
+	expected := "(((tcp dst port 8080) or (udp dst port 8080)) and (dst host 10.0.0.2 or dst host fd00::2)) or " +
+		"(((tcp src port 8080) or (udp src port 8080)) and (src host 10.0.0.2 or src host fd00::2))"
+	if filter := l.Filter(ifi); filter != expected {
+		t.Errorf("unexpected filter %s", filter)
+	}
+}
+
+func TestFilterDeviceUsesInterfaceAddresses(t *testing.T) {
+	l, err := listener.NewFileListener("capture.pcap", "tcp", "eth0", model.Ports{{From: 8080, To: 8080}}, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ifi := pcap.Interface{Name: "eth0", Addresses: []pcap.InterfaceAddress{{IP: net.IP{10, 0, 0, 2}}}}
+	expected := "(((tcp dst port 8080)) and (dst host 10.0.0.2)) or (((tcp src port 8080)) and (src host 10.0.0.2))"
+	if filter := l.Filter(ifi); filter != expected {
+		t.Errorf("unexpected filter %s", filter)
+	}
+}
+
+func TestFilterProtocol(t *testing.T) {
+	l, err := listener.NewFileListener("capture.pcap", "udp", "", model.Ports{{From: 53, To: 53}}, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filter := l.Filter(pcap.Interface{}); filter != "((udp dst port 53)) or ((udp src port 53))" {
+		t.Errorf("unexpected filter %s", filter)
+	}
+}
+
+func TestFilterPortList(t *testing.T) {
+	l, err := listener.NewFileListener("capture.pcap", "tcp", "", model.Ports{{From: 8080, To: 8080}, {From: 9000, To: 9010}}, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "((tcp dst port 8080) or (tcp dst portrange 9000-9010)) or ((tcp src port 8080) or (tcp src portrange 9000-9010))"
+	if filter := l.Filter(pcap.Interface{}); filter != expected {
+		t.Errorf("unexpected filter %s", filter)
+	}
+}
+
+func TestFilterIPv6Host(t *testing.T) {
+	addr, err := util.ParseInputAddress("tcp://[fd00::2]:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := listener.NewFileListener("capture.pcap", addr.Protocol, addr.Host, addr.Ports, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "(((tcp dst port 8080)) and (dst host fd00::2)) or (((tcp src port 8080)) and (src host fd00::2))"
+	if filter := l.Filter(pcap.Interface{}); filter != expected {
+		t.Errorf("unexpected filter %s", filter)
+	}
+
+	// the other addresses of the interface owning the address are not captured
+	ifi := pcap.Interface{Name: "eth0", Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("fd00:0:0::2")}, {IP: net.ParseIP("fe80::2")}}}
+	if filter := l.Filter(ifi); filter != expected {
+		t.Errorf("unexpected filter %s", filter)
+	}
+}
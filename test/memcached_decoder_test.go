@@ -0,0 +1,143 @@
+package test
+
+import (
+	"encoding/binary"
+	"net-capture/pkg/message"
+	"testing"
+)
+
+// memcachedBinary builds a binary protocol packet, status is the vbucket id for requests
+func memcachedBinary(magic, opcode byte, status uint16, opaque uint32, extras, key, value string) string {
+	header := make([]byte, 24)
+	header[0], header[1] = magic, opcode
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(key)))
+	header[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(header[6:8], status)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(header[12:16], opaque)
+	return string(header) + extras + key + value
+}
+
+func memcachedRecordsOf(t *testing.T, messages []*message.NetMessage) []*message.MemcachedMessage {
+	var records []*message.MemcachedMessage
+	for _, msg := range messages {
+		record, ok := msg.Record.(*message.MemcachedMessage)
+		if !ok {
+			t.Fatalf("message was not decoded as memcached: %q", msg.Payload)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestMemcachedText(t *testing.T) {
+	c := &conversation{conn: newTCPConn(11211)}
+	c.send(true, "set user:1 0 300 5\r\nalice\r\n")
+	c.send(false, "STORED\r\n")
+	c.send(true, "delete session:9 noreply\r\nget user:1 user:2\r\n")
+	c.send(false, "VALUE user:1 0 5\r\nalice\r\nEND\r\n")
+	c.send(true, "incr visits 1\r\n")
+	c.send(false, "42\r\n")
+
+	records := memcachedRecordsOf(t, parsePackets(11211, c.packets...))
+	if len(records) != 7 {
+		t.Fatalf("expected 7 records, got %d", len(records))
+	}
+
+	if set := records[0]; set.Command != "set" || len(set.Keys) != 1 || set.Keys[0] != "user:1" || set.ValueSize != 5 || set.Size != 27 {
+		t.Errorf("unexpected set %+v", set)
+	}
+	if stored := records[1]; !stored.Response || stored.Status != "STORED" || stored.Command != "set" || stored.LatencyMs != 1 {
+		t.Errorf("unexpected set response %+v", stored)
+	}
+	if del := records[2]; del.Command != "delete" || !del.NoReply {
+		t.Errorf("unexpected delete %+v", del)
+	}
+	if get := records[3]; get.Command != "get" || len(get.Keys) != 2 {
+		t.Errorf("unexpected get %+v", get)
+	}
+	if value := records[4]; value.Command != "get" || value.Hits != 1 || value.Misses != 1 || value.ValueSize != 5 {
+		t.Errorf("unexpected get response %+v", value)
+	}
+	if incr := records[6]; incr.Command != "incr" || incr.Status != "42" || incr.Keys[0] != "visits" {
+		t.Errorf("unexpected incr response %+v", incr)
+	}
+}
+
+func TestMemcachedBinary(t *testing.T) {
+	c := &conversation{conn: newTCPConn(11211)}
+	c.send(true, memcachedBinary(0x80, 0x0d, 0, 1, "", "missing", "")+memcachedBinary(0x80, 0x00, 0, 2, "", "user:1", "")+
+		memcachedBinary(0x80, 0x0a, 0, 3, "", "", ""))
+	c.send(false, memcachedBinary(0x81, 0x00, 0, 2, "\x00\x00\x00\x00", "", "alice")+memcachedBinary(0x81, 0x0a, 0, 3, "", "", ""))
+	c.send(true, memcachedBinary(0x80, 0x01, 0, 4, "\x00\x00\x00\x00\x00\x00\x01\x2c", "user:2", "bob"))
+	c.send(false, memcachedBinary(0x81, 0x01, 0x02, 4, "", "", ""))
+
+	records := memcachedRecordsOf(t, parsePackets(11211, c.packets...))
+	if len(records) != 7 {
+		t.Fatalf("expected 7 records, got %d", len(records))
+	}
+
+	if getkq := records[0]; getkq.Command != "getkq" || getkq.Keys[0] != "missing" || !getkq.Binary {
+		t.Errorf("unexpected getkq %+v", getkq)
+	}
+	if hit := records[3]; hit.Command != "get" || hit.Keys[0] != "user:1" || hit.Status != "SUCCESS" || hit.Hits != 1 ||
+		hit.ValueSize != 5 || hit.LatencyMs != 1 {
+		t.Errorf("unexpected get response %+v", hit)
+	}
+	if noop := records[4]; noop.Command != "noop" || noop.Opaque != 3 {
+		t.Errorf("unexpected noop response %+v", noop)
+	}
+	if set := records[5]; set.Command != "set" || set.Keys[0] != "user:2" || set.ValueSize != 3 {
+		t.Errorf("unexpected set %+v", set)
+	}
+	if exists := records[6]; exists.Command != "set" || exists.Status != "KEY_EEXISTS" || exists.Hits != 0 {
+		t.Errorf("unexpected set response %+v", exists)
+	}
+}
+
+func TestMemcachedMetaQuiet(t *testing.T) {
+	c := &conversation{conn: newTCPConn(11211)}
+	c.send(true, "mg user:1 v q\r\nmg user:2 v q\r\nmn\r\n")
+	c.send(false, "VA 5\r\nalice\r\nMN\r\n")
+	c.send(true, "get user:3\r\n")
+	c.send(false, "END\r\n")
+
+	records := memcachedRecordsOf(t, parsePackets(11211, c.packets...))
+	if len(records) != 7 {
+		t.Fatalf("expected 7 records, got %d", len(records))
+	}
+	if quiet := records[0]; !quiet.Quiet || quiet.NoReply {
+		t.Errorf("unexpected quiet mg %+v", quiet)
+	}
+	if hit := records[3]; hit.Command != "mg" || hit.Keys[0] != "user:1" || hit.Status != "VA" || hit.Hits != 1 || hit.Misses != 0 {
+		t.Errorf("unexpected mg hit %+v", hit)
+	}
+	if mn := records[4]; mn.Command != "mn" || mn.Status != "MN" || len(mn.Keys) != 1 || mn.Keys[0] != "user:2" || mn.Misses != 1 {
+		t.Errorf("unexpected mn response %+v", mn)
+	}
+	if miss := records[6]; miss.Command != "get" || miss.Keys[0] != "user:3" || miss.Status != "END" || miss.Misses != 1 {
+		t.Errorf("unexpected get response %+v", miss)
+	}
+}
+
+func TestMemcachedBinaryQuietMultiGet(t *testing.T) {
+	c := &conversation{conn: newTCPConn(11211)}
+	c.send(true, memcachedBinary(0x80, 0x0d, 0, 1, "", "user:1", "")+memcachedBinary(0x80, 0x0d, 0, 2, "", "user:2", "")+
+		memcachedBinary(0x80, 0x0d, 0, 3, "", "user:3", "")+memcachedBinary(0x80, 0x0a, 0, 4, "", "", ""))
+	c.send(false, memcachedBinary(0x81, 0x0d, 0, 2, "\x00\x00\x00\x00", "user:2", "bob")+memcachedBinary(0x81, 0x0a, 0, 4, "", "", ""))
+
+	records := memcachedRecordsOf(t, parsePackets(11211, c.packets...))
+	if len(records) != 6 {
+		t.Fatalf("expected 6 records, got %d", len(records))
+	}
+	if getkq := records[0]; getkq.Command != "getkq" || !getkq.Quiet {
+		t.Errorf("unexpected getkq %+v", getkq)
+	}
+	if hit := records[4]; hit.Command != "getkq" || hit.Keys[0] != "user:2" || hit.Hits != 1 || hit.ValueSize != 3 {
+		t.Errorf("unexpected getkq hit %+v", hit)
+	}
+	noop := records[5]
+	if noop.Command != "noop" || noop.Misses != 2 || len(noop.Keys) != 2 || noop.Keys[0] != "user:1" || noop.Keys[1] != "user:3" {
+		t.Errorf("unexpected noop response %+v", noop)
+	}
+}
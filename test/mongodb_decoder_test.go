@@ -0,0 +1,125 @@
+package test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"net-capture/pkg/message"
+	"testing"
+)
+
+// mongoMessage builds a wire protocol message from its header fields and body
+func mongoMessage(requestID, responseTo, opCode int32, body ...[]byte) string {
+	var data []byte
+	for _, b := range body {
+		data = append(data, b...)
+	}
+	header := binary.LittleEndian.AppendUint32(nil, uint32(16+len(data)))
+	header = binary.LittleEndian.AppendUint32(header, uint32(requestID))
+	header = binary.LittleEndian.AppendUint32(header, uint32(responseTo))
+	header = binary.LittleEndian.AppendUint32(header, uint32(opCode))
+	return string(append(header, data...))
+}
+
+func mongoDocument(t *testing.T, doc bson.D) []byte {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// mongoBody is the body section of OP_MSG with no flags
+func mongoBody(doc []byte) []byte {
+	return append([]byte{0, 0, 0, 0, 0}, doc...)
+}
+
+func mongoRecordsOf(t *testing.T, messages []*message.NetMessage) []*message.MongoDBMessage {
+	var records []*message.MongoDBMessage
+	for _, msg := range messages {
+		record, ok := msg.Record.(*message.MongoDBMessage)
+		if !ok {
+			t.Fatalf("message was not decoded as mongodb: %q", msg.Payload)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestMongoDBCommands(t *testing.T) {
+	c := &conversation{conn: newTCPConn(27017)}
+	c.send(true, mongoMessage(1, 0, 2013, mongoBody(mongoDocument(t, bson.D{
+		{Key: "find", Value: "orders"}, {Key: "filter", Value: bson.D{{Key: "status", Value: "open"}}}, {Key: "$db", Value: "shop"},
+	}))))
+	c.send(false, mongoMessage(101, 1, 2013, mongoBody(mongoDocument(t, bson.D{
+		{Key: "cursor", Value: bson.D{{Key: "firstBatch", Value: bson.A{}}, {Key: "id", Value: int64(0)}, {Key: "ns", Value: "shop.orders"}}},
+		{Key: "ok", Value: 1.0},
+	}))))
+
+	documents := append(mongoDocument(t, bson.D{{Key: "_id", Value: 1}}), mongoDocument(t, bson.D{{Key: "_id", Value: 1}})...)
+	sequence := append([]byte{1}, binary.LittleEndian.AppendUint32(nil, uint32(4+len("documents\x00")+len(documents)))...)
+	sequence = append(append(sequence, "documents\x00"...), documents...)
+	c.send(true, mongoMessage(2, 0, 2013, mongoBody(mongoDocument(t, bson.D{
+		{Key: "insert", Value: "orders"}, {Key: "ordered", Value: true}, {Key: "$db", Value: "shop"},
+	})), sequence))
+	c.send(false, mongoMessage(102, 2, 2013, mongoBody(mongoDocument(t, bson.D{
+		{Key: "n", Value: 1},
+		{Key: "writeErrors", Value: bson.A{bson.D{
+			{Key: "index", Value: 1}, {Key: "code", Value: 11000}, {Key: "errmsg", Value: "E11000 duplicate key error"},
+		}}},
+		{Key: "ok", Value: 1.0},
+	}))))
+
+	records := mongoRecordsOf(t, parsePackets(27017, c.packets...))
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+
+	find := records[0]
+	if find.OpCode != "OP_MSG" || find.Command != "find" || find.Database != "shop" || find.Collection != "orders" {
+		t.Errorf("unexpected find %+v", find)
+	}
+	var rendered map[string]interface{}
+	if err := json.Unmarshal(find.Document, &rendered); err != nil || rendered["filter"] == nil {
+		t.Errorf("unexpected find document %s", find.Document)
+	}
+	if reply := records[1]; reply.ResponseTo != 1 || reply.Command != "find" || reply.Collection != "orders" ||
+		reply.OK == nil || !*reply.OK || reply.DurationMs != 1 {
+		t.Errorf("unexpected find reply %+v", reply)
+	}
+
+	insert := records[2]
+	if insert.Command != "insert" || len(insert.Sequences) != 1 || insert.Sequences[0].Identifier != "documents" ||
+		insert.Sequences[0].Documents != 2 {
+		t.Errorf("unexpected insert %+v", insert)
+	}
+	if reply := records[3]; reply.Command != "insert" || reply.ErrorCode != 11000 || reply.ErrorMessage == "" ||
+		reply.OK == nil || !*reply.OK {
+		t.Errorf("unexpected insert reply %+v", reply)
+	}
+}
+
+func TestMongoDBLegacyQuery(t *testing.T) {
+	query := append([]byte{0, 0, 0, 0}, "admin.$cmd\x00"...)
+	query = append(query, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff)
+	reply := make([]byte, 16)
+	binary.LittleEndian.PutUint32(reply[12:], 1)
+
+	c := &conversation{conn: newTCPConn(27017)}
+	c.send(true, mongoMessage(7, 0, 2004, query, mongoDocument(t, bson.D{{Key: "isMaster", Value: 1}})))
+	c.send(false, mongoMessage(8, 7, 1, reply[:4], reply, mongoDocument(t, bson.D{
+		{Key: "ok", Value: 0.0}, {Key: "code", Value: 13}, {Key: "codeName", Value: "Unauthorized"}, {Key: "errmsg", Value: "not authorized"},
+	})))
+
+	records := mongoRecordsOf(t, parsePackets(27017, c.packets...))
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if isMaster := records[0]; isMaster.OpCode != "OP_QUERY" || isMaster.Command != "isMaster" || isMaster.Database != "admin" {
+		t.Errorf("unexpected query %+v", isMaster)
+	}
+	if failed := records[1]; failed.OpCode != "OP_REPLY" || failed.Command != "isMaster" || failed.OK == nil || *failed.OK ||
+		failed.ErrorCode != 13 || failed.ErrorName != "Unauthorized" {
+		t.Errorf("unexpected reply %+v", failed)
+	}
+}
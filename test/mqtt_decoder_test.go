@@ -0,0 +1,100 @@
+package test
+
+import (
+	"encoding/binary"
+	"net-capture/pkg/message"
+	"testing"
+)
+
+// mqttPacket builds a control packet from its first byte and the fields following the remaining length
+func mqttPacket(header byte, fields ...string) string {
+	var body []byte
+	for _, f := range fields {
+		body = append(body, f...)
+	}
+	length := binary.AppendUvarint(nil, uint64(len(body)))
+	return string(append(append([]byte{header}, length...), body...))
+}
+
+func mqttString(s string) string {
+	return string(binary.BigEndian.AppendUint16(nil, uint16(len(s)))) + s
+}
+
+func mqttRecordsOf(t *testing.T, messages []*message.NetMessage) []*message.MQTTMessage {
+	var records []*message.MQTTMessage
+	for _, msg := range messages {
+		record, ok := msg.Record.(*message.MQTTMessage)
+		if !ok {
+			t.Fatalf("message was not decoded as mqtt: %q", msg.Payload)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestMQTT5PublishAndSubscribe(t *testing.T) {
+	c := &conversation{conn: newTCPConn(1883)}
+	c.send(true, mqttPacket(0x10, mqttString("MQTT"), "\x05\x02\x00\x3c", "\x00", mqttString("gateway-7")))
+	c.send(false, mqttPacket(0x20, "\x00\x00", "\x00"))
+	c.send(true, mqttPacket(0x82, "\x00\x01", "\x00", mqttString("sensors/#"), "\x01"))
+	c.send(false, mqttPacket(0x90, "\x00\x01", "\x00", "\x01"))
+	c.send(true, mqttPacket(0x33, mqttString("sensors/temp"), "\x00\x02", "\x03\x01\x00\x00", "21.5"))
+	c.send(false, mqttPacket(0x40, "\x00\x02"))
+	c.send(true, mqttPacket(0xe0, "\x00"))
+
+	records := mqttRecordsOf(t, parsePackets(1883, c.packets...))
+	if len(records) != 7 {
+		t.Fatalf("expected 7 records, got %d", len(records))
+	}
+
+	if connect := records[0]; connect.Type != "CONNECT" || connect.ClientID != "gateway-7" ||
+		connect.ProtocolVersion != "5.0" || connect.KeepAlive != 60 {
+		t.Errorf("unexpected CONNECT %+v", connect)
+	}
+	if connAck := records[1]; connAck.Type != "CONNACK" || len(connAck.ReasonCodes) != 1 || connAck.ReasonCodes[0] != 0 {
+		t.Errorf("unexpected CONNACK %+v", connAck)
+	}
+	if subscribe := records[2]; subscribe.Type != "SUBSCRIBE" || subscribe.PacketID != 1 || len(subscribe.Subscriptions) != 1 ||
+		subscribe.Subscriptions[0].Topic != "sensors/#" || subscribe.Subscriptions[0].QoS != 1 {
+		t.Errorf("unexpected SUBSCRIBE %+v", subscribe)
+	}
+	if subAck := records[3]; subAck.Type != "SUBACK" || subAck.LatencyMs != 1 || subAck.ReasonCodes[0] != 1 {
+		t.Errorf("unexpected SUBACK %+v", subAck)
+	}
+	if publish := records[4]; publish.Type != "PUBLISH" || publish.Topic != "sensors/temp" || publish.QoS != 1 ||
+		!publish.Retain || publish.PacketID != 2 || publish.PayloadSize != 4 {
+		t.Errorf("unexpected PUBLISH %+v", publish)
+	}
+	if pubAck := records[5]; pubAck.Type != "PUBACK" || pubAck.PacketID != 2 || pubAck.LatencyMs != 1 {
+		t.Errorf("unexpected PUBACK %+v", pubAck)
+	}
+	if disconnect := records[6]; disconnect.Type != "DISCONNECT" || disconnect.ReasonCodes[0] != 0 {
+		t.Errorf("unexpected DISCONNECT %+v", disconnect)
+	}
+}
+
+func TestMQTT311QoS2Delivery(t *testing.T) {
+	c := &conversation{conn: newTCPConn(1883)}
+	c.send(true, mqttPacket(0x10, mqttString("MQTT"), "\x04\x82\x00\x1e", mqttString("meter-1"), mqttString("edge")))
+	c.send(false, mqttPacket(0x20, "\x00\x00")+mqttPacket(0x34, mqttString("meters/1/cmd"), "\x00\x05", "reset"))
+	c.send(true, mqttPacket(0x50, "\x00\x05"))
+	c.send(false, mqttPacket(0x62, "\x00\x05"))
+	c.send(true, mqttPacket(0x70, "\x00\x05"))
+
+	records := mqttRecordsOf(t, parsePackets(1883, c.packets...))
+	if len(records) != 6 {
+		t.Fatalf("expected 6 records, got %d", len(records))
+	}
+	if connect := records[0]; connect.ProtocolVersion != "3.1.1" || connect.ClientID != "meter-1" || connect.Username != "edge" {
+		t.Errorf("unexpected CONNECT %+v", connect)
+	}
+	if publish := records[2]; publish.Type != "PUBLISH" || publish.QoS != 2 || publish.PayloadSize != 5 || publish.Retain {
+		t.Errorf("unexpected PUBLISH %+v", publish)
+	}
+	if pubRec := records[3]; pubRec.Type != "PUBREC" || pubRec.LatencyMs != 0 || len(pubRec.ReasonCodes) != 0 {
+		t.Errorf("unexpected PUBREC %+v", pubRec)
+	}
+	if pubComp := records[5]; pubComp.Type != "PUBCOMP" || pubComp.PacketID != 5 || pubComp.LatencyMs != 3 {
+		t.Errorf("unexpected PUBCOMP %+v", pubComp)
+	}
+}
@@ -0,0 +1,161 @@
+package test
+
+import (
+	"encoding/binary"
+	"net-capture/pkg/message"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mysqlPacket(seq byte, payload string) string {
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}
+	return string(header) + payload
+}
+
+func mysqlGreeting() string {
+	return mysqlPacket(0, "\x0a8.0.36\x00"+strings.Repeat("\x00", 40))
+}
+
+func mysqlLogin(capabilities uint32) string {
+	header := make([]byte, 32)
+	binary.LittleEndian.PutUint32(header, capabilities)
+	return mysqlPacket(1, string(header)+"root\x00\x14"+strings.Repeat("x", 20)+"shop\x00")
+}
+
+func mysqlRecords(t *testing.T, messages []*message.NetMessage) []*message.MySQLMessage {
+	var records []*message.MySQLMessage
+	for _, msg := range messages {
+		record, ok := msg.Record.(*message.MySQLMessage)
+		if !ok {
+			t.Fatalf("message was not decoded as mysql: %q", msg.Payload)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestMySQLQueries(t *testing.T) {
+	c := &conversation{conn: newTCPConn(3306)}
+	c.send(false, mysqlGreeting())
+	// protocol 41, secure connection, connect with db and length encoded auth data
+	c.send(true, mysqlLogin(0x0200|0x8000|0x0008|0x00200000))
+	c.send(false, mysqlPacket(2, "\x00\x00\x00\x02\x00\x00\x00"))
+
+	c.send(true, mysqlPacket(0, "\x03SELECT id FROM users"))
+	eof := "\xfe\x00\x00\x02\x00"
+	c.send(false, mysqlPacket(1, "\x01")+mysqlPacket(2, "\x03def\x04shop\x05users")+mysqlPacket(3, eof)+
+		mysqlPacket(4, "\x011")+mysqlPacket(5, "\x012")+mysqlPacket(6, eof))
+
+	c.send(true, mysqlPacket(0, "\x16UPDATE users SET name=? WHERE id=?"))
+	c.send(false, mysqlPacket(1, "\x00\x07\x00\x00\x00\x00\x00\x02\x00\x00\x00\x00")+
+		mysqlPacket(2, "\x03def")+mysqlPacket(3, "\x03def")+mysqlPacket(4, eof))
+	c.send(true, mysqlPacket(0, "\x17\x07\x00\x00\x00\x00\x01\x00\x00\x00"))
+	c.send(false, mysqlPacket(1, "\x00\x01\x00\x02\x00\x00\x00"))
+
+	c.send(true, mysqlPacket(0, "\x03SELECT * FROM missing"))
+	c.send(false, mysqlPacket(1, "\xff\x7a\x04#42S02Table 'shop.missing' doesn't exist"))
+	c.send(true, mysqlPacket(0, "\x01"))
+
+	records := mysqlRecords(t, parsePackets(3306, c.packets...))
+	if len(records) != 12 {
+		t.Fatalf("expected 12 records, got %d", len(records))
+	}
+
+	if greeting := records[0]; greeting.Status != "HANDSHAKE" || greeting.ServerVersion != "8.0.36" {
+		t.Errorf("unexpected greeting %+v", greeting)
+	}
+	if login := records[1]; login.Command != "LOGIN" || login.User != "root" || login.Database != "shop" {
+		t.Errorf("unexpected login %+v", login)
+	}
+	if query := records[3]; query.Command != "COM_QUERY" || query.Query != "SELECT id FROM users" {
+		t.Errorf("unexpected query %+v", query)
+	}
+	if result := records[4]; result.Status != "RESULTSET" || result.Columns != 1 || result.Rows != 2 || result.Query != "SELECT id FROM users" {
+		t.Errorf("unexpected result set %+v", result)
+	}
+	if prepared := records[6]; prepared.Status != "OK" || prepared.StatementID != 7 {
+		t.Errorf("unexpected prepare response %+v", prepared)
+	}
+	if execute := records[7]; execute.Command != "COM_STMT_EXECUTE" || execute.StatementID != 7 || !strings.HasPrefix(execute.Query, "UPDATE") {
+		t.Errorf("unexpected execute %+v", execute)
+	}
+	if ok := records[8]; ok.Status != "OK" || ok.AffectedRows != 1 {
+		t.Errorf("unexpected execute response %+v", ok)
+	}
+	if err := records[10]; err.Status != "ERR" || err.ErrorCode != 1146 || err.SQLState != "42S02" || err.ErrorMessage == "" {
+		t.Errorf("unexpected error response %+v", err)
+	}
+	if quit := records[11]; quit.Command != "COM_QUIT" {
+		t.Errorf("unexpected quit %+v", quit)
+	}
+}
+
+func TestMySQLSkipsTLS(t *testing.T) {
+	c := &conversation{conn: newTCPConn(3306)}
+	c.send(false, mysqlGreeting())
+	ssl := make([]byte, 32)
+	binary.LittleEndian.PutUint32(ssl, 0x0200|0x8000|0x0800)
+	c.send(true, mysqlPacket(1, string(ssl))+"\x16\x03\x01\x00\x05hello")
+	c.send(false, "\x16\x03\x03\x00\x05world")
+
+	messages := parsePackets(3306, c.packets...)
+	if len(messages) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(messages))
+	}
+	if record, ok := messages[1].Record.(*message.MySQLMessage); !ok || record.Command != "SSL_REQUEST" {
+		t.Errorf("expected the SSL request, got %+v", messages[1].Record)
+	}
+	for _, msg := range messages[2:] {
+		if msg.Record != nil {
+			t.Errorf("TLS data should not be decoded, got %+v", msg.Record)
+		}
+	}
+}
+
+func TestMySQLBadAuthLength(t *testing.T) {
+	c := &conversation{conn: newTCPConn(3306)}
+	c.send(false, mysqlGreeting())
+	header := make([]byte, 32)
+	binary.LittleEndian.PutUint32(header, 0x0200|0x8000|0x0008|0x00200000)
+	// the length encoded auth data length is negative as an int
+	c.send(true, mysqlPacket(1, string(header)+"root\x00\xfe\x00\x00\x00\x00\x00\x00\x00\xc0shop\x00"))
+
+	records := mysqlRecords(t, parsePackets(3306, c.packets...))
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if login := records[1]; login.Command != "LOGIN" || login.User != "root" || login.Database != "" {
+		t.Errorf("unexpected login %+v", login)
+	}
+}
+
+func TestMySQLDuration(t *testing.T) {
+	c := &conversation{conn: newTCPConn(3306)}
+	c.send(true, mysqlPacket(0, "\x03SELECT 1"))
+	c.conn.timestamp = c.conn.timestamp.Add(200 * time.Millisecond)
+	c.send(false, mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00"))
+	// COM_STMT_CLOSE is not answered, the response to the next query must not be measured from it
+	c.conn.timestamp = c.conn.timestamp.Add(time.Second)
+	c.send(true, mysqlPacket(0, "\x19\x07\x00\x00\x00"))
+	c.send(true, mysqlPacket(0, "\x03SELECT 2"))
+	c.conn.timestamp = c.conn.timestamp.Add(50 * time.Millisecond)
+	c.send(false, mysqlPacket(1, "\x00\x00\x00\x02\x00\x00\x00"))
+
+	messages := parsePackets(3306, c.packets...)
+	records := mysqlRecords(t, messages)
+	if len(records) != 5 {
+		t.Fatalf("expected 5 records, got %d", len(records))
+	}
+	if first := records[1]; first.Query != "SELECT 1" || first.DurationMs < 200 || first.DurationMs > 202 {
+		t.Errorf("unexpected first response %+v", first)
+	}
+	if closed := records[2]; closed.Command != "COM_STMT_CLOSE" || closed.DurationMs != 0 {
+		t.Errorf("unexpected close %+v", closed)
+	}
+	second := records[4]
+	expected := float64(messages[4].Timestamp.Sub(messages[3].Timestamp)) / float64(time.Millisecond)
+	if second.Query != "SELECT 2" || second.DurationMs != expected || expected < 50 || expected > 53 {
+		t.Errorf("unexpected second response %+v, expected %.3fms", second, expected)
+	}
+}
@@ -0,0 +1,93 @@
+package test
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"net-capture/pkg/output"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPcapOutputRotation(t *testing.T) {
+	dir := t.TempDir()
+	o := output.NewPcapOutput(model.PcapOutputConfig{
+		Path:     filepath.Join(dir, "capture.pcap"),
+		MaxSize:  1,
+		MaxFiles: 2,
+	})
+
+	conn := newTCPConn(8080)
+	for i := 0; i < 3; i++ {
+		msg := &message.NetMessage{Packets: []gopacket.Packet{conn.client(0, "data")}}
+		if err := o.PluginWrite(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pcap"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files to be kept, got %v", files)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "capture_3.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := reader.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		t.Error("expected packet data in the rotated file")
+	}
+}
+
+func TestPcapOutputRotationWithinSecond(t *testing.T) {
+	dir := t.TempDir()
+	o := output.NewPcapOutput(model.PcapOutputConfig{
+		Path:     filepath.Join(dir, "capture-%Y%m%d%H%M%S.pcap"),
+		MaxSize:  1,
+		MaxFiles: 2,
+	})
+
+	conn := newTCPConn(8080)
+	for i := 0; i < 3; i++ {
+		msg := &message.NetMessage{Packets: []gopacket.Packet{conn.client(0, "data")}}
+		if err := o.PluginWrite(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pcap"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files to be kept, got %v", files)
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := pcapgo.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = reader.ReadPacketData(); err != nil {
+			t.Errorf("expected a packet in %s: %v", file, err)
+		}
+		_ = f.Close()
+	}
+}
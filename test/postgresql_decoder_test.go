@@ -0,0 +1,126 @@
+package test
+
+import (
+	"encoding/binary"
+	"net-capture/pkg/message"
+	"testing"
+	"time"
+)
+
+func postgresMessage(kind byte, body string) string {
+	header := make([]byte, 5)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(body)+4))
+	return string(header) + body
+}
+
+func postgresStartup(params string) string {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(params)+9))
+	binary.BigEndian.PutUint32(header[4:], 196608)
+	return string(header) + params + "\x00"
+}
+
+func TestPostgreSQLQueries(t *testing.T) {
+	c := &conversation{conn: newTCPConn(5432)}
+	c.send(true, postgresStartup("user\x00app\x00database\x00shop\x00"))
+	c.send(false, postgresMessage('R', "\x00\x00\x00\x00")+postgresMessage('S', "TimeZone\x00UTC\x00")+
+		postgresMessage('K', "\x00\x00\x00\x01\x00\x00\x00\x02")+postgresMessage('Z', "I"))
+
+	c.send(true, postgresMessage('Q', "SELECT id FROM users\x00"))
+	c.send(false, postgresMessage('T', "\x00\x01id\x00")+postgresMessage('D', "\x00\x01\x00\x00\x00\x011")+
+		postgresMessage('D', "\x00\x01\x00\x00\x00\x012")+postgresMessage('C', "SELECT 2\x00")+postgresMessage('Z', "I"))
+
+	c.send(true, postgresMessage('P', "upd\x00UPDATE users SET name = $1\x00\x00\x00")+
+		postgresMessage('B', "\x00upd\x00\x00\x00\x00\x00\x00\x00")+postgresMessage('E', "\x00\x00\x00\x00\x00")+
+		postgresMessage('S', ""))
+	c.send(false, postgresMessage('1', "")+postgresMessage('2', "")+postgresMessage('C', "UPDATE 3\x00")+postgresMessage('Z', "I"))
+
+	c.send(true, postgresMessage('Q', "SELECT * FROM missing\x00"))
+	c.send(false, postgresMessage('E', "SERROR\x00VERROR\x00C42P01\x00Mrelation \"missing\" does not exist\x00\x00")+
+		postgresMessage('Z', "I"))
+
+	var records []*message.PostgreSQLMessage
+	for _, msg := range parsePackets(5432, c.packets...) {
+		record, ok := msg.Record.(*message.PostgreSQLMessage)
+		if !ok {
+			t.Fatalf("message was not decoded as postgresql: %q", msg.Payload)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 8 {
+		t.Fatalf("expected 8 records, got %d", len(records))
+	}
+
+	if startup := records[0]; startup.User != "app" || startup.Database != "shop" {
+		t.Errorf("unexpected startup %+v", startup)
+	}
+	if ready := records[1]; ready.TransactionStatus != "idle" || len(ready.Messages) != 4 {
+		t.Errorf("unexpected startup response %+v", ready)
+	}
+	if result := records[3]; result.Rows != 2 || result.Columns != 1 || len(result.CommandTags) != 1 || result.CommandTags[0] != "SELECT 2" {
+		t.Errorf("unexpected query response %+v", result)
+	}
+	if extended := records[4]; len(extended.Messages) != 4 || extended.Statement != "upd" || extended.Query != "UPDATE users SET name = $1" {
+		t.Errorf("unexpected extended query %+v", extended)
+	}
+	if updated := records[5]; len(updated.CommandTags) != 1 || updated.CommandTags[0] != "UPDATE 3" {
+		t.Errorf("unexpected extended query response %+v", updated)
+	}
+	if failed := records[7]; failed.ErrorCode != "42P01" || failed.ErrorSeverity != "ERROR" || failed.ErrorMessage == "" {
+		t.Errorf("unexpected error response %+v", failed)
+	}
+}
+
+func TestPostgreSQLSkipsSSL(t *testing.T) {
+	c := &conversation{conn: newTCPConn(5432)}
+	c.send(true, "\x00\x00\x00\x08\x04\xd2\x16\x2f")
+	c.send(false, "S")
+	c.send(true, "\x16\x03\x01\x00\x05hello")
+	c.send(false, "\x16\x03\x03\x00\x05world")
+
+	messages := parsePackets(5432, c.packets...)
+	if len(messages) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(messages))
+	}
+	for _, msg := range messages[2:] {
+		if msg.Record != nil {
+			t.Errorf("encrypted data should not be decoded, got %+v", msg.Record)
+		}
+	}
+}
+
+func TestPostgreSQLDuration(t *testing.T) {
+	c := &conversation{conn: newTCPConn(5432)}
+	c.send(true, postgresStartup("user\x00app\x00database\x00shop\x00"))
+	c.send(false, postgresMessage('R', "\x00\x00\x00\x00")+postgresMessage('Z', "I"))
+
+	c.send(true, postgresMessage('Q', "SELECT 1\x00"))
+	c.conn.timestamp = c.conn.timestamp.Add(30 * time.Millisecond)
+	c.send(false, postgresMessage('C', "SELECT 1\x00")+postgresMessage('Z', "I"))
+
+	c.conn.timestamp = c.conn.timestamp.Add(time.Second)
+	c.send(true, postgresMessage('P', "\x00SELECT 2\x00\x00\x00")+postgresMessage('B', "\x00\x00\x00\x00\x00\x00\x00\x00")+
+		postgresMessage('E', "\x00\x00\x00\x00\x00")+postgresMessage('S', ""))
+	c.conn.timestamp = c.conn.timestamp.Add(80 * time.Millisecond)
+	c.send(false, postgresMessage('1', "")+postgresMessage('2', "")+postgresMessage('C', "SELECT 1\x00"))
+	c.send(false, postgresMessage('Z', "I"))
+
+	messages := parsePackets(5432, c.packets...)
+	if len(messages) != 6 {
+		t.Fatalf("expected 6 messages, got %d", len(messages))
+	}
+	duration := func(i int) float64 {
+		return messages[i].Record.(*message.PostgreSQLMessage).DurationMs
+	}
+	if startup := duration(1); startup != 0 {
+		t.Errorf("unexpected duration of the startup response %.3fms", startup)
+	}
+	if simple := duration(3); simple != 31 {
+		t.Errorf("expected the simple query to take 31ms, got %.3fms", simple)
+	}
+	// the group of the server ends with ReadyForQuery in the second packet
+	if extended := duration(5); extended != 82 {
+		t.Errorf("expected the extended query to take 82ms, got %.3fms", extended)
+	}
+}
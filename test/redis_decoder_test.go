@@ -0,0 +1,63 @@
+package test
+
+import (
+	"net-capture/pkg/message"
+	"testing"
+)
+
+func TestRedisPipelinedCommands(t *testing.T) {
+	conn := newTCPConn(6379)
+	commands := "*3\r\n$3\r\nSET\r\n$4\r\nuser\r\n$5\r\nalice\r\n*2\r\n$4\r\nhget\r\n$4\r\nhash\r\n"
+	replies := "+OK\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	messages := parsePackets(6379,
+		conn.client(0, commands[:20]),
+		conn.client(20, commands[20:]),
+		conn.server(0, replies),
+		conn.client(uint32(len(commands)), "PING\r\n"),
+		conn.server(uint32(len(replies)), "%1\r\n+role\r\n$6\r\nmaster\r\n"),
+	)
+
+	var records []*message.RedisMessage
+	for _, msg := range messages {
+		record, ok := msg.Record.(*message.RedisMessage)
+		if !ok {
+			t.Fatalf("message was not decoded as redis: %q", msg.Payload)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 6 {
+		t.Fatalf("expected 6 records, got %d", len(records))
+	}
+
+	if set := records[0]; set.Command != "SET" || set.Key != "user" || set.Args != 2 || set.Size != 34 {
+		t.Errorf("unexpected SET command %+v", set)
+	}
+	if hget := records[1]; hget.Command != "HGET" || hget.Key != "hash" || hget.Args != 1 {
+		t.Errorf("unexpected HGET command %+v", hget)
+	}
+	if ok := records[2]; ok.ReplyType != "simple_string" || ok.Command != "SET" {
+		t.Errorf("unexpected SET reply %+v", ok)
+	}
+	if wrongType := records[3]; wrongType.ReplyType != "error" || wrongType.Command != "HGET" || wrongType.Error == "" {
+		t.Errorf("unexpected HGET reply %+v", wrongType)
+	}
+	if ping := records[4]; ping.Command != "PING" || ping.Key != "" || ping.Args != 0 {
+		t.Errorf("unexpected inline command %+v", ping)
+	}
+	if role := records[5]; role.ReplyType != "map" || role.Command != "PING" || role.Args != 1 {
+		t.Errorf("unexpected RESP3 reply %+v", role)
+	}
+}
+
+func TestRedisHugeBulkLength(t *testing.T) {
+	conn := newTCPConn(6379)
+	payload := "*1\r\n$9223372036854775807\r\nPING\r\n"
+	messages := parsePackets(6379, conn.client(0, payload))
+
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	if _, ok := messages[0].Record.(*message.RedisMessage); ok || string(messages[0].Payload) != payload {
+		t.Errorf("expected the invalid command to be emitted undecoded, got %q", messages[0].Payload)
+	}
+}
@@ -0,0 +1,197 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"net-capture/pkg/output"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayOutput(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the target answers every line with the line in upper case
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					_, _ = conn.Write([]byte("ECHO " + scanner.Text() + "\n"))
+				}
+			}(conn)
+		}
+	}()
+
+	record := filepath.Join(t.TempDir(), "replay.jsonl")
+	o := output.NewReplayOutput(model.ReplayOutputConfig{
+		Target:          listener.Addr().String(),
+		ReuseConnection: true,
+		RecordPath:      record,
+	})
+
+	conn := newTCPConn(8080)
+	messages := parsePackets(8080,
+		conn.client(0, "first\n"),
+		conn.server(0, "ignored response\n"),
+		conn.client(6, "second\n"),
+	)
+	for _, msg := range messages {
+		if err := o.PluginWrite(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = o.Close()
+
+	f, err := os.Open(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var responses []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r output.ReplayRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Error != "" {
+			t.Errorf("unexpected replay error %s", r.Error)
+		}
+		responses = append(responses, r.Response)
+	}
+
+	if len(responses) != 2 || responses[0] != "ECHO first\n" || responses[1] != "ECHO second\n" {
+		t.Errorf("requests were not replayed in order, got %q", responses)
+	}
+}
+
+func TestReplayOutputDiscardResponse(t *testing.T) {
+	target, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	record := filepath.Join(t.TempDir(), "replay.jsonl")
+	o := output.NewReplayOutput(model.ReplayOutputConfig{
+		Target:          target.LocalAddr().String(),
+		RecordPath:      record,
+		Timeout:         time.Minute,
+		DiscardResponse: true,
+	})
+
+	start := time.Now()
+	msg := &message.NetMessage{Request: true, Protocol: model.ProtocolUDP, Timestamp: start, Payload: []byte("fire and forget")}
+	if err := o.PluginWrite(msg); err != nil {
+		t.Fatal(err)
+	}
+	_ = o.Close()
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("replay waited %s for a response", elapsed)
+	}
+
+	buf := make([]byte, 64)
+	_ = target.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := target.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "fire and forget" {
+		t.Errorf("request was not replayed: %q %v", buf[:n], err)
+	}
+
+	data, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r output.ReplayRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Error != "" || r.RequestSize != len("fire and forget") || r.ResponseSize != 0 {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+func TestReplayOutputHTTPKeepAlive(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the target sends both responses at once, the second one must be kept for the second request
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if _, err = http.ReadRequest(reader); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nfirst" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nsecond"))
+		_, _ = http.ReadRequest(reader)
+		_, _ = io.Copy(io.Discard, reader)
+	}()
+
+	record := filepath.Join(t.TempDir(), "replay.jsonl")
+	o := output.NewReplayOutput(model.ReplayOutputConfig{
+		Target:          listener.Addr().String(),
+		ReuseConnection: true,
+		RecordPath:      record,
+		Timeout:         time.Second,
+	})
+
+	c := &conversation{conn: newTCPConn(8080)}
+	c.send(true, "GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	c.send(false, "HTTP/1.1 204 No Content\r\n\r\n")
+	c.send(true, "GET /second HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	for _, msg := range parsePackets(8080, c.packets...) {
+		if err := o.PluginWrite(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = o.Close()
+
+	f, err := os.Open(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var responses []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r output.ReplayRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Error != "" {
+			t.Errorf("unexpected replay error %s", r.Error)
+		}
+		responses = append(responses, r.Response)
+	}
+	if len(responses) != 2 || !strings.HasSuffix(responses[0], "\r\n\r\nfirst") ||
+		!strings.HasSuffix(responses[1], "\r\n\r\nsecond") {
+		t.Errorf("unexpected responses %q", responses)
+	}
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"net-capture/pkg/parser"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrackResponse(t *testing.T) {
+	conn := newTCPConn(8080)
+	messages := parsePacketsWith(func(p *parser.MessageParser) { p.TrackResponse(time.Minute) }, 8080,
+		conn.client(0, "first request"),
+		conn.server(0, "first response"),
+		conn.client(13, "second request"),
+	)
+
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+
+	answered := messages[0]
+	if string(answered.Payload) != "first request" || answered.Response == nil {
+		t.Fatalf("expected the first request to be paired, got %q", answered.Payload)
+	}
+	if string(answered.Response.Payload) != "first response" {
+		t.Errorf("unexpected response payload %q", answered.Response.Payload)
+	}
+	if answered.Latency != answered.Response.Timestamp.Sub(answered.Timestamp) || answered.Latency <= 0 {
+		t.Errorf("unexpected latency %s", answered.Latency)
+	}
+
+	unanswered := messages[1]
+	if string(unanswered.Payload) != "second request" || unanswered.Response != nil {
+		t.Errorf("expected the second request to be emitted unanswered, got %q", unanswered.Payload)
+	}
+}
+
+func TestTrackResponseExpiry(t *testing.T) {
+	conn := newTCPConn(8080)
+	first := conn.client(0, "first request")
+	// the first response arrives after the timeout, the requests after it are still paired in order
+	conn.timestamp = conn.timestamp.Add(2 * time.Second)
+	messages := parsePacketsWith(func(p *parser.MessageParser) { p.TrackResponse(time.Second) }, 8080,
+		first,
+		conn.server(0, "late response"),
+		conn.client(13, "second request"),
+		conn.server(13, "second response"),
+	)
+
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(messages))
+	}
+	if expired := messages[0]; string(expired.Payload) != "first request" || expired.Response != nil || !expired.Request {
+		t.Errorf("expected the first request to expire unanswered, got %q", expired.Payload)
+	}
+	if late := messages[1]; string(late.Payload) != "late response" || late.Request {
+		t.Errorf("expected the late response to be emitted alone, got %q", late.Payload)
+	}
+	answered := messages[2]
+	if string(answered.Payload) != "second request" || answered.Response == nil || string(answered.Response.Payload) != "second response" {
+		t.Fatalf("expected the second request to be paired with its response, got %q", answered.Payload)
+	}
+	if answered.Latency <= 0 || answered.Latency >= time.Second {
+		t.Errorf("unexpected latency %s", answered.Latency)
+	}
+}
+
+func TestTrackResponsePendingBound(t *testing.T) {
+	conn := newTCPConn(6379)
+	// one more pipelined command than the tracker keeps waiting for a response
+	commands := strings.Repeat("PING\r\n", 1025)
+	messages := parsePacketsWith(func(p *parser.MessageParser) { p.TrackResponse(time.Minute) }, 6379,
+		conn.client(0, commands),
+		conn.server(0, "+PONG\r\n"),
+	)
+
+	if len(messages) != 1025 {
+		t.Fatalf("expected 1025 messages, got %d", len(messages))
+	}
+	if dropped := messages[0]; dropped.Response != nil {
+		t.Errorf("expected the oldest command to be emitted unanswered first")
+	}
+	if answered := messages[1]; answered.Response == nil || string(answered.Response.Payload) != "+PONG\r\n" {
+		t.Errorf("expected the second command to be paired with the reply")
+	}
+	for _, msg := range messages[2:] {
+		if msg.Response != nil {
+			t.Fatalf("unexpected response for a pending command")
+		}
+	}
+}
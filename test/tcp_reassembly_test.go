@@ -0,0 +1,258 @@
+package test
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"net-capture/pkg/message"
+	"net-capture/pkg/model"
+	"net-capture/pkg/parser"
+	"testing"
+	"time"
+)
+
+var (
+	clientIP  = net.IP{10, 0, 0, 1}
+	serverIP  = net.IP{10, 0, 0, 2}
+	clientIP6 = net.ParseIP("fd00::1")
+	serverIP6 = net.ParseIP("fd00::2")
+)
+
+// tcpConn builds the packets of a single TCP connection between clientIP:40000 and serverIP:port
+type tcpConn struct {
+	clientIP  net.IP
+	serverIP  net.IP
+	port      uint16
+	clientSeq uint32
+	serverSeq uint32
+	timestamp time.Time
+}
+
+func newTCPConn(port uint16) *tcpConn {
+	return &tcpConn{clientIP: clientIP, serverIP: serverIP, port: port, clientSeq: 1000, serverSeq: 5000, timestamp: time.Unix(1700000000, 0)}
+}
+
+// newTCPConn6 is newTCPConn between clientIP6 and serverIP6
+func newTCPConn6(port uint16) *tcpConn {
+	conn := newTCPConn(port)
+	conn.clientIP, conn.serverIP = clientIP6, serverIP6
+	return conn
+}
+
+// client returns a packet sent by the client carrying the payload at the given offset of the client stream
+func (c *tcpConn) client(offset uint32, payload string) gopacket.Packet {
+	return c.packet(true, c.clientSeq+offset, payload, false)
+}
+
+// server returns a packet sent by the server carrying the payload at the given offset of the server stream
+func (c *tcpConn) server(offset uint32, payload string) gopacket.Packet {
+	return c.packet(false, c.serverSeq+offset, payload, false)
+}
+
+func (c *tcpConn) clientFin(offset uint32) gopacket.Packet {
+	return c.packet(true, c.clientSeq+offset, "", true)
+}
+
+func (c *tcpConn) packet(fromClient bool, seq uint32, payload string, fin bool) gopacket.Packet {
+	src, dst := c.clientIP, c.serverIP
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(c.port), Seq: seq, ACK: true, PSH: payload != "", FIN: fin, Window: 65535}
+	if !fromClient {
+		src, dst = dst, src
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	}
+
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+	var ip gopacket.NetworkLayer = &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+	if src.To4() == nil {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+	}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	_ = gopacket.SerializeLayers(buf, opts, eth, ip.(gopacket.SerializableLayer), tcp, gopacket.Payload(payload))
+
+	c.timestamp = c.timestamp.Add(time.Millisecond)
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+	packet.Metadata().Timestamp = c.timestamp
+	packet.Metadata().CaptureLength = len(buf.Bytes())
+	packet.Metadata().Length = len(buf.Bytes())
+	return packet
+}
+
+// conversation builds the packets of a connection from the data sent by each side in turn
+type conversation struct {
+	conn    *tcpConn
+	client  uint32
+	server  uint32
+	packets []gopacket.Packet
+}
+
+func (c *conversation) send(fromClient bool, data string) {
+	if fromClient {
+		c.packets = append(c.packets, c.conn.client(c.client, data))
+		c.client += uint32(len(data))
+	} else {
+		c.packets = append(c.packets, c.conn.server(c.server, data))
+		c.server += uint32(len(data))
+	}
+}
+
+// parsePackets feeds the packets into a MessageParser and returns everything it emitted
+func parsePackets(port uint16, packets ...gopacket.Packet) []*message.NetMessage {
+	return parsePacketsWith(nil, port, packets...)
+}
+
+// parsePacketsWith is parsePackets with the chance to configure the parser before packets are handled
+func parsePacketsWith(configure func(p *parser.MessageParser), port uint16, packets ...gopacket.Packet) []*message.NetMessage {
+	messages := make(chan *message.NetMessage, 2048)
+	messageParser := parser.NewMessageParser(messages, "", model.Ports{{From: port, To: port}}, []net.IP{serverIP}, 2*time.Second)
+	if configure != nil {
+		configure(messageParser)
+	}
+	for _, packet := range packets {
+		messageParser.PacketHandler(packet)
+	}
+	messageParser.Close()
+	close(messages)
+
+	var result []*message.NetMessage
+	for msg := range messages {
+		result = append(result, msg)
+	}
+	return result
+}
+
+func TestTCPReassemblyOutOfOrder(t *testing.T) {
+	conn := newTCPConn(8080)
+	messages := parsePackets(8080,
+		conn.client(0, "hello "),
+		conn.client(11, "again"),
+		conn.client(6, "world"),
+		// retransmission and overlap must not duplicate data
+		conn.client(6, "world"),
+		conn.client(8, "rld ag"),
+		conn.server(0, "response"),
+		conn.clientFin(16),
+	)
+
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if string(messages[0].Payload) != "hello worldagain" {
+		t.Errorf("unexpected request payload %q", messages[0].Payload)
+	}
+	if messages[0].Transport.Dst().String() != "8080" {
+		t.Errorf("request should be sent to the server, got %s", messages[0].Transport)
+	}
+	if string(messages[1].Payload) != "response" {
+		t.Errorf("unexpected response payload %q", messages[1].Payload)
+	}
+	if messages[1].Transport.Src().String() != "8080" {
+		t.Errorf("response should be sent by the server, got %s", messages[1].Transport)
+	}
+}
+
+func TestRequestDirectionWithPortRange(t *testing.T) {
+	messages := make(chan *message.NetMessage, 10)
+	ports := model.Ports{{From: 8080, To: 8080}, {From: 9000, To: 9010}}
+	messageParser := parser.NewMessageParser(messages, "", ports, []net.IP{serverIP}, 2*time.Second)
+
+	conn := newTCPConn(9005)
+	messageParser.PacketHandler(conn.client(0, "request"))
+	messageParser.PacketHandler(conn.server(0, "response"))
+	messageParser.Close()
+	close(messages)
+
+	request, response := <-messages, <-messages
+	if request == nil || !request.Request || response == nil || response.Request {
+		t.Errorf("expected a request to port 9005 followed by its response")
+	}
+}
+
+func TestRequestDirectionIPv6(t *testing.T) {
+	conn := newTCPConn6(8080)
+	messages := parsePackets(8080,
+		conn.client(0, "request"),
+		conn.server(0, "response"),
+		conn.clientFin(7),
+	)
+
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	request, response := messages[0], messages[1]
+	if !request.Request || request.Network.Src().String() != "fd00::1" || request.Network.Dst().String() != "fd00::2" {
+		t.Errorf("unexpected request %s %s, request %v", request.Network, request.Transport, request.Request)
+	}
+	if response.Request || response.Network.Src().String() != "fd00::2" || string(response.Payload) != "response" {
+		t.Errorf("unexpected response %s %s, request %v", response.Network, response.Transport, response.Request)
+	}
+}
+
+func TestFlowMetadata(t *testing.T) {
+	conn := newTCPConn(8080)
+	messages := parsePackets(8080,
+		conn.client(0, "request"),
+		conn.server(0, "response"),
+		conn.clientFin(7),
+	)
+
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	request, response := messages[0], messages[1]
+	if request.Protocol != "tcp" || !request.SrcIP.Equal(clientIP) || request.SrcPort != 40000 || !request.DstIP.Equal(serverIP) || request.DstPort != 8080 {
+		t.Errorf("unexpected request 5-tuple %s %s:%d -> %s:%d", request.Protocol, request.SrcIP, request.SrcPort, request.DstIP, request.DstPort)
+	}
+	if request.Direction != message.DirectionIncoming || response.Direction != message.DirectionOutgoing {
+		t.Errorf("unexpected directions %s and %s", request.Direction, response.Direction)
+	}
+	if request.ConnectionID == "" || request.ConnectionID != response.ConnectionID {
+		t.Errorf("request and response should share the connection id, got %q and %q", request.ConnectionID, response.ConnectionID)
+	}
+}
+
+func TestTCPIdleConnectionKeepsDecoder(t *testing.T) {
+	client, server := newHTTP2Side(), newHTTP2Side()
+	c := &conversation{conn: newTCPConn(8080)}
+	_ = client.framer.WriteSettings()
+	client.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/first")
+	c.send(true, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"+client.flush())
+	_ = server.framer.WriteSettings()
+	server.writeHeaders(1, true, ":status", "200")
+	c.send(false, server.flush())
+	// the second request refers to the HPACK table filled by the first one
+	c.conn.timestamp = c.conn.timestamp.Add(3500 * time.Millisecond)
+	client.writeHeaders(3, true, ":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/second")
+	c.send(true, client.flush())
+
+	messages := make(chan *message.NetMessage, 16)
+	messageParser := parser.NewMessageParser(messages, "", model.Ports{{From: 8080, To: 8080}}, []net.IP{serverIP}, 100*time.Millisecond)
+	for _, packet := range c.packets[:2] {
+		messageParser.PacketHandler(packet)
+	}
+	// the connection is idle for longer than the expiry when the parser checks for expired connections
+	time.Sleep(1200 * time.Millisecond)
+	if len(messages) != 2 {
+		t.Errorf("expected the data of the idle connection to be emitted, got %d messages", len(messages))
+	}
+	messageParser.PacketHandler(c.packets[2])
+	messageParser.Close()
+	close(messages)
+
+	var paths []string
+	for msg := range messages {
+		record, ok := msg.Record.(*message.HTTP2Message)
+		if !ok {
+			t.Fatalf("message was not decoded as http2: %q", msg.Payload)
+		}
+		if msg.Request {
+			paths = append(paths, record.Path)
+		}
+	}
+	if len(paths) != 2 || paths[0] != "/first" || paths[1] != "/second" {
+		t.Errorf("unexpected requests %v", paths)
+	}
+}
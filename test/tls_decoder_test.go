@@ -0,0 +1,297 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"net-capture/pkg/message"
+	"net-capture/pkg/parser"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingConn logs the data written to it into a conversation shared by both ends of a pipe
+type recordingConn struct {
+	net.Conn
+	client bool
+	lock   *sync.Mutex
+	c      *conversation
+}
+
+func (r *recordingConn) Write(b []byte) (int, error) {
+	r.lock.Lock()
+	r.c.send(r.client, string(b))
+	r.lock.Unlock()
+	return r.Conn.Write(b)
+}
+
+func selfSignedCertificate(t *testing.T, notAfter time.Time) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com", Organization: []string{"Example"}},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    notAfter.AddDate(-1, 0, 0),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsConfigs returns the configurations of a client connecting to example.com and a server offering both http/2
+// and http/1.1, the server does not send session tickets
+func tlsConfigs(maxVersion uint16, cert tls.Certificate) (client *tls.Config, server *tls.Config) {
+	client = &tls.Config{
+		ServerName:         "example.com",
+		NextProtos:         []string{"h2", "http/1.1"},
+		MaxVersion:         maxVersion,
+		InsecureSkipVerify: true,
+	}
+	server = &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		NextProtos:             []string{"h2", "http/1.1"},
+		SessionTicketsDisabled: true,
+	}
+	return
+}
+
+// tlsConversation runs a handshake of crypto/tls over a pipe and records what both sides sent, after it the
+// client sends request and the server answers with response
+func tlsConversation(t *testing.T, clientConfig, serverConfig *tls.Config, request, response string) *conversation {
+	c := &conversation{conn: newTCPConn(443)}
+	lock := &sync.Mutex{}
+	clientEnd, serverEnd := net.Pipe()
+	defer func() { _ = clientEnd.Close() }()
+	defer func() { _ = serverEnd.Close() }()
+
+	server := tls.Server(&recordingConn{Conn: serverEnd, lock: lock, c: c}, serverConfig)
+	client := tls.Client(&recordingConn{Conn: clientEnd, client: true, lock: lock, c: c}, clientConfig)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Write([]byte(request))
+		if err == nil {
+			_, err = io.ReadFull(client, make([]byte, len(response)))
+		}
+		errs <- err
+	}()
+	if _, err := io.ReadFull(server, make([]byte, len(request))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Write([]byte(response)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func tlsRecordsOf(t *testing.T, messages []*message.NetMessage) []*message.TLSMessage {
+	var records []*message.TLSMessage
+	for _, msg := range messages {
+		record, ok := msg.Record.(*message.TLSMessage)
+		if !ok {
+			t.Fatalf("message was not decoded as tls: %q", msg.Payload)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestTLS12Handshake(t *testing.T) {
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	clientConfig, serverConfig := tlsConfigs(tls.VersionTLS12, selfSignedCertificate(t, notAfter))
+	c := tlsConversation(t, clientConfig, serverConfig, "ping", "pong")
+	records := tlsRecordsOf(t, parsePackets(443, c.packets...))
+	if len(records) < 4 {
+		t.Fatalf("expected at least 4 records, got %d", len(records))
+	}
+
+	hello := records[0]
+	if len(hello.Handshakes) != 1 || hello.Handshakes[0] != "ClientHello" || hello.ServerName != "example.com" ||
+		strings.Join(hello.ALPN, ",") != "h2,http/1.1" || len(hello.CipherSuites) == 0 || hello.Version != "TLS 1.2" {
+		t.Errorf("unexpected client hello %+v", hello)
+	}
+	if fields := strings.Split(hello.JA3, ","); len(fields) != 5 || fields[0] != "771" {
+		t.Errorf("unexpected ja3 %q", hello.JA3)
+	}
+	if sum := md5.Sum([]byte(hello.JA3)); hello.JA3Hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected ja3 hash %q", hello.JA3Hash)
+	}
+
+	serverHello := records[1]
+	if serverHello.Handshakes[0] != "ServerHello" || serverHello.Version != "TLS 1.2" || serverHello.CipherSuite == "" ||
+		strings.Join(serverHello.ALPN, ",") != "h2" || !strings.HasPrefix(serverHello.JA3S, "771,") || serverHello.JA3SHash == "" {
+		t.Errorf("unexpected server hello %+v", serverHello)
+	}
+	cert := serverHello.Certificate
+	if cert == nil || cert.Subject != "CN=example.com,O=Example" || !cert.NotAfter.Equal(notAfter) ||
+		len(cert.DNSNames) != 1 || cert.DNSNames[0] != "example.com" {
+		t.Errorf("unexpected certificate %+v", cert)
+	}
+
+	finished := records[2]
+	if n := len(finished.Handshakes); n < 2 || finished.Handshakes[n-2] != "ChangeCipherSpec" ||
+		finished.Handshakes[n-1] != "EncryptedHandshake" {
+		t.Errorf("unexpected client finished %+v", finished)
+	}
+	if data := records[len(records)-1]; data.ApplicationData == 0 || len(data.Handshakes) != 0 {
+		t.Errorf("unexpected application data %+v", data)
+	}
+}
+
+func TestTLS13Handshake(t *testing.T) {
+	clientConfig, serverConfig := tlsConfigs(tls.VersionTLS13, selfSignedCertificate(t, time.Now().AddDate(1, 0, 0)))
+	c := tlsConversation(t, clientConfig, serverConfig, "ping", "pong")
+	records := tlsRecordsOf(t, parsePackets(443, c.packets...))
+	if len(records) < 3 {
+		t.Fatalf("expected at least 3 records, got %d", len(records))
+	}
+
+	if hello := records[0]; hello.SupportedVersions[0] != "TLS 1.3" || hello.ServerName != "example.com" {
+		t.Errorf("unexpected client hello %+v", hello)
+	}
+	serverHello := records[1]
+	if serverHello.Handshakes[0] != "ServerHello" || serverHello.Version != "TLS 1.3" ||
+		serverHello.CipherSuite == "" || serverHello.Certificate != nil || len(serverHello.ALPN) != 0 {
+		t.Errorf("unexpected server hello %+v", serverHello)
+	}
+	for _, record := range records[2:] {
+		if record.Certificate != nil || record.Alert != "" {
+			t.Errorf("unexpected encrypted record %+v", record)
+		}
+	}
+}
+
+// writeKeyLog makes the client log its secrets to a key log file which the parser starts watching before it exists
+func writeKeyLog(t *testing.T, clientConfig *tls.Config) *parser.TLSKeyLog {
+	path := filepath.Join(t.TempDir(), "sslkeylog.txt")
+	keyLog, err := parser.LoadTLSKeyLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = file.Close() })
+	clientConfig.KeyLogWriter = file
+	return keyLog
+}
+
+func TestTLS12DecryptHTTP(t *testing.T) {
+	suites := map[string]uint16{
+		"gcm":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"cbc":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		"chacha": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	}
+	for name, suite := range suites {
+		t.Run(name, func(t *testing.T) {
+			clientConfig, serverConfig := tlsConfigs(tls.VersionTLS12, selfSignedCertificate(t, time.Now().AddDate(1, 0, 0)))
+			clientConfig.CipherSuites = []uint16{suite}
+			clientConfig.NextProtos = []string{"http/1.1"}
+			options := parser.DecoderOptions{TLSKeyLog: writeKeyLog(t, clientConfig)}
+			c := tlsConversation(t, clientConfig, serverConfig, "GET /secret HTTP/1.1\r\nHost: example.com\r\n\r\n",
+				"HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nhidden")
+
+			var requests, responses []*message.HTTPMessage
+			var finished bool
+			setOptions := func(p *parser.MessageParser) { p.SetDecoderOptions(options) }
+			for _, msg := range parsePacketsWith(setOptions, 443, c.packets...) {
+				switch record := msg.Record.(type) {
+				case *message.HTTPMessage:
+					if msg.Request {
+						requests = append(requests, record)
+					} else {
+						responses = append(responses, record)
+					}
+				case *message.TLSMessage:
+					if record.ApplicationData > 0 {
+						t.Errorf("application data was not decrypted %+v", record)
+					}
+					for _, handshake := range record.Handshakes {
+						finished = finished || handshake == "Finished"
+					}
+				default:
+					t.Fatalf("unexpected message %q", msg.Payload)
+				}
+			}
+			if len(requests) != 1 || requests[0].Method != "GET" || requests[0].URL != "/secret" {
+				t.Errorf("unexpected requests %+v", requests)
+			}
+			if len(responses) != 1 || responses[0].StatusCode != 200 || string(responses[0].Body) != "hidden" {
+				t.Errorf("unexpected responses %+v", responses)
+			}
+			if !finished {
+				t.Errorf("encrypted Finished was not decrypted")
+			}
+		})
+	}
+}
+
+func TestTLS13DecryptGRPC(t *testing.T) {
+	descriptors, err := parser.LoadGRPCDescriptors([]string{writeGreeterDescriptors(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := newHTTP2Side(), newHTTP2Side()
+	_ = client.framer.WriteSettings()
+	client.writeHeaders(1, false, ":method", "POST", ":scheme", "https", ":authority", "example.com",
+		":path", "/test.Greeter/Hello", "content-type", "application/grpc", "te", "trailers")
+	_ = client.framer.WriteData(1, true, grpcFrame("\x0a\x05alice"))
+	_ = server.framer.WriteSettings()
+	server.writeHeaders(1, false, ":status", "200", "content-type", "application/grpc")
+	_ = server.framer.WriteData(1, false, grpcFrame("\x0a\x0bhello alice"))
+	server.writeHeaders(1, true, "grpc-status", "0")
+
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	clientConfig, serverConfig := tlsConfigs(tls.VersionTLS13, selfSignedCertificate(t, notAfter))
+	options := parser.DecoderOptions{GRPCDescriptors: descriptors, TLSKeyLog: writeKeyLog(t, clientConfig)}
+	c := tlsConversation(t, clientConfig, serverConfig, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"+client.flush(), server.flush())
+
+	var calls []*message.GRPCCall
+	var handshake *message.TLSMessage
+	setOptions := func(p *parser.MessageParser) { p.SetDecoderOptions(options) }
+	for _, msg := range parsePacketsWith(setOptions, 443, c.packets...) {
+		switch record := msg.Record.(type) {
+		case *message.HTTP2Message:
+			calls = append(calls, record.GRPC)
+		case *message.TLSMessage:
+			if record.ServerName == "" && record.Certificate != nil {
+				handshake = record
+			}
+		default:
+			t.Fatalf("unexpected message %q", msg.Payload)
+		}
+	}
+	if handshake == nil {
+		t.Fatalf("encrypted handshake was not decrypted")
+	}
+	if strings.Join(handshake.ALPN, ",") != "h2" || !handshake.Certificate.NotAfter.Equal(notAfter) {
+		t.Errorf("unexpected encrypted handshake %+v", handshake)
+	}
+	if len(calls) != 2 || calls[0] == nil || calls[0].Method != "Hello" || calls[1] == nil ||
+		calls[1].Status == nil || *calls[1].Status != 0 || len(calls[1].Messages) != 1 {
+		t.Fatalf("unexpected gRPC calls %+v", calls)
+	}
+}